@@ -3,10 +3,13 @@ package client
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"net/url"
@@ -20,6 +23,7 @@ import (
 	"github.com/go-zoox/core-utils/strings"
 	"github.com/go-zoox/logger"
 	"github.com/go-zoox/safe"
+	"github.com/go-zoox/uuid"
 	"github.com/go-zoox/websocket"
 )
 
@@ -35,6 +39,8 @@ type Client interface {
 	Close() error
 	//
 	Exec(command *entities.Command) error
+	ExecAsync(command *entities.Command, opts ...func(opt *ExecOption)) (Execution, error)
+	Attach(id string, offset int64) error
 	Cancel() error
 	//
 	Output(command *entities.Command) (response string, err error)
@@ -72,6 +78,12 @@ type Config struct {
 	// ClientSecret is the client secret
 	ClientSecret string `config:"client_secret"`
 
+	// Token is the api token, used instead of client id and secret
+	Token string `config:"token"`
+
+	// Stdin is the standard input reader, which is streamed to the command if set
+	Stdin io.Reader
+
 	// Stdout is the standard output writer
 	Stdout io.Writer
 
@@ -83,23 +95,51 @@ type Config struct {
 
 	// Mode is the mode of client, can be "pipeline" or "command"
 	Mode string `config:"mode"`
+
+	// ProtocolVersion is the max protocol version to negotiate, default: latest
+	ProtocolVersion int `config:"protocol_version"`
+
+	// IsAutoReconnectDisabled disables reconnecting and reattaching to the running command when connection drops
+	IsAutoReconnectDisabled bool `config:"is_auto_reconnect_disabled"`
+
+	// ReconnectTimeout is how long to keep reconnecting, default: 30s
+	ReconnectTimeout time.Duration `config:"reconnect_timeout"`
+
+	// TLSCAFile is the CA bundle to verify the server certificate of wss://, default: system roots
+	TLSCAFile string `config:"tls_ca_file"`
+
+	// TLSCertFile is the client certificate of mTLS
+	TLSCertFile string `config:"tls_cert_file"`
+
+	// TLSKeyFile is the private key of client certificate
+	TLSKeyFile string `config:"tls_key_file"`
 }
 
 type client struct {
 	cfg *Config
 	//
-	exitCode chan int
-	//
 	stdout io.Writer
 	stderr io.Writer
 	//
 	closeCh chan struct{}
 	//
-	messageCh chan []byte
+	messageCh chan *entities.Envelope
 	//
 	isAuthenticated bool
 	authErrCh       chan error
-	authDoneCh      chan struct{}
+	// authDone is closed when the connection of current attempt is authenticated
+	authDone chan struct{}
+	// closeAttempt closes the connection of current attempt, which failed to authenticate
+	closeAttempt func()
+	//
+	isClosed bool
+	// executions is the commands running, which are reattached when reconnected
+	executions map[string]*execution
+	// latest is the latest execution, which v1 messages without command id apply to
+	latest *execution
+	//
+	version int
+	sync.Mutex
 
 	// //
 	// pipelineClient pipelineClient.Client
@@ -121,18 +161,28 @@ func New(cfg *Config) Client {
 		cfg.ExecTimeout = 7 * 24 * time.Hour
 	}
 
+	if cfg.ReconnectTimeout == 0 {
+		cfg.ReconnectTimeout = 30 * time.Second
+	}
+
+	if cfg.ProtocolVersion == 0 {
+		cfg.ProtocolVersion = entities.ProtocolVersion
+	}
+
 	return &client{
-		cfg:      cfg,
-		exitCode: make(chan int),
-		stdout:   stdout,
-		stderr:   stderr,
+		cfg:    cfg,
+		stdout: stdout,
+		stderr: stderr,
 		//
-		messageCh: make(chan []byte),
+		// messages are buffered while reconnecting
+		messageCh: make(chan *entities.Envelope, 64),
 		closeCh:   make(chan struct{}),
 		//
 		isAuthenticated: false,
 		authErrCh:       make(chan error),
-		authDoneCh:      make(chan struct{}),
+		//
+		executions: map[string]*execution{},
+		version:    entities.ProtocolVersion1,
 	}
 }
 
@@ -143,6 +193,13 @@ func (c *client) Connect() (err error) {
 	}
 	logger.Debugf("connecting to %s", u.String())
 
+	var tlsConfig *tls.Config
+	if c.cfg.TLSCAFile != "" || c.cfg.TLSCertFile != "" || c.cfg.TLSKeyFile != "" {
+		if tlsConfig, err = LoadTLSConfig(c.cfg.TLSCAFile, c.cfg.TLSCertFile, c.cfg.TLSKeyFile); err != nil {
+			return err
+		}
+	}
+
 	// if c.cfg.Mode == ModePipeline {
 	// 	pc := pipelineClient.New(&pipelineClient.Config{
 	// 		Server:   c.cfg.Server,
@@ -159,40 +216,77 @@ func (c *client) Connect() (err error) {
 	// 	return pc.Connect()
 	// }
 
-	wc, err := websocket.NewClient(func(opt *websocket.ClientOption) {
-		opt.Context = context.Background()
-		opt.Addr = u.String()
-	})
-	if err != nil {
-		return err
-	}
+	wc := newDialer(u.String(), tlsConfig)
 
 	wc.OnClose(func(conn websocket.Conn, code int, message string) error {
-		if !c.isAuthenticated {
+		c.Lock()
+		isAuthenticated, isClosed := c.isAuthenticated, c.isClosed
+		c.isAuthenticated = false
+		c.Unlock()
+		if !isAuthenticated || isClosed {
 			return nil
 		}
 
-		c.stderr.Write([]byte(fmt.Sprintf("connection closed from server: %s\n", message)))
-		c.exitCode <- 1
+		executions := c.runningExecutions()
+		if len(executions) != 0 && !c.cfg.IsAutoReconnectDisabled {
+			logger.Warnf("connection closed from server: %s, reconnecting ...", message)
+			go c.reconnect()
+			return nil
+		}
+
+		for _, e := range executions {
+			e.stderr.Write([]byte(fmt.Sprintf("connection closed from server: %s\n", message)))
+			e.exit(1, "connection closed from server")
+		}
 		return nil
 	})
 
 	wc.OnTextMessage(func(conn websocket.Conn, message []byte) error {
-		switch message[0] {
-		case entities.MessageCommandStdout:
-			c.stdout.Write(message[1:])
-		case entities.MessageCommandStderr:
-			c.stderr.Write(message[1:])
-		case entities.MessageCommandExitCode:
-			c.exitCode <- int(message[1])
-		case entities.MessageAuthResponseFailure:
-			c.authErrCh <- fmt.Errorf("%s", message[1:])
-		case entities.MessageAuthResponseSuccess:
+		// v1 message is decoded into envelope too
+		env, err := entities.DecodeEnvelope(message)
+		if err != nil {
+			logger.Errorf("invalid message: %s", err)
+			return nil
+		}
+
+		switch env.Type {
+		case entities.EnvelopeTypeOutput:
+			if e := c.route(env.CommandID); e != nil {
+				e.write(env)
+			}
+		case entities.EnvelopeTypeExit:
+			if e := c.route(env.CommandID); e != nil {
+				e.exit(env.ExitCode, env.Reason)
+			}
+		case entities.EnvelopeTypeAuthFailure:
+			c.authErrCh <- fmt.Errorf("%s", env.Reason)
+		case entities.EnvelopeTypeAuthSuccess:
+			// old server responses without version, which means v1
+			version := entities.ProtocolVersion1
+			if len(env.Payload) > 0 {
+				response := &entities.AuthResponse{}
+				if err := json.Unmarshal(env.Payload, response); err != nil {
+					c.authErrCh <- fmt.Errorf("invalid auth response: %s", err)
+					return nil
+				}
+				version = response.Version
+			}
+
+			c.Lock()
+			c.version = version
+			c.Unlock()
+
 			c.authErrCh <- nil
-		case entities.MessageCommandCancelResponse:
-			c.stderr.Write([]byte("command canceled\n"))
+		case entities.EnvelopeTypeQueued:
+			if e := c.route(env.CommandID); e != nil {
+				e.queued(env.Position)
+			}
+		case entities.EnvelopeTypeCancelResponse:
+			if e := c.route(env.CommandID); e != nil {
+				e.stderr.Write([]byte("command canceled\n"))
+			}
 		default:
-			logger.Errorf("unknown message type: %d", message[0])
+			logger.Errorf("unknown message type: %s", env.Type)
 		}
 
 		return nil
@@ -201,9 +295,22 @@ func (c *client) Connect() (err error) {
 	wc.OnConnect(func(conn websocket.Conn) error {
 		ctx, cancel := context.WithCancel(conn.Context())
 
+		authDone := make(chan struct{})
+		c.Lock()
+		c.authDone = authDone
+		c.closeAttempt = func() {
+			cancel()
+			conn.Close()
+		}
+		c.Unlock()
+
 		// close
 		go func() {
-			<-c.closeCh
+			select {
+			case <-c.closeCh:
+			case <-ctx.Done():
+				return
+			}
 			// logger.Infof("closing connection ...")
 			// logger.Infof("canceling context ...")
 			cancel()
@@ -218,6 +325,8 @@ func (c *client) Connect() (err error) {
 			authRequest := &entities.AuthRequest{
 				ClientID:     c.cfg.ClientID,
 				ClientSecret: c.cfg.ClientSecret,
+				Token:        c.cfg.Token,
+				Version:      c.cfg.ProtocolVersion,
 			}
 			message, err := json.Marshal(authRequest)
 			if err != nil {
@@ -232,7 +341,12 @@ func (c *client) Connect() (err error) {
 		}()
 
 		go func() {
-			<-c.authDoneCh
+			// the attempt failed to authenticate is closed
+			select {
+			case <-authDone:
+			case <-ctx.Done():
+				return
+			}
 
 			// heart beat
 			go func() {
@@ -243,7 +357,13 @@ func (c *client) Connect() (err error) {
 						return
 					case <-time.After(3 * time.Second):
 						// logger.Infof("heart beat ping ...")
-						if err := conn.WriteTextMessage([]byte{entities.MessagePing}); err != nil {
+						ping, err := c.encode(&entities.Envelope{Type: entities.EnvelopeTypePing})
+						if err != nil {
+							logger.Errorf("failed to encode ping: %s", err)
+							return
+						}
+
+						if err := conn.WriteTextMessage(ping); err != nil {
 							logger.Errorf("failed to send ping: %s", err)
 							return
 						}
@@ -257,7 +377,13 @@ func (c *client) Connect() (err error) {
 					select {
 					case <-ctx.Done():
 						return
-					case msg := <-c.messageCh:
+					case env := <-c.messageCh:
+						msg, err := c.encode(env)
+						if err != nil {
+							logger.Errorf("failed to encode message: %s", err)
+							continue
+						}
+
 						if err := conn.WriteTextMessage(msg); err != nil {
 							logger.Errorf("failed to send message: %s", err)
 							return
@@ -274,60 +400,271 @@ func (c *client) Connect() (err error) {
 		return err
 	}
 
-	if err := <-c.authErrCh; err != nil {
+	err = <-c.authErrCh
+
+	c.Lock()
+	authDone, closeAttempt := c.authDone, c.closeAttempt
+	c.authDone, c.closeAttempt = nil, nil
+	c.isAuthenticated = err == nil
+	c.Unlock()
+
+	if err != nil {
+		if closeAttempt != nil {
+			closeAttempt()
+		}
 		return err
 	}
-	c.authDoneCh <- struct{}{}
-	c.isAuthenticated = true
+	if authDone != nil {
+		close(authDone)
+	}
 
 	return
 }
 
-func (c *client) Exec(command *entities.Command) error {
-	go func() {
-		time.AfterFunc(c.cfg.ExecTimeout, func() {
-			c.stderr.Write([]byte("command exec timeout\n"))
-			c.exitCode <- 1
+// reconnect connects to server again, and reattaches to the running commands
+func (c *client) reconnect() {
+	deadline := time.Now().Add(c.cfg.ReconnectTimeout)
+	for attempt := 1; ; attempt++ {
+		time.Sleep(time.Duration(min(attempt, 5)) * time.Second)
+
+		c.Lock()
+		isClosed := c.isClosed
+		c.Unlock()
+		if isClosed {
+			return
+		}
+
+		logger.Debugf("reconnecting to %s (attempt: %d) ...", c.cfg.Server, attempt)
+		err := c.Connect()
+		if err == nil {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			for _, e := range c.runningExecutions() {
+				e.stderr.Write([]byte(fmt.Sprintf("failed to reconnect to server: %s\n", err)))
+				e.exit(1, "failed to reconnect to server")
+			}
+			return
+		}
+	}
+
+	for _, e := range c.runningExecutions() {
+		payload, err := json.Marshal(e.attachRequest())
+		if err != nil {
+			e.stderr.Write([]byte(fmt.Sprintf("failed to marshal attach request: %s\n", err)))
+			e.exit(1, "failed to reattach")
+			continue
+		}
+
+		c.send(&entities.Envelope{
+			Type:      entities.EnvelopeTypeAttachRequest,
+			CommandID: e.id,
+			Payload:   payload,
 		})
-	}()
+	}
+}
 
-	message, err := json.Marshal(command)
+func (c *client) Exec(command *entities.Command) error {
+	e, err := c.ExecAsync(command)
 	if err != nil {
-		return &ExitError{
+		return err
+	}
+
+	return e.Wait()
+}
+
+// ExecAsync sends the command to run, returns the handle to wait or cancel,
+//
+//	multiple commands can run over one connection if server supports protocol v2.
+func (c *client) ExecAsync(command *entities.Command, opts ...func(opt *ExecOption)) (Execution, error) {
+	opt := &ExecOption{
+		Stdin:  c.cfg.Stdin,
+		Stdout: c.stdout,
+		Stderr: c.stderr,
+	}
+	for _, o := range opts {
+		o(opt)
+	}
+
+	if opt.Stdin != nil {
+		command.Stdin = true
+	}
+
+	// the command id is required to route messages and reattach
+	if command.ID == "" {
+		command.ID = uuid.V4()
+	}
+
+	payload, err := json.Marshal(command)
+	if err != nil {
+		return nil, &ExitError{
 			ExitCode: 1,
 			Message:  fmt.Sprintf("failed to marshal command request: %s", err),
 		}
 	}
 
-	c.messageCh <- append([]byte{entities.MessageCommand}, message...)
+	e, err := c.addExecution(command.ID, opt)
+	if err != nil {
+		return nil, err
+	}
 
-	exitCode := <-c.exitCode
+	c.send(&entities.Envelope{
+		Type:      entities.EnvelopeTypeCommand,
+		CommandID: e.id,
+		Payload:   payload,
+	})
 
-	if exitCode == 0 {
-		return nil
+	if command.Stdin {
+		go c.streamStdin(e.id, opt.Stdin)
 	}
 
-	return &ExitError{
-		ExitCode: exitCode,
+	return e, nil
+}
+
+// Attach attaches to the running command by id, replays its output from offset,
+//
+//	offset < 0 means no replay.
+func (c *client) Attach(id string, offset int64) error {
+	payload, err := json.Marshal(&entities.AttachRequest{
+		ID:     id,
+		Offset: offset,
+	})
+	if err != nil {
+		return &ExitError{
+			ExitCode: 1,
+			Message:  fmt.Sprintf("failed to marshal attach request: %s", err),
+		}
 	}
+
+	e, err := c.addExecution(id, &ExecOption{
+		Stdout: c.stdout,
+		Stderr: c.stderr,
+	})
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&e.offset, max(offset, 0))
+
+	c.send(&entities.Envelope{
+		Type:      entities.EnvelopeTypeAttachRequest,
+		CommandID: id,
+		Payload:   payload,
+	})
+
+	return e.Wait()
 }
 
+// streamStdin sends stdin to server in chunks, ends with EOF message
+func (c *client) streamStdin(id string, stdin io.Reader) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := stdin.Read(buf)
+		if n > 0 {
+			chunk := make([]byte, n)
+			copy(chunk, buf[:n])
+			c.send(&entities.Envelope{Type: entities.EnvelopeTypeStdin, CommandID: id, Data: chunk})
+		}
+
+		if err != nil {
+			if err != io.EOF {
+				logger.Errorf("failed to read stdin: %s", err)
+			}
+
+			c.send(&entities.Envelope{Type: entities.EnvelopeTypeStdinEOF, CommandID: id})
+			return
+		}
+	}
+}
+
+// Cancel cancels the latest command
 func (c *client) Cancel() error {
-	c.messageCh <- []byte{entities.MessageCommandCancelRequest}
+	c.Lock()
+	e := c.latest
+	c.Unlock()
 
-	exitCode := <-c.exitCode
+	if e == nil {
+		return fmt.Errorf("no command to cancel")
+	}
 
-	if exitCode == 0 {
-		return nil
+	return e.Cancel()
+}
+
+// send sends the message, it is encoded in the negotiated protocol version,
+//
+//	it waits while reconnecting if the buffer is full, and drops the message once closed.
+func (c *client) send(env *entities.Envelope) {
+	select {
+	case c.messageCh <- env:
+	case <-c.closeCh:
+	}
+}
+
+// encode encodes the envelope in v1 framing if protocol v2 is not negotiated
+func (c *client) encode(env *entities.Envelope) ([]byte, error) {
+	c.Lock()
+	version := c.version
+	c.Unlock()
+
+	if version < entities.ProtocolVersion2 {
+		return env.Message()
+	}
+
+	return json.Marshal(env)
+}
+
+// addExecution registers the execution, v1 server can only run one command at a time
+func (c *client) addExecution(id string, opt *ExecOption) (*execution, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.version < entities.ProtocolVersion2 && len(c.executions) != 0 {
+		return nil, fmt.Errorf("server does not support running multiple commands over one connection")
 	}
 
-	close(c.exitCode)
+	if _, ok := c.executions[id]; ok {
+		return nil, fmt.Errorf("command(%s) is already running", id)
+	}
+
+	e := newExecution(c, id, opt)
+	c.executions[id] = e
+	c.latest = e
+	return e, nil
+}
 
-	return &ExitError{
-		ExitCode: exitCode,
+func (c *client) removeExecution(e *execution) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.executions[e.id] == e {
+		delete(c.executions, e.id)
 	}
 }
 
+// route returns the execution of message, the latest one if command id is empty
+func (c *client) route(id string) *execution {
+	c.Lock()
+	defer c.Unlock()
+
+	if id == "" {
+		return c.latest
+	}
+
+	return c.executions[id]
+}
+
+func (c *client) runningExecutions() []*execution {
+	c.Lock()
+	defer c.Unlock()
+
+	executions := make([]*execution, 0, len(c.executions))
+	for _, e := range c.executions {
+		executions = append(executions, e)
+	}
+
+	return executions
+}
+
 func (c *client) Output(command *entities.Command) (response string, err error) {
 	responseBuf := NewBufWriter()
 
@@ -345,8 +682,12 @@ func (c *client) Close() error {
 	// 	return c.pipelineClient.Close()
 	// }
 
+	c.Lock()
+	c.isClosed = true
+	c.Unlock()
+
+	// the connection may be dropped already, so close instead of send
 	return safe.Do(func() error {
-		c.closeCh <- struct{}{}
 		close(c.closeCh)
 		return nil
 	})
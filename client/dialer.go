@@ -0,0 +1,106 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/go-zoox/logger"
+	"github.com/go-zoox/websocket"
+	wsconn "github.com/go-zoox/websocket/conn"
+	gorilla "github.com/gorilla/websocket"
+)
+
+// dialer is the websocket client with its own dialer, so the tls config of one client
+//
+//	does not apply to the other connections of process.
+type dialer struct {
+	addr   string
+	dialer *gorilla.Dialer
+	//
+	onConnect     []func(conn websocket.Conn) error
+	onClose       []func(conn websocket.Conn, code int, message string) error
+	onTextMessage []func(conn websocket.Conn, message []byte) error
+}
+
+func newDialer(addr string, tlsConfig *tls.Config) *dialer {
+	return &dialer{
+		addr: addr,
+		dialer: &gorilla.Dialer{
+			Proxy:            http.ProxyFromEnvironment,
+			HandshakeTimeout: 30 * time.Second,
+			TLSClientConfig:  tlsConfig,
+		},
+	}
+}
+
+func (d *dialer) OnConnect(cb func(conn websocket.Conn) error) {
+	d.onConnect = append(d.onConnect, cb)
+}
+
+func (d *dialer) OnClose(cb func(conn websocket.Conn, code int, message string) error) {
+	d.onClose = append(d.onClose, cb)
+}
+
+func (d *dialer) OnTextMessage(cb func(conn websocket.Conn, message []byte) error) {
+	d.onTextMessage = append(d.onTextMessage, cb)
+}
+
+// Connect dials the server, and handles the messages in order until the connection is closed
+func (d *dialer) Connect() error {
+	ctx := context.Background()
+	raw, response, err := d.dialer.DialContext(ctx, d.addr, nil)
+	if err != nil {
+		if response == nil || response.Body == nil {
+			return fmt.Errorf("failed to connect at %s (error: %s)", d.addr, err)
+		}
+
+		body, _ := io.ReadAll(response.Body)
+		return fmt.Errorf("failed to connect at %s (status: %d, response: %s, error: %v)", d.addr, response.StatusCode, string(body), err)
+	}
+
+	conn := wsconn.New(ctx, raw, nil)
+	// server heartbeat
+	raw.SetPingHandler(func(appData string) error {
+		return conn.Pong([]byte(appData))
+	})
+
+	for _, cb := range d.onConnect {
+		if err := cb(conn); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+
+	go func() {
+		for {
+			typ, message, err := raw.ReadMessage()
+			if err != nil {
+				if errx, ok := err.(*gorilla.CloseError); ok {
+					for _, cb := range d.onClose {
+						cb(conn, errx.Code, errx.Text)
+					}
+					return
+				}
+
+				logger.Debugf("connection to %s is closed: %s", d.addr, err)
+				return
+			}
+
+			if typ != gorilla.TextMessage {
+				continue
+			}
+
+			for _, cb := range d.onTextMessage {
+				if err := cb(conn, message); err != nil {
+					logger.Errorf("failed to handle message: %s", err)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,137 @@
+package client
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-idp/agent/entities"
+	"github.com/go-zoox/logger"
+)
+
+// Execution is the handle of command running asynchronously
+type Execution interface {
+	// ID returns the id of command
+	ID() string
+	// Wait waits for the command to exit, returns ExitError if exit code is not 0
+	Wait() error
+	// Cancel cancels the command, and waits for it to exit
+	Cancel() error
+}
+
+// ExecOption is the option of async execution
+type ExecOption struct {
+	// Stdin is the standard input reader, default: Config.Stdin
+	Stdin io.Reader
+	// Stdout is the standard output writer, default: Config.Stdout
+	Stdout io.Writer
+	// Stderr is the standard error writer, default: Config.Stderr
+	Stderr io.Writer
+	// OnQueued is called with the position when the command waits in queue or moves forward, protocol v2 only
+	OnQueued func(position int)
+}
+
+type execution struct {
+	client *client
+	//
+	id     string
+	stdout io.Writer
+	stderr io.Writer
+	//
+	onQueued func(position int)
+	// offset is the bytes of output received, used to replay when reattached
+	offset int64
+	//
+	done     chan struct{}
+	once     sync.Once
+	exitCode int
+	reason   string
+	//
+	timer *time.Timer
+}
+
+func newExecution(c *client, id string, opt *ExecOption) *execution {
+	e := &execution{
+		client:   c,
+		id:       id,
+		stdout:   opt.Stdout,
+		stderr:   opt.Stderr,
+		onQueued: opt.OnQueued,
+		done:     make(chan struct{}),
+	}
+
+	e.timer = time.AfterFunc(c.cfg.ExecTimeout, func() {
+		e.stderr.Write([]byte("command exec timeout\n"))
+		e.exit(1, "command exec timeout")
+	})
+
+	return e
+}
+
+func (e *execution) ID() string {
+	return e.id
+}
+
+func (e *execution) Wait() error {
+	<-e.done
+
+	if e.exitCode == 0 {
+		return nil
+	}
+
+	return &ExitError{
+		ExitCode: e.exitCode,
+		Message:  e.reason,
+	}
+}
+
+func (e *execution) Cancel() error {
+	e.client.send(&entities.Envelope{
+		Type:      entities.EnvelopeTypeCancelRequest,
+		CommandID: e.id,
+	})
+
+	return e.Wait()
+}
+
+// write writes output of command
+func (e *execution) write(env *entities.Envelope) {
+	atomic.AddInt64(&e.offset, int64(len(env.Data)))
+
+	if env.Stream == entities.StreamStderr {
+		e.stderr.Write(env.Data)
+	} else {
+		e.stdout.Write(env.Data)
+	}
+}
+
+// queued reports the position of command in queue
+func (e *execution) queued(position int) {
+	if e.onQueued != nil {
+		e.onQueued(position)
+		return
+	}
+
+	logger.Infof("[client] command %s is queued (position: %d)", e.id, position)
+}
+
+// exit marks the command exited, only the first exit takes effect
+func (e *execution) exit(code int, reason string) {
+	e.once.Do(func() {
+		e.timer.Stop()
+		e.client.removeExecution(e)
+
+		e.exitCode = code
+		e.reason = reason
+		close(e.done)
+	})
+}
+
+// attachRequest returns the request to reattach with the output received
+func (e *execution) attachRequest() *entities.AttachRequest {
+	return &entities.AttachRequest{
+		ID:     e.id,
+		Offset: atomic.LoadInt64(&e.offset),
+	}
+}
@@ -18,6 +18,10 @@ type Config struct {
 	Server       string `config:"server"`
 	ClientID     string `config:"client_id"`
 	ClientSecret string `config:"client_secret"`
+	Token        string `config:"token"`
+	TLSCAFile    string `config:"tls_ca_file"`
+	TLSCertFile  string `config:"tls_cert_file"`
+	TLSKeyFile   string `config:"tls_key_file"`
 }
 
 func RegistryClient(app *cli.MultipleProgram) {
@@ -49,6 +53,26 @@ func RegistryClient(app *cli.MultipleProgram) {
 				Usage:   "Auth Client Secret",
 				EnvVars: []string{"CAAS_CLIENT_SECRET"},
 			},
+			&cli.StringFlag{
+				Name:    "token",
+				Usage:   "Auth API Token",
+				EnvVars: []string{"CAAS_TOKEN"},
+			},
+			&cli.StringFlag{
+				Name:    "tls-ca",
+				Usage:   "TLS CA file to verify server certificate",
+				EnvVars: []string{"CAAS_TLS_CA"},
+			},
+			&cli.StringFlag{
+				Name:    "tls-cert",
+				Usage:   "TLS client certificate file (mTLS)",
+				EnvVars: []string{"CAAS_TLS_CERT"},
+			},
+			&cli.StringFlag{
+				Name:    "tls-key",
+				Usage:   "TLS client private key file (mTLS)",
+				EnvVars: []string{"CAAS_TLS_KEY"},
+			},
 			//
 			&cli.StringFlag{
 				Name:    "scriptfile",
@@ -60,6 +84,11 @@ func RegistryClient(app *cli.MultipleProgram) {
 				Usage:   "specify command envfile file path",
 				EnvVars: []string{"CAAS_ENV_FILE"},
 			},
+			&cli.StringSliceFlag{
+				Name:    "secret",
+				Usage:   "specify secret env, format: key=value, which is never persisted and masked in output",
+				EnvVars: []string{"CAAS_SECRETS"},
+			},
 			&cli.StringFlag{
 				Name:    "user",
 				Usage:   "specify command user",
@@ -76,6 +105,11 @@ func RegistryClient(app *cli.MultipleProgram) {
 				Usage:   "specify workdir base, which to run workdir = workdirbase + id",
 				EnvVars: []string{"CAAS_WORKDIR_BASE"},
 			},
+			&cli.BoolFlag{
+				Name:    "stdin",
+				Usage:   "stream stdin to command, example: tar c . | agent client --stdin --script 'tar x'",
+				EnvVars: []string{"CAAS_STDIN"},
+			},
 			// &cli.StringFlag{
 			// 	Name:    "pipeline",
 			// 	Usage:   "specify pipeline",
@@ -100,9 +134,29 @@ func RegistryClient(app *cli.MultipleProgram) {
 				cfg.ClientSecret = ctx.String("client-secret")
 			}
 
+			if ctx.String("token") != "" {
+				cfg.Token = ctx.String("token")
+			}
+
+			if ctx.String("tls-ca") != "" {
+				cfg.TLSCAFile = ctx.String("tls-ca")
+			}
+
+			if ctx.String("tls-cert") != "" {
+				cfg.TLSCertFile = ctx.String("tls-cert")
+			}
+
+			if ctx.String("tls-key") != "" {
+				cfg.TLSKeyFile = ctx.String("tls-key")
+			}
+
 			// add scheme
 			if !regexp.Match("^wss?://", cfg.Server) {
-				cfg.Server = fmt.Sprintf("ws://%s", cfg.Server)
+				scheme := "ws"
+				if cfg.TLSCAFile != "" || cfg.TLSCertFile != "" {
+					scheme = "wss"
+				}
+				cfg.Server = fmt.Sprintf("%s://%s", scheme, cfg.Server)
 
 				// add port
 				if !regexp.Match(":\\d+$", cfg.Server) {
@@ -180,14 +234,32 @@ func RegistryClient(app *cli.MultipleProgram) {
 				}
 			}
 
+			secrets := map[string]string{}
+			for _, secret := range ctx.StringSlice("secret") {
+				parts := strings.SplitN(secret, "=", 2)
+				if len(parts) != 2 {
+					return fmt.Errorf("invalid secret: %s", parts[0])
+				}
+
+				secrets[parts[0]] = parts[1]
+			}
+
 			clientCfg := &client.Config{
 				Server:       cfg.Server,
 				ClientID:     cfg.ClientID,
 				ClientSecret: cfg.ClientSecret,
+				Token:        cfg.Token,
+				TLSCAFile:    cfg.TLSCAFile,
+				TLSCertFile:  cfg.TLSCertFile,
+				TLSKeyFile:   cfg.TLSKeyFile,
 				Stdout:       os.Stdout,
 				Stderr:       os.Stderr,
 			}
 
+			if ctx.Bool("stdin") {
+				clientCfg.Stdin = os.Stdin
+			}
+
 			// run pipeline
 			if v := ctx.String("pipeline"); v != "" {
 				clientCfg.Mode = client.ModePipeline
@@ -244,6 +316,7 @@ func RegistryClient(app *cli.MultipleProgram) {
 					ID:          ctx.String("job-id"),
 					Script:      script,
 					Environment: environment,
+					Secrets:     secrets,
 					WorkDirBase: ctx.String("workdir-base"),
 					//
 					User: ctx.String("user"),
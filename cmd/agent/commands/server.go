@@ -34,6 +34,26 @@ func RegistryServer(app *cli.MultipleProgram) {
 				EnvVars: []string{"CAAS_METADATA_DIR"},
 				Value:   "/tmp/agent/metadata",
 			},
+			&cli.IntFlag{
+				Name:    "max-concurrent-commands",
+				Usage:   "specify max number of commands running at once, the others wait in queue, default: 0 (unlimited)",
+				EnvVars: []string{"CAAS_MAX_CONCURRENT_COMMANDS"},
+			},
+			&cli.IntFlag{
+				Name:    "max-queued-commands",
+				Usage:   "specify max number of commands waiting in queue, the others are rejected, default: 0 (unlimited)",
+				EnvVars: []string{"CAAS_MAX_QUEUED_COMMANDS"},
+			},
+			&cli.StringFlag{
+				Name:    "policy-file",
+				Usage:   "Command Policy File (JSON), which commands are allowed by",
+				EnvVars: []string{"CAAS_POLICY_FILE"},
+			},
+			&cli.StringFlag{
+				Name:    "metadata-encryption-key",
+				Usage:   "specify metadata encryption key, which encrypts script, env and log with AES-GCM, base64 encoded 32 bytes",
+				EnvVars: []string{"CAAS_METADATA_ENCRYPTION_KEY"},
+			},
 			&cli.StringFlag{
 				Name:    "workdir",
 				Usage:   "specify command workdir",
@@ -57,6 +77,76 @@ func RegistryServer(app *cli.MultipleProgram) {
 				Usage:   "Auth Client Secret",
 				EnvVars: []string{"CAAS_CLIENT_SECRET"},
 			},
+			&cli.StringFlag{
+				Name:    "tokens-file",
+				Usage:   "Auth API Tokens File (JSON)",
+				EnvVars: []string{"CAAS_TOKENS_FILE"},
+			},
+			&cli.StringFlag{
+				Name:    "jwt-secret",
+				Usage:   "Auth JWT HMAC Secret",
+				EnvVars: []string{"CAAS_JWT_SECRET"},
+			},
+			&cli.StringFlag{
+				Name:    "jwt-public-key-file",
+				Usage:   "Auth JWT RSA/ECDSA Public Key File (PEM)",
+				EnvVars: []string{"CAAS_JWT_PUBLIC_KEY_FILE"},
+			},
+			&cli.StringFlag{
+				Name:    "jwt-jwks-file",
+				Usage:   "Auth JWT JWKS File",
+				EnvVars: []string{"CAAS_JWT_JWKS_FILE"},
+			},
+			&cli.StringFlag{
+				Name:    "jwt-issuer",
+				Usage:   "Auth JWT Issuer required",
+				EnvVars: []string{"CAAS_JWT_ISSUER"},
+			},
+			&cli.StringFlag{
+				Name:    "jwt-audience",
+				Usage:   "Auth JWT Audience required",
+				EnvVars: []string{"CAAS_JWT_AUDIENCE"},
+			},
+			&cli.StringFlag{
+				Name:    "auth-service",
+				Usage:   "Auth Service URL, which verifies credentials",
+				EnvVars: []string{"CAAS_AUTH_SERVICE"},
+			},
+			&cli.Int64Flag{
+				Name:    "auth-service-timeout",
+				Usage:   "Auth Service request timeout, in seconds, default: 5",
+				EnvVars: []string{"CAAS_AUTH_SERVICE_TIMEOUT"},
+			},
+			&cli.Int64Flag{
+				Name:    "auth-service-cache-ttl",
+				Usage:   "Auth Service cache ttl of credentials accepted, in seconds, default: 60",
+				EnvVars: []string{"CAAS_AUTH_SERVICE_CACHE_TTL"},
+			},
+			&cli.Int64Flag{
+				Name:    "auth-service-negative-cache-ttl",
+				Usage:   "Auth Service cache ttl of credentials rejected, in seconds, default: 10",
+				EnvVars: []string{"CAAS_AUTH_SERVICE_NEGATIVE_CACHE_TTL"},
+			},
+			&cli.Int64Flag{
+				Name:    "auth-service-retries",
+				Usage:   "Auth Service retries when it fails, -1 to disable, default: 2",
+				EnvVars: []string{"CAAS_AUTH_SERVICE_RETRIES"},
+			},
+			&cli.Int64Flag{
+				Name:    "auth-service-breaker-threshold",
+				Usage:   "Auth Service failures in a row to open circuit breaker, default: 5",
+				EnvVars: []string{"CAAS_AUTH_SERVICE_BREAKER_THRESHOLD"},
+			},
+			&cli.Int64Flag{
+				Name:    "auth-service-breaker-cooldown",
+				Usage:   "Auth Service circuit breaker cooldown, in seconds, default: 30",
+				EnvVars: []string{"CAAS_AUTH_SERVICE_BREAKER_COOLDOWN"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "auth-service-scopes",
+				Usage:   "Scopes of Auth Service identities, unless scopes are in response, default: exec, read-logs, cancel",
+				EnvVars: []string{"CAAS_AUTH_SERVICE_SCOPES"},
+			},
 			&cli.Int64Flag{
 				Name:    "timeout",
 				Usage:   "specify command timeout, in seconds, default: 86400 (1d)",
@@ -85,6 +175,11 @@ func RegistryServer(app *cli.MultipleProgram) {
 				Usage:   "Disable command cancel on close, default: false",
 				EnvVars: []string{"CAAS_DISABLE_COMMAND_CANCEL_ON_CLOSE"},
 			},
+			&cli.Int64Flag{
+				Name:    "command-reattach-timeout",
+				Usage:   "specify how long (seconds) the command keeps running for reattach after connection closed, negative cancels immediately, default: 30",
+				EnvVars: []string{"CAAS_COMMAND_REATTACH_TIMEOUT"},
+			},
 			&cli.StringFlag{
 				Name:    "terminal-path",
 				Usage:   "specify terminal path",
@@ -121,6 +216,71 @@ func RegistryServer(app *cli.MultipleProgram) {
 				Usage:   "specify terminal relay",
 				EnvVars: []string{"CAAS_TERMINAL_RELAY"},
 			},
+			&cli.StringFlag{
+				Name:    "command-store",
+				Usage:   "specify command history store, options: memory, bolt, default: memory",
+				EnvVars: []string{"CAAS_COMMAND_STORE"},
+			},
+			&cli.StringFlag{
+				Name:    "command-store-path",
+				Usage:   "specify command history store file path for bolt, default: /tmp/agent/commands.db",
+				EnvVars: []string{"CAAS_COMMAND_STORE_PATH"},
+			},
+			&cli.IntFlag{
+				Name:    "command-retention-count",
+				Usage:   "specify max number of commands to retain, default: 100 for memory store, unlimited for bolt store",
+				EnvVars: []string{"CAAS_COMMAND_RETENTION_COUNT"},
+			},
+			&cli.Int64Flag{
+				Name:    "command-retention-age",
+				Usage:   "specify max age of commands to retain, in seconds, default: 0 (unlimited)",
+				EnvVars: []string{"CAAS_COMMAND_RETENTION_AGE"},
+			},
+			&cli.StringFlag{
+				Name:    "tls-cert",
+				Usage:   "TLS certificate file, which serves https and wss",
+				EnvVars: []string{"CAAS_TLS_CERT"},
+			},
+			&cli.StringFlag{
+				Name:    "tls-key",
+				Usage:   "TLS private key file",
+				EnvVars: []string{"CAAS_TLS_KEY"},
+			},
+			&cli.StringFlag{
+				Name:    "tls-client-ca",
+				Usage:   "TLS CA file to verify client certificates, whose CN is the identity",
+				EnvVars: []string{"CAAS_TLS_CLIENT_CA"},
+			},
+			&cli.BoolFlag{
+				Name:    "tls-client-cert-required",
+				Usage:   "Require client certificate (mTLS)",
+				EnvVars: []string{"CAAS_TLS_CLIENT_CERT_REQUIRED"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "tls-client-scopes",
+				Usage:   "Scopes of client certificate identities, default: exec, read-logs, cancel",
+				EnvVars: []string{"CAAS_TLS_CLIENT_SCOPES"},
+			},
+			&cli.StringFlag{
+				Name:    "audit-log",
+				Usage:   "specify audit log file path, which enables audit log",
+				EnvVars: []string{"CAAS_AUDIT_LOG"},
+			},
+			&cli.Int64Flag{
+				Name:    "audit-log-max-size",
+				Usage:   "specify max size of audit log before rotated, in MB, default: 10",
+				EnvVars: []string{"CAAS_AUDIT_LOG_MAX_SIZE"},
+			},
+			&cli.IntFlag{
+				Name:    "audit-log-max-backups",
+				Usage:   "specify max number of rotated audit logs to keep, default: 5",
+				EnvVars: []string{"CAAS_AUDIT_LOG_MAX_BACKUPS"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "trusted-proxies",
+				Usage:   "Addresses or CIDRs of proxies whose X-Forwarded-For is trusted",
+				EnvVars: []string{"CAAS_TRUSTED_PROXIES"},
+			},
 			&cli.BoolFlag{
 				Name:    "auto-report",
 				Usage:   "Auto report command status",
@@ -145,6 +305,22 @@ func RegistryServer(app *cli.MultipleProgram) {
 				cfg.MetadataDir = ctx.String("metadata-dir")
 			}
 
+			if v := ctx.Int("max-concurrent-commands"); v != 0 {
+				cfg.MaxConcurrentCommands = v
+			}
+
+			if v := ctx.Int("max-queued-commands"); v != 0 {
+				cfg.MaxQueuedCommands = v
+			}
+
+			if ctx.String("policy-file") != "" {
+				cfg.PolicyFile = ctx.String("policy-file")
+			}
+
+			if ctx.String("metadata-encryption-key") != "" {
+				cfg.MetadataEncryptionKey = ctx.String("metadata-encryption-key")
+			}
+
 			if ctx.String("workdir") != "" {
 				cfg.WorkDir = ctx.String("workdir")
 			}
@@ -178,6 +354,62 @@ func RegistryServer(app *cli.MultipleProgram) {
 				cfg.ClientSecret = ctx.String("client-secret")
 			}
 
+			if ctx.String("tokens-file") != "" {
+				cfg.TokensFile = ctx.String("tokens-file")
+			}
+
+			if ctx.String("jwt-secret") != "" {
+				cfg.JWTSecret = ctx.String("jwt-secret")
+			}
+
+			if ctx.String("jwt-public-key-file") != "" {
+				cfg.JWTPublicKeyFile = ctx.String("jwt-public-key-file")
+			}
+
+			if ctx.String("jwt-jwks-file") != "" {
+				cfg.JWTJWKSFile = ctx.String("jwt-jwks-file")
+			}
+
+			if ctx.String("jwt-issuer") != "" {
+				cfg.JWTIssuer = ctx.String("jwt-issuer")
+			}
+
+			if ctx.String("jwt-audience") != "" {
+				cfg.JWTAudience = ctx.String("jwt-audience")
+			}
+
+			if ctx.String("auth-service") != "" {
+				cfg.AuthService = ctx.String("auth-service")
+			}
+
+			if v := ctx.Int64("auth-service-timeout"); v != 0 {
+				cfg.AuthServiceTimeout = v
+			}
+
+			if v := ctx.Int64("auth-service-cache-ttl"); v != 0 {
+				cfg.AuthServiceCacheTTL = v
+			}
+
+			if v := ctx.Int64("auth-service-negative-cache-ttl"); v != 0 {
+				cfg.AuthServiceNegativeCacheTTL = v
+			}
+
+			if v := ctx.Int64("auth-service-retries"); v != 0 {
+				cfg.AuthServiceRetries = v
+			}
+
+			if v := ctx.Int64("auth-service-breaker-threshold"); v != 0 {
+				cfg.AuthServiceBreakerThreshold = v
+			}
+
+			if v := ctx.Int64("auth-service-breaker-cooldown"); v != 0 {
+				cfg.AuthServiceBreakerCooldown = v
+			}
+
+			if v := ctx.StringSlice("auth-service-scopes"); len(v) != 0 {
+				cfg.AuthServiceScopes = v
+			}
+
 			if ctx.Bool("enable-clean-workdir") {
 				cfg.IsCleanWorkDirEnabled = ctx.Bool("enable-clean-workdir")
 			}
@@ -190,6 +422,10 @@ func RegistryServer(app *cli.MultipleProgram) {
 				cfg.IsCommandCancelOnCloseDisabled = ctx.Bool("disable-command-cancel-on-close")
 			}
 
+			if ctx.Int64("command-reattach-timeout") != 0 {
+				cfg.CommandReattachTimeout = ctx.Int64("command-reattach-timeout")
+			}
+
 			if ctx.String("terminal-path") != "" {
 				cfg.TerminalPath = ctx.String("terminal-path")
 			}
@@ -218,6 +454,58 @@ func RegistryServer(app *cli.MultipleProgram) {
 				cfg.TerminalRelay = ctx.String("terminal-relay")
 			}
 
+			if ctx.String("command-store") != "" {
+				cfg.CommandStore = ctx.String("command-store")
+			}
+
+			if ctx.String("command-store-path") != "" {
+				cfg.CommandStorePath = ctx.String("command-store-path")
+			}
+
+			if v := ctx.Int("command-retention-count"); v != 0 {
+				cfg.CommandRetentionCount = v
+			}
+
+			if v := ctx.Int64("command-retention-age"); v != 0 {
+				cfg.CommandRetentionAge = v
+			}
+
+			if ctx.String("tls-cert") != "" {
+				cfg.TLSCertFile = ctx.String("tls-cert")
+			}
+
+			if ctx.String("tls-key") != "" {
+				cfg.TLSKeyFile = ctx.String("tls-key")
+			}
+
+			if ctx.String("tls-client-ca") != "" {
+				cfg.TLSClientCAFile = ctx.String("tls-client-ca")
+			}
+
+			if v := ctx.Bool("tls-client-cert-required"); v {
+				cfg.IsTLSClientCertRequired = true
+			}
+
+			if v := ctx.StringSlice("tls-client-scopes"); len(v) != 0 {
+				cfg.TLSClientScopes = v
+			}
+
+			if ctx.String("audit-log") != "" {
+				cfg.AuditLog = ctx.String("audit-log")
+			}
+
+			if v := ctx.Int64("audit-log-max-size"); v != 0 {
+				cfg.AuditLogMaxSize = v
+			}
+
+			if v := ctx.Int("audit-log-max-backups"); v != 0 {
+				cfg.AuditLogMaxBackups = v
+			}
+
+			if v := ctx.StringSlice("trusted-proxies"); len(v) != 0 {
+				cfg.TrustedProxies = v
+			}
+
 			if v := ctx.Bool("auto-report"); v {
 				cfg.IsAutoReport = true
 			}
@@ -8,11 +8,13 @@ import (
 	"strings"
 	"syscall"
 
+	agentClient "github.com/go-idp/agent/client"
 	"github.com/go-idp/agent/constants"
 	"github.com/go-zoox/cli"
 	"github.com/go-zoox/core-utils/regexp"
 	"github.com/go-zoox/fs"
 	"github.com/go-zoox/terminal/client"
+	gorilla "github.com/gorilla/websocket"
 	"golang.org/x/term"
 )
 
@@ -38,6 +40,21 @@ func RegistryShell(app *cli.MultipleProgram) {
 				Usage:   "Auth Client Secret",
 				EnvVars: []string{"CAAS_CLIENT_SECRET"},
 			},
+			&cli.StringFlag{
+				Name:    "tls-ca",
+				Usage:   "TLS CA file to verify server certificate",
+				EnvVars: []string{"CAAS_TLS_CA"},
+			},
+			&cli.StringFlag{
+				Name:    "tls-cert",
+				Usage:   "TLS client certificate file (mTLS)",
+				EnvVars: []string{"CAAS_TLS_CERT"},
+			},
+			&cli.StringFlag{
+				Name:    "tls-key",
+				Usage:   "TLS client private key file (mTLS)",
+				EnvVars: []string{"CAAS_TLS_KEY"},
+			},
 			&cli.StringFlag{
 				Name:    "command",
 				Usage:   "specify exec command",
@@ -141,9 +158,27 @@ func RegistryShell(app *cli.MultipleProgram) {
 				Password: ctx.String("client-secret"),
 			}
 
+			isTLS := ctx.String("tls-ca") != "" || ctx.String("tls-cert") != ""
+			if isTLS || ctx.String("tls-key") != "" {
+				tlsConfig, err := agentClient.LoadTLSConfig(ctx.String("tls-ca"), ctx.String("tls-cert"), ctx.String("tls-key"))
+				if err != nil {
+					return err
+				}
+
+				// the terminal client dials by the default dialer only,
+				//	the shell is the only connection of this process.
+				dialer := *gorilla.DefaultDialer
+				dialer.TLSClientConfig = tlsConfig
+				gorilla.DefaultDialer = &dialer
+			}
+
 			// add scheme
 			if !regexp.Match("^wss?://", cfg.Server) {
-				cfg.Server = fmt.Sprintf("ws://%s", cfg.Server)
+				scheme := "ws"
+				if isTLS {
+					scheme = "wss"
+				}
+				cfg.Server = fmt.Sprintf("%s://%s", scheme, cfg.Server)
 
 				// add port
 				if !regexp.Match(":\\d+$", cfg.Server) {
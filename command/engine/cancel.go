@@ -1,5 +1,9 @@
 package idp
 
 func (c *idp) Cancel() error {
+	if c.client == nil {
+		return nil
+	}
+
 	return c.client.Close()
 }
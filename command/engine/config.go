@@ -13,6 +13,8 @@ type Config struct {
 	Server       string
 	ClientID     string
 	ClientSecret string
+	// TerminalPath is the path of agent web terminal, default: /terminal
+	TerminalPath string
 
 	// Custom Command Runner ID
 	ID string
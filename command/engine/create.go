@@ -16,13 +16,17 @@ func (c *idp) create() error {
 		return errors.New("command: server is required")
 	}
 
-	c.client = client.New(&client.Config{
+	return nil
+}
+
+// newClient creates the agent client, after stdio is set.
+func (c *idp) newClient() client.Client {
+	return client.New(&client.Config{
 		Server:       c.cfg.Server,
 		ClientID:     c.cfg.ClientID,
 		ClientSecret: c.cfg.ClientSecret,
+		Stdin:        c.stdin,
 		Stdout:       c.stdout,
 		Stderr:       c.stderr,
 	})
-
-	return nil
 }
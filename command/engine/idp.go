@@ -28,7 +28,6 @@ func New(cfg *Config) (engine.Engine, error) {
 	c := &idp{
 		cfg: cfg,
 		//
-		stdin:  os.Stdin,
 		stdout: os.Stdout,
 		stderr: os.Stderr,
 	}
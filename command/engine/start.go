@@ -7,6 +7,8 @@ import (
 )
 
 func (c *idp) Start() error {
+	c.client = c.newClient()
+
 	if err := c.client.Connect(); err != nil {
 		logger.Debugf("failed to connect to server: %s", err)
 		return fmt.Errorf("failed to connect server(%s): %s", c.cfg.Server, err)
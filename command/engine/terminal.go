@@ -1,12 +1,226 @@
 package idp
 
 import (
-	"errors"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
 
+	"github.com/go-zoox/command/errors"
 	"github.com/go-zoox/command/terminal"
+	"github.com/go-zoox/logger"
+	"github.com/go-zoox/terminal/message"
+	"github.com/go-zoox/websocket"
 )
 
-// Terminal returns a terminal.
+// Terminal returns a terminal, which is bridged to the agent web terminal.
 func (c *idp) Terminal() (terminal.Terminal, error) {
-	return nil, errors.New("not supported")
+	u, err := url.Parse(c.newClient().TerminalURL(c.cfg.TerminalPath))
+	if err != nil {
+		return nil, fmt.Errorf("invalid terminal address: %s", err)
+	}
+	if c.cfg.ReadOnly {
+		query := u.Query()
+		query.Set("read_only", "true")
+		u.RawQuery = query.Encode()
+	}
+
+	headers := http.Header{}
+	if c.cfg.ClientID != "" || c.cfg.ClientSecret != "" {
+		headers.Set("Authorization", fmt.Sprintf("Basic %s", base64.StdEncoding.EncodeToString([]byte(c.cfg.ClientID+":"+c.cfg.ClientSecret))))
+	}
+
+	wc, err := websocket.NewClient(func(opt *websocket.ClientOption) {
+		opt.Context = context.Background()
+		opt.Addr = u.String()
+		opt.Headers = headers
+		opt.ConnectTimeout = 10 * time.Second
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	reader, writer := io.Pipe()
+	t := &Terminal{
+		ReadOnly: c.cfg.ReadOnly,
+		//
+		reader:    reader,
+		writer:    writer,
+		connectCh: make(chan struct{}),
+		exitCh:    make(chan struct{}),
+	}
+
+	wc.OnConnect(func(conn websocket.Conn) error {
+		t.conn = conn
+
+		msg := &message.Message{}
+		msg.SetType(message.TypeConnect)
+		msg.SetConnect(&message.Connect{
+			Shell:       c.cfg.Shell,
+			Environment: c.cfg.Environment,
+			WorkDir:     c.cfg.WorkDir,
+			User:        c.cfg.User,
+			InitCommand: c.cfg.Command,
+		})
+
+		return t.send(msg)
+	})
+
+	wc.OnClose(func(conn websocket.Conn, code int, message string) error {
+		t.exit(code, fmt.Sprintf("terminal connection closed: %s", message))
+		return nil
+	})
+
+	wc.OnBinaryMessage(func(conn websocket.Conn, rawMsg []byte) error {
+		msg, err := message.Deserialize(rawMsg)
+		if err != nil {
+			logger.Errorf("[idp][terminal] failed to deserialize message: %s", err)
+			return nil
+		}
+
+		switch msg.Type() {
+		case message.TypeConnect:
+			t.connectOnce.Do(func() {
+				close(t.connectCh)
+			})
+		case message.TypeOutput:
+			t.writer.Write(msg.Output())
+		case message.TypeHeartBeat:
+			heartbeat := &message.Message{}
+			heartbeat.SetType(message.TypeHeartBeat)
+			return t.send(heartbeat)
+		case message.TypeExit:
+			data := msg.Exit()
+			t.exit(data.Code, data.Message)
+		case message.TypeError:
+			logger.Errorf("[idp][terminal] error: %s", msg.Error().Message)
+		}
+
+		return nil
+	})
+
+	if err := wc.Connect(); err != nil {
+		return nil, fmt.Errorf("failed to connect terminal(%s): %s", u.String(), err)
+	}
+
+	select {
+	case <-t.connectCh:
+		return t, nil
+	case <-t.exitCh:
+		return nil, fmt.Errorf("failed to connect terminal: %s", t.exitMessage)
+	case <-time.After(30 * time.Second):
+		t.Close()
+		return nil, fmt.Errorf("failed to connect terminal: timeout")
+	}
+}
+
+// Terminal is the terminal implementation over the agent web terminal.
+type Terminal struct {
+	ReadOnly bool
+	//
+	conn websocket.Conn
+	//
+	reader *io.PipeReader
+	writer *io.PipeWriter
+	//
+	connectCh   chan struct{}
+	connectOnce sync.Once
+	//
+	exitCh      chan struct{}
+	exitOnce    sync.Once
+	exitCode    int
+	exitMessage string
+}
+
+// Read reads the output of the terminal.
+func (t *Terminal) Read(p []byte) (n int, err error) {
+	return t.reader.Read(p)
+}
+
+// Write writes keys to the terminal.
+func (t *Terminal) Write(p []byte) (n int, err error) {
+	if t.ReadOnly {
+		return 0, nil
+	}
+
+	msg := &message.Message{}
+	msg.SetType(message.TypeKey)
+	msg.SetKey(p)
+	if err := t.send(msg); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Close closes the terminal.
+func (t *Terminal) Close() error {
+	t.exit(-1, "terminal closed")
+
+	if t.conn == nil {
+		return nil
+	}
+
+	return t.conn.Close()
+}
+
+// Resize resizes the terminal.
+func (t *Terminal) Resize(rows, cols int) error {
+	msg := &message.Message{}
+	msg.SetType(message.TypeResize)
+	msg.SetResize(&message.Resize{
+		Rows:    rows,
+		Columns: cols,
+	})
+
+	return t.send(msg)
+}
+
+// ExitCode returns the exit code.
+func (t *Terminal) ExitCode() int {
+	return t.exitCode
+}
+
+// Wait waits for the terminal to exit.
+func (t *Terminal) Wait() error {
+	<-t.exitCh
+
+	if t.exitCode != 0 {
+		message := t.exitMessage
+		if message == "" {
+			message = fmt.Sprintf("exit code: %d", t.exitCode)
+		}
+
+		return &errors.ExitError{
+			Code:    t.exitCode,
+			Message: message,
+		}
+	}
+
+	return nil
+}
+
+func (t *Terminal) send(msg *message.Message) error {
+	if t.conn == nil {
+		return fmt.Errorf("terminal is not connected")
+	}
+
+	if err := msg.Serialize(); err != nil {
+		return err
+	}
+
+	return t.conn.WriteTextMessage(msg.Msg())
+}
+
+func (t *Terminal) exit(code int, message string) {
+	t.exitOnce.Do(func() {
+		t.exitCode = code
+		t.exitMessage = message
+		t.writer.Close()
+		close(t.exitCh)
+	})
 }
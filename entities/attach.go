@@ -0,0 +1,9 @@
+package entities
+
+// AttachRequest is the request for attaching to a running command
+type AttachRequest struct {
+	// ID is the id of command
+	ID string `json:"id"`
+	// Offset is the byte offset of command log to replay from, -1 means no replay
+	Offset int64 `json:"offset"`
+}
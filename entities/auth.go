@@ -4,4 +4,8 @@ package entities
 type AuthRequest struct {
 	ClientID     string `json:"client_id"`
 	ClientSecret string `json:"client_secret"`
+	// Token is the api token, used instead of client id and secret
+	Token string `json:"token,omitempty"`
+	// Version is the max protocol version supported by client, 0 means v1
+	Version int `json:"version,omitempty"`
 }
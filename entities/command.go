@@ -7,6 +7,9 @@ type Command struct {
 	ID          string            `json:"id"`
 	Script      string            `json:"script"`
 	Environment map[string]string `json:"environment"`
+	// Secrets are the environment variables whose values are never persisted or returned,
+	//	and masked in the output of command.
+	Secrets     map[string]string `json:"secrets,omitempty"`
 	WorkDirBase string            `json:"workdirbase"`
 	//
 	Shell string `json:"shell"`
@@ -22,6 +25,10 @@ type Command struct {
 	Privileged bool    `json:"privileged"`
 	// Timeout is the timeout of command, in milliseconds
 	Timeout int64 `json:"timeout"`
+	// Priority is the priority of command waiting in queue, higher runs first, only admin raises it above 0, default: 0
+	Priority int `json:"priority,omitempty"`
+	// Stdin means the client streams stdin by MessageCommandStdin, ends with MessageCommandStdinEOF
+	Stdin bool `json:"stdin"`
 
 	// Pipeline *pipeline.Pipeline `json:"pipeline"`
 
@@ -30,3 +37,21 @@ type Command struct {
 	// Enable clean metadata dir
 	EnableCleanMetadataDir bool `json:"enable_clean_metadata_dir"`
 }
+
+// SecretMask replaces the values of secrets
+const SecretMask = "******"
+
+// Redacted returns the copy of command whose secret values are masked, it is safe to persist or return
+func (c *Command) Redacted() *Command {
+	if c == nil || len(c.Secrets) == 0 {
+		return c
+	}
+
+	redacted := *c
+	redacted.Secrets = make(map[string]string, len(c.Secrets))
+	for k := range c.Secrets {
+		redacted.Secrets[k] = SecretMask
+	}
+
+	return &redacted
+}
@@ -0,0 +1,171 @@
+package entities
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ProtocolVersion1 is the protocol with single byte prefix framing
+const ProtocolVersion1 = 1
+
+// ProtocolVersion2 is the protocol with JSON envelope framing
+const ProtocolVersion2 = 2
+
+// ProtocolVersion is the latest protocol version
+const ProtocolVersion = ProtocolVersion2
+
+// Envelope types
+const (
+	EnvelopeTypeCommand        = "command"
+	EnvelopeTypePing           = "ping"
+	EnvelopeTypeAuthRequest    = "auth"
+	EnvelopeTypeAuthSuccess    = "auth_success"
+	EnvelopeTypeAuthFailure    = "auth_failure"
+	EnvelopeTypeOutput         = "output"
+	EnvelopeTypeExit           = "exit"
+	EnvelopeTypeCancelRequest  = "cancel"
+	EnvelopeTypeCancelResponse = "cancelled"
+	EnvelopeTypeStdin          = "stdin"
+	EnvelopeTypeStdinEOF       = "stdin_eof"
+	EnvelopeTypeAttachRequest  = "attach"
+	// EnvelopeTypeQueued is sent when the command waits in queue or moves forward, v2 only
+	EnvelopeTypeQueued = "queued"
+)
+
+// StreamStdout is the stream of command stdout
+const StreamStdout = "stdout"
+
+// StreamStderr is the stream of command stderr
+const StreamStderr = "stderr"
+
+// Envelope is the message of protocol v2, which is sent as JSON text message.
+//
+//	The handshake (auth request and response) is always in v1 framing,
+//	after the server responses the negotiated version 2, both sides send envelopes only.
+type Envelope struct {
+	Type string `json:"type"`
+	// CommandID is the id of command the message belongs to
+	CommandID string `json:"command_id,omitempty"`
+	// Stream is the stream of output, options: stdout, stderr
+	Stream string `json:"stream,omitempty"`
+	// Seq is the sequence number of message sent by server, per command
+	Seq uint64 `json:"seq,omitempty"`
+	// Timestamp is the time message sent, in milliseconds
+	Timestamp int64 `json:"ts,omitempty"`
+	// Data is the raw data of output or stdin
+	Data []byte `json:"data,omitempty"`
+	// ExitCode is the exit code of command, for exit message
+	ExitCode int `json:"exit_code,omitempty"`
+	// Reason is the reason of error or exit
+	Reason string `json:"reason,omitempty"`
+	// Position is the position of command in queue, starts from 1, for queued message
+	Position int `json:"position,omitempty"`
+	// Payload is the JSON payload of command, attach and auth messages
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// AuthResponse is the payload of auth success response
+type AuthResponse struct {
+	// Version is the protocol version negotiated
+	Version int `json:"version"`
+}
+
+var envelopeTypes = map[byte]string{
+	MessageCommand:               EnvelopeTypeCommand,
+	MessagePing:                  EnvelopeTypePing,
+	MessageAuthRequest:           EnvelopeTypeAuthRequest,
+	MessageAuthResponseSuccess:   EnvelopeTypeAuthSuccess,
+	MessageAuthResponseFailure:   EnvelopeTypeAuthFailure,
+	MessageCommandExitCode:       EnvelopeTypeExit,
+	MessageCommandCancelRequest:  EnvelopeTypeCancelRequest,
+	MessageCommandCancelResponse: EnvelopeTypeCancelResponse,
+	MessageCommandStdin:          EnvelopeTypeStdin,
+	MessageCommandStdinEOF:       EnvelopeTypeStdinEOF,
+	MessageCommandAttachRequest:  EnvelopeTypeAttachRequest,
+}
+
+// IsEnvelope returns true if the message is a v2 envelope
+func IsEnvelope(msg []byte) bool {
+	return len(msg) > 0 && msg[0] == '{'
+}
+
+// DecodeEnvelope decodes the message, v1 messages are converted to envelope
+func DecodeEnvelope(msg []byte) (*Envelope, error) {
+	if len(msg) == 0 {
+		return nil, fmt.Errorf("empty message")
+	}
+
+	if IsEnvelope(msg) {
+		env := &Envelope{}
+		if err := json.Unmarshal(msg, env); err != nil {
+			return nil, fmt.Errorf("failed to decode envelope: %s", err)
+		}
+
+		return env, nil
+	}
+
+	flag, data := msg[0], msg[1:]
+	switch flag {
+	case MessageCommandStdout:
+		return &Envelope{Type: EnvelopeTypeOutput, Stream: StreamStdout, Data: data}, nil
+	case MessageCommandStderr:
+		return &Envelope{Type: EnvelopeTypeOutput, Stream: StreamStderr, Data: data}, nil
+	case MessageCommandExitCode:
+		if len(data) == 0 {
+			return nil, fmt.Errorf("invalid exit code message")
+		}
+		return &Envelope{Type: EnvelopeTypeExit, ExitCode: int(data[0])}, nil
+	case MessageCommandStdin, MessageCommandStdinEOF:
+		return &Envelope{Type: envelopeTypes[flag], Data: data}, nil
+	case MessageAuthResponseFailure:
+		return &Envelope{Type: EnvelopeTypeAuthFailure, Reason: string(data)}, nil
+	}
+
+	typ, ok := envelopeTypes[flag]
+	if !ok {
+		return nil, fmt.Errorf("unknown message type: %d", flag)
+	}
+
+	env := &Envelope{Type: typ}
+	if len(data) > 0 {
+		env.Payload = json.RawMessage(data)
+	}
+
+	return env, nil
+}
+
+// Message encodes the envelope in v1 framing,
+//
+//	exit code is truncated to one byte, and command id, seq and reason are dropped.
+func (e *Envelope) Message() ([]byte, error) {
+	switch e.Type {
+	case EnvelopeTypeOutput:
+		if e.Stream == StreamStderr {
+			return append([]byte{MessageCommandStderr}, e.Data...), nil
+		}
+		return append([]byte{MessageCommandStdout}, e.Data...), nil
+	case EnvelopeTypeExit:
+		return []byte{MessageCommandExitCode, byte(e.ExitCode)}, nil
+	case EnvelopeTypeStdin, EnvelopeTypeStdinEOF:
+		return append([]byte{flagOf(e.Type)}, e.Data...), nil
+	case EnvelopeTypeAuthFailure:
+		return append([]byte{MessageAuthResponseFailure}, e.Reason...), nil
+	}
+
+	flag := flagOf(e.Type)
+	if flag == 0 {
+		return nil, fmt.Errorf("unknown envelope type: %s", e.Type)
+	}
+
+	return append([]byte{flag}, e.Payload...), nil
+}
+
+func flagOf(typ string) byte {
+	for flag, t := range envelopeTypes {
+		if t == typ {
+			return flag
+		}
+	}
+
+	return 0
+}
@@ -29,3 +29,12 @@ const MessageCommandCancelRequest = '8'
 
 // MessageCommandCancelResponse is the message for command cancel response
 const MessageCommandCancelResponse = '9'
+
+// MessageCommandStdin is the message for command stdin
+const MessageCommandStdin = 'a'
+
+// MessageCommandStdinEOF is the message for command stdin EOF
+const MessageCommandStdinEOF = 'b'
+
+// MessageCommandAttachRequest is the message for attaching to a running command
+const MessageCommandAttachRequest = 'c'
@@ -2,15 +2,12 @@ package server
 
 import (
 	"fmt"
-	"io"
-	"os"
-	"strings"
+	"strconv"
 	"time"
 
 	"github.com/go-idp/agent/entities"
 	dcommand "github.com/go-idp/agent/server/data/command"
 	"github.com/go-zoox/datetime"
-	"github.com/go-zoox/fs"
 	"github.com/go-zoox/uuid"
 	"github.com/go-zoox/zoox"
 )
@@ -35,106 +32,137 @@ func createCommandAPI(cfg *Config) func(ctx *zoox.Context) {
 
 		if commandRequest.ID == "" {
 			commandRequest.ID = uuid.V4()
+		} else if err := validateCommandID(commandRequest.ID); err != nil {
+			ctx.Fail(err, 400, err.Error())
+			return
 		}
 
-		dc, err := dcommand.New(func(c *dcommand.Config) {
-			c.ID = commandRequest.ID
-
-			c.Command = commandRequest
-
-			// cfg.Timeout is seconds, but command.Timeout is milliseconds
-			if cfg.Timeout != 0 {
-				c.Command.Timeout = cfg.Timeout * 1000
-			}
+		isWait := ctx.Query().Get("wait").Bool()
+		timeout, tail, err := parseWaitOption(ctx.Query())
+		if err != nil {
+			ctx.Fail(err, 400, err.Error())
+			return
+		}
 
-			// fix workdir
-			if c.Command.WorkDirBase == "" {
-				c.Command.WorkDirBase = cfg.WorkDir
-			}
+		identity := identityOf(cfg, ctx)
 
-			if cfg.Environment != nil {
-				for k, v := range cfg.Environment {
-					c.Command.Environment[k] = v
-				}
-			}
-		})
+		dc, err := newDataCommand(cfg, commandRequest, identity.Caller(remoteAddrOf(ctx.Request)))
 		if err != nil {
 			ctx.Fail(fmt.Errorf("failed to create data command: %s", err), 500, "failed to create data command")
 			return
 		}
 
-		// set listener
-		dc.On("error", func(payload any) {
-			state.Command.Running.Dec(1)
-			state.Command.Error.Inc(1)
-		})
-		dc.On("run", func(payload any) {
-			state.Command.Running.Inc(1)
-		})
-		dc.On("cancel", func(payload any) {
-			state.Command.Running.Dec(1)
-			state.Command.Cancelled.Inc(1)
-		})
-		dc.On("complete", func(payload any) {
-			state.Command.Running.Dec(1)
-			state.Command.Completed.Inc(1)
-		})
-
-		commandsMap.Set(dc.ID, dc)
-		commandsIDList.LPush(dc.ID)
-		state.Command.Total.Inc(1)
+		// denied before accepted, so the caller gets the reason
+		if err := dc.Enforce(); err != nil {
+			ctx.Fail(err, 403, err.Error(), 403)
+			return
+		}
 
-		cmdCfg, err := cfg.GetCommandConfig(dc.ID, commandRequest)
+		ticket, err := admitCommand(dc)
 		if err != nil {
-			ctx.Fail(fmt.Errorf("failed to get command config: %s", err), 500, "failed to get command config")
+			ctx.Fail(err, 429, err.Error(), 429)
 			return
 		}
 
-		dc.SetStdout(cmdCfg.Log)
-		dc.SetStderr(cmdCfg.Log)
-
-		cmdCfg.Script.WriteString(commandRequest.Script)
-		cmdCfg.StartAt.WriteString(datetime.Now().Format("YYYY-MM-DD HH:mm:ss"))
-		if len(commandRequest.Environment) > 0 {
-			env := []string{}
-			for k, v := range commandRequest.Environment {
-				env = append(env, fmt.Sprintf("%s=%s", k, v))
+		run, err := startCommand(cfg, dc, ticket)
+		if err != nil {
+			if err == errCommandExists {
+				ctx.Fail(err, 409, err.Error(), 409)
+				return
 			}
-			cmdCfg.Env.WriteString(strings.Join(env, "\n"))
+
+			ctx.Fail(err, 500, "failed to start command")
+			return
 		}
+		auditHTTP(ctx, &AuditEvent{Action: AuditActionCommandCreate, CommandID: dc.ID})
 
-		go func() {
-			defer cmdCfg.Log.Close()
+		status := "running"
+		if dc.Status() == "queued" {
+			status = "queued"
+		}
+
+		go run.Run(nil)
 
-			err = dc.Run()
+		// synchronous for short jobs, the command keeps running if the wait times out
+		if isWait {
+			result, err := waitCommand(ctx.Request.Context(), cfg, identity, dc.ID, timeout, tail)
 			if err != nil {
-				cmdCfg.Error.WriteString(err.Error())
-				cmdCfg.FailedAt.WriteString(datetime.Now().Format("YYYY-MM-DD HH:mm:ss"))
-				cmdCfg.Status.WriteString("failure")
-				fmt.Printf("[createCommandAPI] failed to run command: %s\n", err)
+				ctx.Fail(err, 500, fmt.Sprintf("failed to wait for command: %s", err))
 				return
 			}
-
-			cmdCfg.SucceedAt.WriteString(datetime.Now().Format("YYYY-MM-DD HH:mm:ss"))
-			cmdCfg.Status.WriteString("success")
-		}()
+			if result != nil {
+				ctx.Success(result)
+				return
+			}
+		}
 
 		ctx.Success(zoox.H{
-			"id": commandRequest.ID,
+			"id":     commandRequest.ID,
+			"status": status,
 		})
 	}
 }
 
 func listCommandsAPI(cfg *Config) func(ctx *zoox.Context) {
 	return func(ctx *zoox.Context) {
-		commands := []any{}
-		for _, id := range commandsIDList.Iterator() {
-			commands = append(commands, commandsMap.Get(id))
+		query := ctx.Query()
+		opt := &dcommand.ListOption{
+			Status: query.Get("status").String(),
+			Engine: query.Get("engine").String(),
+			User:   query.Get("user").String(),
+			Order:  query.Get("order").String(),
+			Cursor: query.Get("cursor").String(),
+			Offset: query.Get("offset").Int(),
+			Limit:  query.Get("limit").Int(),
+		}
+		if identity := identityOf(cfg, ctx); !identity.IsAdmin() {
+			opt.Owner = identity.Name
+		}
+
+		if opt.Order != "" && opt.Order != "asc" && opt.Order != "desc" {
+			ctx.Fail(fmt.Errorf("invalid order: %s", opt.Order), 400, "order should be asc or desc")
+			return
+		}
+
+		var err error
+		if opt.Since, err = parseQueryTime(query.Get("since").String()); err != nil {
+			ctx.Fail(err, 400, fmt.Sprintf("invalid since: %s", err))
+			return
+		}
+		if opt.Until, err = parseQueryTime(query.Get("until").String()); err != nil {
+			ctx.Fail(err, 400, fmt.Sprintf("invalid until: %s", err))
+			return
+		}
+
+		data, total, err := commands.List(opt)
+		if err != nil {
+			ctx.Fail(err, 500, fmt.Sprintf("failed to list commands: %s", err))
+			return
+		}
+
+		nextCursor := ""
+		if opt.Limit > 0 && len(data) == opt.Limit {
+			nextCursor = data[len(data)-1].ID
+		}
+
+		if query.Get("view").String() == "summary" {
+			summaries := make([]*dcommand.Summary, 0, len(data))
+			for _, command := range data {
+				summaries = append(summaries, command.Summary())
+			}
+
+			ctx.Success(zoox.H{
+				"total":       total,
+				"data":        summaries,
+				"next_cursor": nextCursor,
+			})
+			return
 		}
 
 		ctx.Success(zoox.H{
-			"total": len(commands),
-			"data":  commands,
+			"total":       total,
+			"data":        data,
+			"next_cursor": nextCursor,
 		})
 	}
 }
@@ -147,7 +175,7 @@ func retvieveCommandAPI(cfg *Config) func(ctx *zoox.Context) {
 			return
 		}
 
-		commandX := commandsMap.Get(id)
+		commandX := getCommandOf(identityOf(cfg, ctx), id)
 		if commandX == nil {
 			ctx.Fail(nil, 404, "command not found")
 			return
@@ -165,7 +193,7 @@ func retrieveCommandLogAPI(cfg *Config) func(ctx *zoox.Context) {
 			return
 		}
 
-		command := commandsMap.Get(id)
+		command := getCommandOf(identityOf(cfg, ctx), id)
 		if command == nil {
 			ctx.Fail(nil, 404, "command not found")
 			return
@@ -190,9 +218,16 @@ func retrieveCommandLogSSEAPI(cfg *Config) func(ctx *zoox.Context) {
 			ctx.Fail(fmt.Errorf("id is required"), 400, "id is required")
 			return
 		}
+		if command := getCommandOf(identityOf(cfg, ctx), id); command == nil {
+			ctx.Fail(nil, 404, "command not found")
+			return
+		}
 		var offset int64
 		logEventID := 0
 
+		metricLogStreamSubscribers.Inc()
+		defer metricLogStreamSubscribers.Dec()
+
 		for {
 			select {
 			case <-ctx.Request.Context().Done():
@@ -201,7 +236,7 @@ func retrieveCommandLogSSEAPI(cfg *Config) func(ctx *zoox.Context) {
 				// max 10 minutes, avoid memory leak
 				return
 			default:
-				command := commandsMap.Get(id)
+				command := commands.Get(id)
 				if command == nil {
 					ctx.Fail(nil, 404, "command not found")
 					return
@@ -237,7 +272,7 @@ func cancelCommandAPI(cfg *Config) func(ctx *zoox.Context) {
 			return
 		}
 
-		command := commandsMap.Get(id)
+		command := getCommandOf(identityOf(cfg, ctx), id)
 		if command == nil {
 			ctx.Fail(nil, 404, "command not found")
 			return
@@ -247,6 +282,12 @@ func cancelCommandAPI(cfg *Config) func(ctx *zoox.Context) {
 			ctx.Fail(err, 500, fmt.Sprintf("failed to cancel command: %s", err))
 			return
 		}
+		auditHTTP(ctx, &AuditEvent{Action: AuditActionCommandCancel, CommandID: command.ID})
+
+		if err := commands.Set(command); err != nil {
+			ctx.Fail(err, 500, fmt.Sprintf("failed to save command: %s", err))
+			return
+		}
 
 		ctx.Success(nil)
 	}
@@ -259,14 +300,13 @@ func getLatestCommandAPI(cfg *Config) func(ctx *zoox.Context) {
 			return
 		}
 
-		for _, id := range commandsIDList.Iterator() {
-			if command := commandsMap.Get(id); command != nil {
-				if command.IsRunning() {
-					ctx.Success(command)
-					return
-				}
-			}
+		command := getLatestRunningCommand(identityOf(cfg, ctx))
+		if command == nil {
+			ctx.Fail(nil, 200, "no commands running")
+			return
 		}
+
+		ctx.Success(command)
 	}
 }
 
@@ -277,22 +317,21 @@ func getLatestCommandLogAPI(cfg *Config) func(ctx *zoox.Context) {
 			return
 		}
 
-		for _, id := range commandsIDList.Iterator() {
-			if command := commandsMap.Get(id); command != nil {
-				if command.IsRunning() {
-					logContent, err := readCommandLog(cfg, id)
-					if err != nil {
-						ctx.Fail(err, 500, fmt.Sprintf("failed to read command log: %s", err))
-						return
-					}
+		command := getLatestRunningCommand(identityOf(cfg, ctx))
+		if command == nil {
+			ctx.Fail(nil, 200, "no commands running")
+			return
+		}
 
-					ctx.Success(zoox.H{
-						"log": logContent,
-					})
-					return
-				}
-			}
+		logContent, err := readCommandLog(cfg, command.ID)
+		if err != nil {
+			ctx.Fail(err, 500, fmt.Sprintf("failed to read command log: %s", err))
+			return
 		}
+
+		ctx.Success(zoox.H{
+			"log": logContent,
+		})
 	}
 }
 
@@ -304,13 +343,8 @@ func getLatestCommandLogSSEAPI(cfg *Config) func(ctx *zoox.Context) {
 		}
 
 		commandID := ""
-		for _, id := range commandsIDList.Iterator() {
-			if command := commandsMap.Get(id); command != nil {
-				if command.IsRunning() {
-					commandID = id
-					break
-				}
-			}
+		if command := getLatestRunningCommand(identityOf(cfg, ctx)); command != nil {
+			commandID = command.ID
 		}
 
 		if commandID == "" {
@@ -320,6 +354,9 @@ func getLatestCommandLogSSEAPI(cfg *Config) func(ctx *zoox.Context) {
 		var offset int64
 		logEventID := 0
 
+		metricLogStreamSubscribers.Inc()
+		defer metricLogStreamSubscribers.Dec()
+
 		for {
 			select {
 			case <-ctx.Request.Context().Done():
@@ -328,7 +365,7 @@ func getLatestCommandLogSSEAPI(cfg *Config) func(ctx *zoox.Context) {
 				// max 10 minutes, avoid memory leak
 				return
 			default:
-				command := commandsMap.Get(commandID)
+				command := commands.Get(commandID)
 				if command == nil {
 					ctx.Fail(nil, 404, "command not found")
 					return
@@ -360,55 +397,61 @@ func getLatestCommandLogSSEAPI(cfg *Config) func(ctx *zoox.Context) {
 	}
 }
 
-func readCommandLog(cfg *Config, id string) (string, error) {
-	logPath := getCommandLogPath(cfg, id)
-	if !fs.IsExist(logPath) {
-		return "", nil
+// parseQueryTime parses time in query, supports RFC3339, YYYY-MM-DD HH:mm:ss and unix timestamp in seconds
+func parseQueryTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
 	}
 
-	content, err := os.ReadFile(logPath)
-	if err != nil {
-		return "", err
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
 	}
 
-	return string(content), nil
+	if dt, err := datetime.FromPattern("YYYY-MM-DD HH:mm:ss", value); err == nil {
+		return dt.Time(), nil
+	}
+
+	if ts, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(ts, 0), nil
+	}
+
+	return time.Time{}, fmt.Errorf("unsupported time format: %s", value)
 }
 
-func readCommandLogChunk(cfg *Config, id string, offset int64) (string, int64, error) {
-	logPath := getCommandLogPath(cfg, id)
-	if !fs.IsExist(logPath) {
-		return "", offset, nil
+// getLatestRunningCommand returns the latest running command accessible to the identity
+func getLatestRunningCommand(identity *Identity) *dcommand.Command {
+	opt := &dcommand.ListOption{
+		Status: "running",
+		Limit:  1,
+	}
+	if !identity.IsAdmin() {
+		opt.Owner = identity.Name
 	}
 
-	f, err := os.Open(logPath)
-	if err != nil {
-		return "", offset, err
+	running, _, err := commands.List(opt)
+	if err != nil || len(running) == 0 {
+		return nil
 	}
-	defer f.Close()
 
-	if _, err := f.Seek(offset, io.SeekStart); err != nil {
-		return "", offset, err
+	return running[0]
+}
+
+func readCommandLog(cfg *Config, id string) (string, error) {
+	content, _, err := readMetadataFrom(cfg, getCommandLogPath(cfg, id), 0)
+	if err != nil {
+		return "", err
 	}
 
-	var chunk strings.Builder
-	buf := make([]byte, 32*1024)
-	nextOffset := offset
-	for {
-		n, err := f.Read(buf)
-		if n > 0 {
-			chunk.Write(buf[:n])
-			nextOffset += int64(n)
-		}
+	return string(content), nil
+}
 
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return "", offset, err
-		}
+func readCommandLogChunk(cfg *Config, id string, offset int64) (string, int64, error) {
+	chunk, nextOffset, err := readMetadataFrom(cfg, getCommandLogPath(cfg, id), offset)
+	if err != nil {
+		return "", offset, err
 	}
 
-	return chunk.String(), nextOffset, nil
+	return string(chunk), nextOffset, nil
 }
 
 func getCommandLogPath(cfg *Config, id string) string {
@@ -419,3 +462,30 @@ func getCommandLogPath(cfg *Config, id string) string {
 
 	return fmt.Sprintf("%s/%s/log", metadataDir, id)
 }
+
+// identityOf returns the identity authenticated by middleware,
+//
+//	the route without middleware is given no scopes when auth is enabled, anonymous otherwise.
+func identityOf(cfg *Config, ctx *zoox.Context) *Identity {
+	if identity, ok := ctx.State().Get("identity").(*Identity); ok {
+		return identity
+	}
+
+	if !cfg.isAuthEnabled() {
+		return anonymous
+	}
+
+	return unauthenticated
+}
+
+// getCommandOf returns the command accessible to the identity,
+//
+//	the command of others is reported as not found, which does not leak its existence.
+func getCommandOf(identity *Identity, id string) *dcommand.Command {
+	command := commands.Get(id)
+	if command == nil || !identity.CanAccess(command) {
+		return nil
+	}
+
+	return command
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-idp/agent/entities"
+	dcommand "github.com/go-idp/agent/server/data/command"
+	"github.com/go-zoox/datetime"
+	"github.com/go-zoox/zoox/defaults"
+)
+
+type listCommandsResponse struct {
+	Result struct {
+		Total      int               `json:"total"`
+		NextCursor string            `json:"next_cursor"`
+		Data       []json.RawMessage `json:"data"`
+	} `json:"result"`
+}
+
+func setupListCommands(t *testing.T) {
+	t.Helper()
+
+	original := commands
+	commands = dcommand.NewMemoryStore()
+	t.Cleanup(func() {
+		commands = original
+	})
+
+	base := time.Date(2024, 1, 1, 10, 0, 0, 0, time.Local)
+	fixtures := []struct {
+		id     string
+		status string
+		engine string
+		user   string
+	}{
+		{"cmd-1", "completed", "", "alice"},
+		{"cmd-2", "error", "docker", "bob"},
+		{"cmd-3", "completed", "docker", "alice"},
+		{"cmd-4", "running", "", "bob"},
+	}
+	for i, f := range fixtures {
+		commands.Set(&dcommand.Command{
+			ID: f.id,
+			Cmd: &entities.Command{
+				ID:          f.id,
+				Script:      "echo secret",
+				Environment: map[string]string{"TOKEN": "secret"},
+				Engine:      f.engine,
+				User:        f.user,
+			},
+			State: &dcommand.State{
+				StartedAt: datetime.FromTime(base.Add(time.Duration(i) * time.Hour)),
+				Status:    f.status,
+			},
+		})
+	}
+}
+
+func requestListCommands(t *testing.T, query string) *listCommandsResponse {
+	t.Helper()
+
+	app := defaults.Application()
+	app.Get("/commands", listCommandsAPI(&Config{}))
+
+	req := httptest.NewRequest("GET", "/commands"+query, nil)
+	resp := httptest.NewRecorder()
+	app.ServeHTTP(resp, req)
+	if resp.Code != 200 {
+		t.Fatalf("expected status 200, got %d, body=%s", resp.Code, resp.Body.String())
+	}
+
+	result := &listCommandsResponse{}
+	if err := json.Unmarshal(resp.Body.Bytes(), result); err != nil {
+		t.Fatalf("failed to decode response: %v, body=%s", err, resp.Body.String())
+	}
+
+	return result
+}
+
+func TestListCommandsAPI_Filters(t *testing.T) {
+	setupListCommands(t)
+
+	cases := []struct {
+		query string
+		total int
+	}{
+		{"", 4},
+		{"?status=completed", 2},
+		{"?engine=docker", 2},
+		{"?engine=host&user=bob", 1},
+		{"?since=2024-01-01%2011:00:00&until=2024-01-01%2012:00:00", 2},
+	}
+	for _, c := range cases {
+		result := requestListCommands(t, c.query)
+		if result.Result.Total != c.total || len(result.Result.Data) != c.total {
+			t.Fatalf("query %q: expected %d commands, got total=%d, data=%d", c.query, c.total, result.Result.Total, len(result.Result.Data))
+		}
+	}
+}
+
+func TestListCommandsAPI_CursorAndSummary(t *testing.T) {
+	setupListCommands(t)
+
+	first := requestListCommands(t, "?limit=2&view=summary")
+	if len(first.Result.Data) != 2 || first.Result.NextCursor != "cmd-3" {
+		t.Fatalf("unexpected first page: data=%d, next_cursor=%s", len(first.Result.Data), first.Result.NextCursor)
+	}
+
+	summary := map[string]any{}
+	if err := json.Unmarshal(first.Result.Data[0], &summary); err != nil {
+		t.Fatalf("failed to decode summary: %v", err)
+	}
+	if summary["id"] != "cmd-4" || summary["engine"] != "host" {
+		t.Fatalf("unexpected summary: %v", summary)
+	}
+	if _, ok := summary["command"]; ok {
+		t.Fatalf("expected summary not to include script and environment: %v", summary)
+	}
+
+	second := requestListCommands(t, "?limit=2&view=summary&cursor="+first.Result.NextCursor)
+	if len(second.Result.Data) != 2 {
+		t.Fatalf("unexpected second page: data=%d", len(second.Result.Data))
+	}
+	if err := json.Unmarshal(second.Result.Data[1], &summary); err != nil {
+		t.Fatalf("failed to decode summary: %v", err)
+	}
+	if summary["id"] != "cmd-1" {
+		t.Fatalf("unexpected last summary: %v", summary)
+	}
+
+	asc := requestListCommands(t, "?limit=1&order=asc&view=summary")
+	if err := json.Unmarshal(asc.Result.Data[0], &summary); err != nil {
+		t.Fatalf("failed to decode summary: %v", err)
+	}
+	if summary["id"] != "cmd-1" {
+		t.Fatalf("unexpected first summary in asc order: %v", summary)
+	}
+}
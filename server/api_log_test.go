@@ -97,9 +97,9 @@ func TestRetrieveCommandLogAPI_ReadsFromFile(t *testing.T) {
 	}
 
 	// Keep command in global registry so API can locate it.
-	_ = commandsMap.Set(commandID, &dcommand.Command{ID: commandID})
+	_ = commands.Set(&dcommand.Command{ID: commandID})
 	defer func() {
-		_ = commandsMap.Del(commandID)
+		_ = commands.Del(commandID)
 	}()
 
 	app := defaults.Application()
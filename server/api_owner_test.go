@@ -0,0 +1,104 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-idp/agent/entities"
+	dcommand "github.com/go-idp/agent/server/data/command"
+	"github.com/go-zoox/zoox"
+	"github.com/go-zoox/zoox/defaults"
+)
+
+func TestCommandsAPI_OwnerScoped(t *testing.T) {
+	original := commands
+	commands = dcommand.NewMemoryStore()
+	t.Cleanup(func() {
+		commands = original
+	})
+
+	for id, owner := range map[string]string{"cmd-alice": "alice", "cmd-bob": "bob", "cmd-legacy": ""} {
+		dc := &dcommand.Command{
+			ID:    id,
+			Cmd:   &entities.Command{ID: id, Script: "true"},
+			State: &dcommand.State{Status: "completed"},
+		}
+		if owner != "" {
+			dc.Caller = &dcommand.Caller{Name: owner}
+		}
+		commands.Set(dc)
+	}
+
+	cfg := &Config{
+		MetadataDir: t.TempDir(),
+		Tokens: []Token{
+			{Name: "alice", Token: "alice-token", Scopes: []string{ScopeReadLogs, ScopeCancel}},
+			{Name: "root", Token: "admin-token", Scopes: []string{ScopeReadLogs, ScopeAdmin}},
+		},
+	}
+	authenticator := createAuthenticator(cfg)
+	authMiddleware := func(scope string) func(ctx *zoox.Context) {
+		return createAuthMiddleware(cfg, authenticator, scope)
+	}
+
+	app := defaults.Application()
+	app.Get("/commands", authMiddleware(ScopeReadLogs), listCommandsAPI(cfg))
+	app.Get("/commands/:id", authMiddleware(ScopeReadLogs), retvieveCommandAPI(cfg))
+	app.Get("/commands/:id/log", authMiddleware(ScopeReadLogs), retrieveCommandLogAPI(cfg))
+	app.Get("/commands/:id/log/sse", authMiddleware(ScopeReadLogs), retrieveCommandLogSSEAPI(cfg))
+	app.Post("/commands/:id/cancel", authMiddleware(ScopeCancel), cancelCommandAPI(cfg))
+
+	request := func(method, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp := httptest.NewRecorder()
+		app.ServeHTTP(resp, req)
+		return resp
+	}
+
+	list := func(token string) int {
+		t.Helper()
+
+		resp := request("GET", "/commands", token)
+		result := &listCommandsResponse{}
+		if err := json.Unmarshal(resp.Body.Bytes(), result); err != nil {
+			t.Fatalf("failed to decode response: %v, body=%s", err, resp.Body.String())
+		}
+		return result.Result.Total
+	}
+
+	if n := list("alice-token"); n != 1 {
+		t.Fatalf("expected alice to list only her command, got %d", n)
+	}
+	if n := list("admin-token"); n != 3 {
+		t.Fatalf("expected admin to list all commands, got %d", n)
+	}
+
+	cases := []struct {
+		method string
+		path   string
+		token  string
+		code   int
+	}{
+		{"GET", "/commands/cmd-alice", "alice-token", 200},
+		{"GET", "/commands/cmd-bob", "alice-token", 404},
+		{"GET", "/commands/cmd-legacy", "alice-token", 404},
+		{"GET", "/commands/cmd-bob", "admin-token", 200},
+		{"GET", "/commands/cmd-legacy", "admin-token", 200},
+		{"GET", "/commands/cmd-alice/log", "alice-token", 200},
+		{"GET", "/commands/cmd-bob/log", "alice-token", 404},
+		{"GET", "/commands/cmd-bob/log/sse", "alice-token", 404},
+		{"POST", "/commands/cmd-bob/cancel", "alice-token", 404},
+	}
+	for _, c := range cases {
+		resp := request(c.method, c.path, c.token)
+		body := struct {
+			Code int `json:"code"`
+		}{}
+		json.Unmarshal(resp.Body.Bytes(), &body)
+		if body.Code != c.code {
+			t.Fatalf("%s %s (%s): expected code %d, got %d: %s", c.method, c.path, c.token, c.code, body.Code, resp.Body.String())
+		}
+	}
+}
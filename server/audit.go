@@ -0,0 +1,393 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-zoox/logger"
+	"github.com/go-zoox/websocket/conn"
+	"github.com/go-zoox/zoox"
+)
+
+// audit actions
+const (
+	AuditActionAuthSuccess   = "auth.success"
+	AuditActionAuthFailure   = "auth.failure"
+	AuditActionCommandCreate = "command.create"
+	AuditActionCommandCancel = "command.cancel"
+	AuditActionFileWrite     = "file.write"
+	AuditActionTerminalOpen  = "terminal.open"
+)
+
+// defaults of audit log
+const (
+	DefaultAuditLogMaxSize    = 10 * 1024 * 1024
+	DefaultAuditLogMaxBackups = 5
+)
+
+// audit is the audit log of server, nil means disabled
+var audit *AuditLog
+
+// trustedProxies are the proxies whose X-Forwarded-For is honoured, none by default
+var trustedProxies []*net.IPNet
+
+// AuditEvent is one line of audit log
+type AuditEvent struct {
+	// Timestamp is the time of event, in milliseconds
+	Timestamp  int64  `json:"ts"`
+	Action     string `json:"action"`
+	Identity   string `json:"identity,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	// Transport is where the action comes from, options: http, websocket
+	Transport string `json:"transport,omitempty"`
+	CommandID string `json:"command_id,omitempty"`
+	// Path is the path of file written, or the path of http request
+	Path   string `json:"path,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// AuditLog is the append-only audit log in JSON lines, rotated by size,
+//
+//	backups are <path>.1 (newest) ... <path>.<max backups> (oldest).
+type AuditLog struct {
+	sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	//
+	file *os.File
+	size int64
+}
+
+// NewAuditLog opens the audit log
+func NewAuditLog(path string, maxSize int64, maxBackups int) (*AuditLog, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultAuditLogMaxSize
+	}
+	if maxBackups <= 0 {
+		maxBackups = DefaultAuditLogMaxBackups
+	}
+
+	a := &AuditLog{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Record appends the event, errors are logged only, which never fail the action
+func (a *AuditLog) Record(event *AuditEvent) {
+	if a == nil {
+		return
+	}
+
+	if event.Timestamp == 0 {
+		event.Timestamp = time.Now().UnixMilli()
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		logger.Warnf("[audit] failed to encode event: %s", err)
+		return
+	}
+	line = append(line, '\n')
+
+	a.Lock()
+	defer a.Unlock()
+
+	if a.size+int64(len(line)) > a.maxSize && a.size > 0 {
+		if err := a.rotate(); err != nil {
+			logger.Warnf("[audit] failed to rotate: %s", err)
+		}
+	}
+
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		logger.Warnf("[audit] failed to write event: %s", err)
+	}
+}
+
+// AuditQuery is the filter of audit events
+type AuditQuery struct {
+	Action    string
+	Identity  string
+	CommandID string
+	Since     time.Time
+	Until     time.Time
+	// Limit is the max events returned, newest first, default: 100
+	Limit int
+}
+
+// Query returns the events matched, newest first
+func (a *AuditLog) Query(q *AuditQuery) ([]*AuditEvent, error) {
+	if q.Limit <= 0 {
+		q.Limit = 100
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	events := []*AuditEvent{}
+	// current file first, then backups from newest to oldest
+	for i := 0; i <= a.maxBackups && len(events) < q.Limit; i++ {
+		path := a.path
+		if i > 0 {
+			path = fmt.Sprintf("%s.%d", a.path, i)
+		}
+
+		matched, err := readAuditFile(path, q)
+		if err != nil {
+			return nil, err
+		}
+
+		// lines in file are oldest first
+		for j := len(matched) - 1; j >= 0 && len(events) < q.Limit; j-- {
+			events = append(events, matched[j])
+		}
+	}
+
+	return events, nil
+}
+
+// Close closes the audit log
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	return a.file.Close()
+}
+
+func (a *AuditLog) open() error {
+	if err := os.MkdirAll(filepath.Dir(a.path), 0755); err != nil {
+		return fmt.Errorf("failed to create audit log dir: %s", err)
+	}
+
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %s", err)
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat audit log: %s", err)
+	}
+
+	a.file = f
+	a.size = st.Size()
+	return nil
+}
+
+func (a *AuditLog) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+
+	// the oldest backup is dropped
+	os.Remove(fmt.Sprintf("%s.%d", a.path, a.maxBackups))
+	for i := a.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", a.path, i), fmt.Sprintf("%s.%d", a.path, i+1))
+	}
+	if err := os.Rename(a.path, a.path+".1"); err != nil {
+		return err
+	}
+
+	return a.open()
+}
+
+func readAuditFile(path string, q *AuditQuery) ([]*AuditEvent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("failed to open audit log: %s", err)
+	}
+	defer f.Close()
+
+	events := []*AuditEvent{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		event := &AuditEvent{}
+		if err := json.Unmarshal(scanner.Bytes(), event); err != nil {
+			continue
+		}
+
+		if q.Action != "" && event.Action != q.Action {
+			continue
+		}
+		if q.Identity != "" && event.Identity != q.Identity {
+			continue
+		}
+		if q.CommandID != "" && event.CommandID != q.CommandID {
+			continue
+		}
+		if !q.Since.IsZero() && event.Timestamp < q.Since.UnixMilli() {
+			continue
+		}
+		if !q.Until.IsZero() && event.Timestamp > q.Until.UnixMilli() {
+			continue
+		}
+
+		events = append(events, event)
+	}
+
+	return events, scanner.Err()
+}
+
+// parseTrustedProxies parses the addresses or CIDRs of trusted proxies
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy: %s", proxy)
+			}
+
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %s", proxy)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// isTrustedProxy returns true if the address (host or host:port) is a trusted proxy
+func isTrustedProxy(addr string) bool {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+
+	ip := net.ParseIP(strings.TrimSpace(addr))
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// remoteAddrOf returns the address of client, X-Forwarded-For is honoured only from trusted proxies,
+//
+//	whose nearest address not of trusted proxies is the client.
+func remoteAddrOf(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+
+	forwarded := r.Header.Get("X-Forwarded-For")
+	if forwarded == "" || !isTrustedProxy(r.RemoteAddr) {
+		return r.RemoteAddr
+	}
+
+	addrs := strings.Split(forwarded, ",")
+	for i := len(addrs) - 1; i > 0; i-- {
+		if !isTrustedProxy(addrs[i]) {
+			return strings.TrimSpace(addrs[i])
+		}
+	}
+
+	return strings.TrimSpace(addrs[0])
+}
+
+// auditHTTP records the event of http request, with the identity authenticated
+func auditHTTP(ctx *zoox.Context, event *AuditEvent) {
+	if identity, ok := ctx.State().Get("identity").(*Identity); ok && event.Identity == "" {
+		event.Identity = identity.Name
+	}
+	event.RemoteAddr = remoteAddrOf(ctx.Request)
+	event.Transport = "http"
+
+	audit.Record(event)
+}
+
+// auditWs records the event of websocket connection
+func auditWs(c conn.Conn, event *AuditEvent) {
+	event.RemoteAddr = remoteAddrOf(c.Request())
+	event.Transport = "websocket"
+
+	audit.Record(event)
+}
+
+// auditTerminalSession is the middleware to record the terminal session opened
+func auditTerminalSession(ctx *zoox.Context) {
+	if strings.EqualFold(ctx.Request.Header.Get("Upgrade"), "websocket") {
+		auditHTTP(ctx, &AuditEvent{Action: AuditActionTerminalOpen, Path: ctx.Path})
+	}
+
+	ctx.Next()
+}
+
+func queryAuditAPI(cfg *Config) func(ctx *zoox.Context) {
+	return func(ctx *zoox.Context) {
+		if audit == nil {
+			ctx.Fail(fmt.Errorf("audit log is disabled"), 404, "audit log is disabled", 404)
+			return
+		}
+
+		query := ctx.Query()
+		q := &AuditQuery{
+			Action:    query.Get("action").String(),
+			Identity:  query.Get("identity").String(),
+			CommandID: query.Get("command_id").String(),
+			Limit:     query.Get("limit").Int(),
+		}
+
+		var err error
+		if q.Since, err = parseQueryTime(query.Get("since").String()); err != nil {
+			ctx.Fail(err, 400, fmt.Sprintf("invalid since: %s", err))
+			return
+		}
+		if q.Until, err = parseQueryTime(query.Get("until").String()); err != nil {
+			ctx.Fail(err, 400, fmt.Sprintf("invalid until: %s", err))
+			return
+		}
+
+		events, err := audit.Query(q)
+		if err != nil {
+			ctx.Fail(err, 500, fmt.Sprintf("failed to query audit log: %s", err))
+			return
+		}
+
+		sort.SliceStable(events, func(i, j int) bool {
+			return events[i].Timestamp > events[j].Timestamp
+		})
+
+		ctx.Success(zoox.H{
+			"data": events,
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-zoox/zoox"
+	"github.com/go-zoox/zoox/defaults"
+)
+
+// newTestAuditLog replaces the audit log of server with a temporary one
+func newTestAuditLog(t *testing.T, maxSize int64, maxBackups int) *AuditLog {
+	t.Helper()
+
+	a, err := NewAuditLog(filepath.Join(t.TempDir(), "audit.log"), maxSize, maxBackups)
+	if err != nil {
+		t.Fatalf("failed to open audit log: %v", err)
+	}
+
+	original := audit
+	audit = a
+	t.Cleanup(func() {
+		audit = original
+		a.Close()
+	})
+
+	return a
+}
+
+func TestAuditLog_RotatesAndQueries(t *testing.T) {
+	a := newTestAuditLog(t, 512, 2)
+
+	for i := 0; i < 30; i++ {
+		a.Record(&AuditEvent{Timestamp: int64(i + 1), Action: AuditActionCommandCreate, Identity: "ci", CommandID: fmt.Sprintf("cmd-%d", i)})
+	}
+
+	if _, err := os.Stat(a.path + ".1"); err != nil {
+		t.Fatalf("expected audit log to be rotated: %v", err)
+	}
+	if _, err := os.Stat(a.path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected at most 2 backups, got %v", err)
+	}
+	if st, _ := os.Stat(a.path); st.Size() > 512 {
+		t.Fatalf("expected audit log under max size, got %d", st.Size())
+	}
+
+	events, err := a.Query(&AuditQuery{Limit: 5})
+	if err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+	if len(events) != 5 || events[0].CommandID != "cmd-29" || events[4].CommandID != "cmd-25" {
+		t.Fatalf("expected newest 5 events, got %+v", events)
+	}
+
+	// across backups
+	events, _ = a.Query(&AuditQuery{CommandID: "cmd-20"})
+	if len(events) != 1 {
+		t.Fatalf("expected cmd-20 in backup, got %+v", events)
+	}
+}
+
+func TestAuditAPI(t *testing.T) {
+	newTestAuditLog(t, 0, 0)
+
+	cfg := &Config{
+		Tokens: []Token{
+			{Name: "ci", Token: "ci-token", Scopes: []string{ScopeExec}},
+			{Name: "auditor", Token: "auditor-token", Scopes: []string{ScopeAudit}},
+		},
+	}
+	authenticator := createAuthenticator(cfg)
+
+	app := defaults.Application()
+	app.Post("/exec", createAuthMiddleware(cfg, authenticator, ScopeExec), func(ctx *zoox.Context) {
+		auditHTTP(ctx, &AuditEvent{Action: AuditActionCommandCreate, CommandID: "cmd-1"})
+		ctx.String(200, "ok")
+	})
+	app.Get("/audit", createAuthMiddleware(cfg, authenticator, ScopeAudit), queryAuditAPI(cfg))
+
+	request := func(method, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp := httptest.NewRecorder()
+		app.ServeHTTP(resp, req)
+		return resp
+	}
+
+	request("POST", "/exec", "ci-token")
+	request("POST", "/exec", "unknown")
+
+	if resp := request("GET", "/audit", "ci-token"); resp.Code != 403 {
+		t.Fatalf("expected audit without audit scope to be forbidden, got %d", resp.Code)
+	}
+
+	query := func(qs string) []*AuditEvent {
+		t.Helper()
+
+		resp := request("GET", "/audit?"+qs, "auditor-token")
+		if resp.Code != 200 {
+			t.Fatalf("failed to query audit: %d %s", resp.Code, resp.Body.String())
+		}
+
+		body := struct {
+			Result struct {
+				Data []*AuditEvent `json:"data"`
+			} `json:"result"`
+		}{}
+		if err := json.Unmarshal(resp.Body.Bytes(), &body); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		return body.Result.Data
+	}
+
+	events := query("action=" + AuditActionCommandCreate)
+	if len(events) != 1 || events[0].Identity != "ci" || events[0].CommandID != "cmd-1" || events[0].RemoteAddr != "10.0.0.1:1234" {
+		t.Fatalf("unexpected command events: %+v", events)
+	}
+
+	events = query("action=" + AuditActionAuthFailure)
+	if len(events) != 2 {
+		t.Fatalf("expected 2 auth failures (invalid token, missing scope), got %+v", events)
+	}
+	if !strings.Contains(events[0].Reason, ScopeAudit) {
+		t.Fatalf("expected newest failure to be missing audit scope, got %+v", events[0])
+	}
+
+	// http requests authenticated are audited by actions only
+	if events := query("action=" + AuditActionAuthSuccess); len(events) != 0 {
+		t.Fatalf("expected no auth success of http requests, got %+v", events)
+	}
+}
+
+func TestRemoteAddrOf_TrustedProxies(t *testing.T) {
+	original := trustedProxies
+	t.Cleanup(func() {
+		trustedProxies = original
+	})
+
+	request := func(remoteAddr, forwarded string) *http.Request {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remoteAddr
+		if forwarded != "" {
+			req.Header.Set("X-Forwarded-For", forwarded)
+		}
+		return req
+	}
+
+	trustedProxies = nil
+	if addr := remoteAddrOf(request("10.0.0.1:1234", "1.2.3.4")); addr != "10.0.0.1:1234" {
+		t.Fatalf("expected X-Forwarded-For to be ignored without trusted proxies, got %s", addr)
+	}
+
+	var err error
+	if trustedProxies, err = parseTrustedProxies([]string{"10.0.0.1", "172.16.0.0/12"}); err != nil {
+		t.Fatalf("failed to parse trusted proxies: %v", err)
+	}
+	cases := []struct {
+		remoteAddr string
+		forwarded  string
+		addr       string
+	}{
+		{"10.0.0.1:1234", "1.2.3.4", "1.2.3.4"},
+		{"10.0.0.1:1234", "6.6.6.6, 1.2.3.4, 172.16.0.2", "1.2.3.4"},
+		{"10.0.0.2:1234", "1.2.3.4", "10.0.0.2:1234"},
+		{"10.0.0.1:1234", "", "10.0.0.1:1234"},
+	}
+	for _, c := range cases {
+		if addr := remoteAddrOf(request(c.remoteAddr, c.forwarded)); addr != c.addr {
+			t.Fatalf("remoteAddrOf(%s, %q): expected %s, got %s", c.remoteAddr, c.forwarded, c.addr, addr)
+		}
+	}
+
+	if _, err := parseTrustedProxies([]string{"proxy"}); err == nil {
+		t.Fatalf("expected invalid trusted proxy to fail")
+	}
+}
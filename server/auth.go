@@ -1,79 +1,270 @@
 package server
 
 import (
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
+	"os"
+	"slices"
+	"strings"
 
-	caas "github.com/go-idp/agent"
-	"github.com/go-zoox/fetch"
+	"github.com/go-idp/agent/entities"
+	dcommand "github.com/go-idp/agent/server/data/command"
+	"github.com/go-zoox/zoox"
 )
 
-func createAuthenticator(cfg *Config) func(clientID, clientSecret string) (err error) {
-	return func(clientID, clientSecret string) (err error) {
-		// static auth
-		if cfg.ClientID != "" && cfg.ClientSecret != "" {
-			if clientID != cfg.ClientID || clientSecret != cfg.ClientSecret {
-				return fmt.Errorf("invalid client id or secret")
-			}
+// scopes of api token
+const (
+	ScopeExec       = "exec"
+	ScopeReadLogs   = "read-logs"
+	ScopeCancel     = "cancel"
+	ScopeFilesWrite = "files:write"
+	ScopeTerminal   = "terminal"
+	ScopeAudit      = "audit"
+	// ScopeAdmin sees and cancels the commands of all callers, others only their own
+	ScopeAdmin = "admin"
+	// ScopeAll grants all scopes
+	ScopeAll = "*"
+)
+
+// Token is the api token with scopes
+type Token struct {
+	Name  string `config:"name" json:"name"`
+	Token string `config:"token" json:"token"`
+	// Scopes are the permissions of token, options: exec, read-logs, cancel, files:write, terminal, audit, admin, *
+	//	read-logs also covers reading command history.
+	Scopes []string `config:"scopes" json:"scopes"`
+	// Weight is the share of commands when queued, against other callers, default: 1
+	Weight int `config:"weight" json:"weight"`
+}
+
+// Identity is the caller authenticated
+type Identity struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// ExpiresAt is when the credential expires, in unix seconds, 0 means never
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+	// Weight is the share of commands when queued, 0 means 1
+	Weight int `json:"weight,omitempty"`
+}
+
+// HasScope returns true if the identity is granted the scope
+func (i *Identity) HasScope(scope string) bool {
+	return slices.Contains(i.Scopes, ScopeAll) || slices.Contains(i.Scopes, scope)
+}
+
+// IsAdmin returns true if the identity can access the commands of all callers
+func (i *Identity) IsAdmin() bool {
+	return i.HasScope(ScopeAdmin)
+}
+
+// CanAccess returns true if the identity is admin or the owner of command,
+//
+//	commands without owner recorded are only accessible to admins.
+func (i *Identity) CanAccess(c *dcommand.Command) bool {
+	if i.IsAdmin() {
+		return true
+	}
+
+	return i.Name != "" && c.Caller != nil && c.Caller.Name == i.Name
+}
+
+// Caller returns the identity recorded with command, from the remote address
+func (i *Identity) Caller(remoteAddr string) *dcommand.Caller {
+	return &dcommand.Caller{
+		Name:       i.Name,
+		Scopes:     i.Scopes,
+		ExpiresAt:  i.ExpiresAt,
+		RemoteAddr: remoteAddr,
+		Weight:     i.Weight,
+	}
+}
+
+// defaultScopes are the scopes of identities without scopes configured,
+//
+//	which run, read and cancel their own commands only.
+var defaultScopes = []string{ScopeExec, ScopeReadLogs, ScopeCancel}
+
+// anonymous is the identity when auth is disabled
+var anonymous = &Identity{Name: "anonymous", Scopes: []string{ScopeAll}}
+
+// unauthenticated is the identity not authenticated when auth is enabled, which has no scopes and owns no commands
+var unauthenticated = &Identity{}
+
+// loadTokens appends the tokens in TokensFile to Tokens
+func (c *Config) loadTokens() error {
+	if c.TokensFile == "" {
+		return nil
+	}
+
+	raw, err := os.ReadFile(c.TokensFile)
+	if err != nil {
+		return fmt.Errorf("failed to read tokens file: %s", err)
+	}
+
+	tokens := []Token{}
+	if err := json.Unmarshal(raw, &tokens); err != nil {
+		return fmt.Errorf("failed to parse tokens file: %s", err)
+	}
+
+	for _, token := range tokens {
+		if token.Token == "" {
+			return fmt.Errorf("token of %s is empty", token.Name)
+		}
+	}
+
+	c.Tokens = append(c.Tokens, tokens...)
+	return nil
+}
+
+// findToken returns the api token matched, nil if not found
+func (c *Config) findToken(token string) *Token {
+	if token == "" {
+		return nil
+	}
+
+	for i := range c.Tokens {
+		if subtle.ConstantTimeCompare([]byte(c.Tokens[i].Token), []byte(token)) == 1 {
+			return &c.Tokens[i]
+		}
+	}
+
+	return nil
+}
+
+// isAuthEnabled returns true if any authentication is configured
+func (c *Config) isAuthEnabled() bool {
+	return c.isCredentialAuthEnabled() || c.TLSClientCAFile != ""
+}
+
+// isCredentialAuthEnabled returns true if any authentication of credentials is configured,
+//
+//	otherwise only client certificates are accepted when auth is enabled.
+func (c *Config) isCredentialAuthEnabled() bool {
+	return c.isStaticAuthEnabled() || c.AuthService != "" || len(c.Tokens) != 0 || c.jwt != nil
+}
+
+// isStaticAuthEnabled returns true if client id or secret is configured, the one not configured should be empty
+func (c *Config) isStaticAuthEnabled() bool {
+	return c.ClientID != "" || c.ClientSecret != ""
+}
 
-			return nil
+// Authenticator authenticates the credential, returns the identity of caller
+type Authenticator func(req *entities.AuthRequest) (identity *Identity, err error)
+
+// createAuthenticator creates the authenticator shared by websocket, REST, SSE and terminal,
+//
+//	credentials are checked in order: jwt, api token, static client id and secret, auth service.
+func createAuthenticator(cfg *Config) Authenticator {
+	var authService *authServiceClient
+	if cfg.AuthService != "" {
+		authService = newAuthServiceClient(cfg)
+	}
+
+	return func(req *entities.AuthRequest) (identity *Identity, err error) {
+		// api token and jwt are also accepted as the secret of basic auth, for the browser of terminal
+		token := req.Token
+		if token == "" {
+			token = req.ClientSecret
 		}
 
-		if cfg.AuthService != "" {
-			// Protocol:
-			// Request:
-			//   POST <AuthService>
-			//		Header:
-			//   		Content-Type: application/json
-			//   		X-Client-ID: <ClientID>
-			//   		X-Client-Secret: <ClientSecret>
-			//
-			//		Body:
-			//   	{
-			//     	"client_id": <ClientID>,
-			//     	"client_secret": <ClientSecret>
-			//   	}
-			//
-			// Response:
-			//   Status: 200
-			//   Body:
-			//   	{
-			//			"code": 200,
-			//     	"message": "ok"
-			//   	}
-			//
-			response, err := fetch.Post(cfg.AuthService, &fetch.Config{
-				Headers: fetch.Headers{
-					"Content-Type":    "application/json",
-					"User-Agent":      fmt.Sprintf("caas/%s", caas.Version),
-					"X-Client-ID":     clientID,
-					"X-Client-Secret": clientSecret,
-				},
-				Body: map[string]string{
-					"client_id":     clientID,
-					"client_secret": clientSecret,
-				},
-			})
+		if cfg.jwt != nil && isJWT(token) {
+			identity, err := cfg.jwt.Verify(token)
 			if err != nil {
-				return fmt.Errorf("failed to communicate with auth service(%s): %s", cfg.AuthService, err)
+				metricAuthFailures.WithLabelValues(authFailureInvalidCredentials).Inc()
+				return nil, fmt.Errorf("invalid jwt: %s", err)
 			}
 
-			if response.Status != 200 {
-				return fmt.Errorf("failed to authenticate by response status(%d): %s", response.Status, response.String())
+			return identity, nil
+		}
+
+		if len(cfg.Tokens) != 0 {
+			if t := cfg.findToken(token); t != nil {
+				return &Identity{Name: t.Name, Scopes: t.Scopes, Weight: t.Weight}, nil
 			}
 
-			code := response.Get("code").Int()
-			if code != 200 {
-				message := response.Get("message").String()
-				if message == "" {
-					message = fmt.Sprintf("unknown error (%s)", response.String())
-				}
+			if req.Token != "" {
+				metricAuthFailures.WithLabelValues(authFailureInvalidCredentials).Inc()
+				return nil, fmt.Errorf("invalid token")
+			}
+		}
 
-				return fmt.Errorf("[%d] %s", code, message)
+		// static auth
+		if cfg.isStaticAuthEnabled() {
+			isClientIDMatched := subtle.ConstantTimeCompare([]byte(req.ClientID), []byte(cfg.ClientID)) == 1
+			isClientSecretMatched := subtle.ConstantTimeCompare([]byte(req.ClientSecret), []byte(cfg.ClientSecret)) == 1
+			if !isClientIDMatched || !isClientSecretMatched {
+				metricAuthFailures.WithLabelValues(authFailureInvalidCredentials).Inc()
+				return nil, fmt.Errorf("invalid client id or secret")
 			}
 
-			return nil
+			return &Identity{Name: req.ClientID, Scopes: []string{ScopeAll}}, nil
 		}
 
-		return nil
+		if authService != nil {
+			return authService.Authenticate(req)
+		}
+
+		// only api tokens or jwt are configured
+		if len(cfg.Tokens) != 0 || cfg.jwt != nil {
+			metricAuthFailures.WithLabelValues(authFailureInvalidCredentials).Inc()
+			return nil, fmt.Errorf("invalid token")
+		}
+
+		// only client certificates are accepted
+		if cfg.isAuthEnabled() {
+			metricAuthFailures.WithLabelValues(authFailureMissingCredentials).Inc()
+			return nil, fmt.Errorf("client certificate is required")
+		}
+
+		return anonymous, nil
+	}
+}
+
+// createAuthMiddleware creates the middleware of http routes, which requires the scope,
+//
+//	credentials are accepted by bearer token or basic auth.
+func createAuthMiddleware(cfg *Config, authenticator Authenticator, scope string) func(ctx *zoox.Context) {
+	return func(ctx *zoox.Context) {
+		if !cfg.isAuthEnabled() {
+			ctx.State().Set("identity", anonymous)
+			ctx.Next()
+			return
+		}
+
+		// the verified client certificate is the identity, unless credentials are given and accepted
+		identity := certIdentity(cfg, ctx.Request)
+		if identity == nil || (cfg.isCredentialAuthEnabled() && ctx.Authorization() != "") {
+			req := &entities.AuthRequest{}
+			if authorization := ctx.Authorization(); strings.HasPrefix(authorization, "Bearer ") {
+				req.Token = strings.TrimPrefix(authorization, "Bearer ")
+			} else if user, pass, ok := ctx.Request.BasicAuth(); ok {
+				req.ClientID = user
+				req.ClientSecret = pass
+			} else {
+				metricAuthFailures.WithLabelValues(authFailureMissingCredentials).Inc()
+				auditHTTP(ctx, &AuditEvent{Action: AuditActionAuthFailure, Path: ctx.Path, Reason: "missing credentials"})
+				ctx.Set("WWW-Authenticate", `Basic realm="go-zoox"`)
+				ctx.Status(401)
+				return
+			}
+
+			var err error
+			if identity, err = authenticator(req); err != nil {
+				auditHTTP(ctx, &AuditEvent{Action: AuditActionAuthFailure, Identity: req.ClientID, Path: ctx.Path, Reason: err.Error()})
+				ctx.Status(401)
+				return
+			}
+		}
+
+		if !identity.HasScope(scope) {
+			auditHTTP(ctx, &AuditEvent{Action: AuditActionAuthFailure, Identity: identity.Name, Path: ctx.Path, Reason: fmt.Sprintf("scope %s is required", scope)})
+			ctx.Fail(fmt.Errorf("scope %s is required", scope), 403, fmt.Sprintf("permission denied: scope %s is required", scope), 403)
+			return
+		}
+
+		// success is audited by the actions, not every request
+		ctx.State().Set("identity", identity)
+		ctx.Next()
 	}
 }
@@ -0,0 +1,289 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	goerrors "errors"
+	"fmt"
+	"sync"
+	"time"
+
+	caas "github.com/go-idp/agent"
+	"github.com/go-idp/agent/entities"
+	"github.com/go-zoox/core-utils/safe"
+	"github.com/go-zoox/fetch"
+	"github.com/go-zoox/logger"
+)
+
+// defaults of auth service
+const (
+	DefaultAuthServiceTimeout          = 5
+	DefaultAuthServiceCacheTTL         = 60
+	DefaultAuthServiceNegativeCacheTTL = 10
+	DefaultAuthServiceRetries          = 2
+	DefaultAuthServiceBreakerThreshold = 5
+	DefaultAuthServiceBreakerCooldown  = 30
+)
+
+// authServiceBackoff is the base backoff of retry, which grows quadratically
+var authServiceBackoff = 100 * time.Millisecond
+
+// authServiceCacheSize is the size of cache to prune expired results
+const authServiceCacheSize = 1024
+
+// errAuthServiceUnavailable is returned when the circuit breaker is open, which fails closed
+var errAuthServiceUnavailable = fmt.Errorf("auth service is unavailable")
+
+// authServiceClient calls the external auth service, with cache, retry and circuit breaker
+type authServiceClient struct {
+	url string
+	// scopes are the scopes of identities whose scopes are not in response
+	scopes []string
+	//
+	timeout          time.Duration
+	cacheTTL         time.Duration
+	negativeCacheTTL time.Duration
+	retries          int
+	breakerThreshold int
+	breakerCooldown  time.Duration
+	//
+	cache *safe.Map[string, *authServiceResult]
+	//
+	sync.Mutex
+	failures  int
+	openUntil time.Time
+	// isProbing is true when the half-open breaker lets one request through
+	isProbing bool
+}
+
+type authServiceResult struct {
+	identity  *Identity
+	err       error
+	expiresAt time.Time
+}
+
+// authServiceRejection is the error of credential rejected by auth service, which is cached and not retried
+type authServiceRejection struct {
+	message string
+}
+
+func (e *authServiceRejection) Error() string {
+	return e.message
+}
+
+func newAuthServiceClient(cfg *Config) *authServiceClient {
+	orDefault := func(v int64, d int64) int64 {
+		if v == 0 {
+			return d
+		}
+
+		return v
+	}
+
+	scopes := cfg.AuthServiceScopes
+	if len(scopes) == 0 {
+		scopes = defaultScopes
+	}
+
+	return &authServiceClient{
+		url:              cfg.AuthService,
+		scopes:           scopes,
+		timeout:          time.Duration(orDefault(cfg.AuthServiceTimeout, DefaultAuthServiceTimeout)) * time.Second,
+		cacheTTL:         time.Duration(orDefault(cfg.AuthServiceCacheTTL, DefaultAuthServiceCacheTTL)) * time.Second,
+		negativeCacheTTL: time.Duration(orDefault(cfg.AuthServiceNegativeCacheTTL, DefaultAuthServiceNegativeCacheTTL)) * time.Second,
+		retries:          max(int(orDefault(cfg.AuthServiceRetries, DefaultAuthServiceRetries)), 0),
+		breakerThreshold: int(orDefault(cfg.AuthServiceBreakerThreshold, DefaultAuthServiceBreakerThreshold)),
+		breakerCooldown:  time.Duration(orDefault(cfg.AuthServiceBreakerCooldown, DefaultAuthServiceBreakerCooldown)) * time.Second,
+		cache:            safe.NewMap[string, *authServiceResult](),
+	}
+}
+
+// Authenticate authenticates the client id and secret by auth service
+func (c *authServiceClient) Authenticate(req *entities.AuthRequest) (*Identity, error) {
+	key := credentialHash(req.ClientID, req.ClientSecret)
+	if result := c.cache.Get(key); result != nil && time.Now().Before(result.expiresAt) {
+		if result.err != nil {
+			metricAuthFailures.WithLabelValues(authFailureServiceRejected).Inc()
+		}
+
+		return result.identity, result.err
+	}
+
+	if !c.allow() {
+		metricAuthFailures.WithLabelValues(authFailureServiceUnavailable).Inc()
+		return nil, errAuthServiceUnavailable
+	}
+
+	scopes, err := c.requestWithRetry(req)
+	rejection := &authServiceRejection{}
+	switch {
+	case err == nil:
+		c.record(true)
+
+		if len(scopes) == 0 {
+			scopes = c.scopes
+		}
+
+		identity := &Identity{Name: req.ClientID, Scopes: scopes}
+		c.store(key, &authServiceResult{identity: identity, expiresAt: time.Now().Add(c.cacheTTL)})
+		return identity, nil
+	case goerrors.As(err, &rejection):
+		// the auth service works, only the credential is rejected
+		c.record(true)
+
+		metricAuthFailures.WithLabelValues(authFailureServiceRejected).Inc()
+		c.store(key, &authServiceResult{err: err, expiresAt: time.Now().Add(c.negativeCacheTTL)})
+		return nil, err
+	default:
+		c.record(false)
+
+		metricAuthFailures.WithLabelValues(authFailureServiceUnavailable).Inc()
+		return nil, fmt.Errorf("failed to communicate with auth service(%s): %s", c.url, err)
+	}
+}
+
+// requestWithRetry calls the auth service, retries with backoff unless the credential is rejected
+func (c *authServiceClient) requestWithRetry(req *entities.AuthRequest) (scopes []string, err error) {
+	rejection := &authServiceRejection{}
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt*attempt) * authServiceBackoff)
+		}
+
+		if scopes, err = c.request(req); err == nil || goerrors.As(err, &rejection) {
+			return scopes, err
+		}
+
+		logger.Warnf("[auth] failed to call auth service (attempt: %d): %s", attempt+1, err)
+	}
+
+	return nil, err
+}
+
+// store caches the result, expired results are pruned when cache is full
+func (c *authServiceClient) store(key string, result *authServiceResult) {
+	if keys := c.cache.Keys(); len(keys) >= authServiceCacheSize {
+		now := time.Now()
+		for _, k := range keys {
+			if r := c.cache.Get(k); r == nil || now.After(r.expiresAt) {
+				c.cache.Del(k)
+			}
+		}
+	}
+
+	c.cache.Set(key, result)
+}
+
+// request calls the auth service once, returns the scopes granted in response
+//
+// Protocol:
+// Request:
+//
+//	POST <AuthService>
+//		Header:
+//			Content-Type: application/json
+//			X-Client-ID: <ClientID>
+//			X-Client-Secret: <ClientSecret>
+//
+//		Body:
+//		{
+//			"client_id": <ClientID>,
+//			"client_secret": <ClientSecret>
+//		}
+//
+// Response:
+//
+//	Status: 200
+//	Body:
+//	{
+//		"code": 200,
+//		"message": "ok",
+//		"scopes": ["exec", "read-logs"] // optional, default: AuthServiceScopes
+//	}
+func (c *authServiceClient) request(req *entities.AuthRequest) ([]string, error) {
+	response, err := fetch.Post(c.url, &fetch.Config{
+		Headers: fetch.Headers{
+			"Content-Type":    "application/json",
+			"User-Agent":      fmt.Sprintf("caas/%s", caas.Version),
+			"X-Client-ID":     req.ClientID,
+			"X-Client-Secret": req.ClientSecret,
+		},
+		Body: map[string]string{
+			"client_id":     req.ClientID,
+			"client_secret": req.ClientSecret,
+		},
+		Timeout: c.timeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// server errors are retried
+	if response.Status >= 500 {
+		return nil, fmt.Errorf("unexpected response status(%d): %s", response.Status, response.String())
+	}
+
+	if response.Status != 200 {
+		return nil, &authServiceRejection{message: fmt.Sprintf("failed to authenticate by response status(%d): %s", response.Status, response.String())}
+	}
+
+	code := response.Get("code").Int()
+	if code != 200 {
+		message := response.Get("message").String()
+		if message == "" {
+			message = fmt.Sprintf("unknown error (%s)", response.String())
+		}
+
+		return nil, &authServiceRejection{message: fmt.Sprintf("[%d] %s", code, message)}
+	}
+
+	scopes := []string{}
+	for _, scope := range response.Get("scopes").Array() {
+		scopes = append(scopes, scope.String())
+	}
+
+	return scopes, nil
+}
+
+// allow returns false if the circuit breaker is open,
+//
+//	after cooldown, one request is let through to probe the auth service.
+func (c *authServiceClient) allow() bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.failures < c.breakerThreshold {
+		return true
+	}
+
+	if time.Now().Before(c.openUntil) || c.isProbing {
+		return false
+	}
+
+	c.isProbing = true
+	return true
+}
+
+// record records the result of auth service, the breaker opens after threshold failures in a row
+func (c *authServiceClient) record(ok bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.isProbing = false
+	if ok {
+		c.failures = 0
+		return
+	}
+
+	c.failures++
+	if c.failures >= c.breakerThreshold {
+		c.openUntil = time.Now().Add(c.breakerCooldown)
+		logger.Warnf("[auth] auth service circuit breaker is open for %s", c.breakerCooldown)
+	}
+}
+
+// credentialHash is the cache key of credential, which does not keep the secret
+func credentialHash(clientID, clientSecret string) string {
+	h := sha256.Sum256([]byte(clientID + "\x00" + clientSecret))
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-idp/agent/entities"
+)
+
+// newTestAuthService starts an auth service, which accepts the secret "ok",
+//
+//	the client "ops" is granted exec and admin, the handler returns false to response 500.
+func newTestAuthService(t *testing.T, handler func(calls int64) bool) (url string, calls *int64) {
+	t.Helper()
+
+	calls = new(int64)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(calls, 1)
+		if handler != nil && !handler(n) {
+			w.WriteHeader(500)
+			return
+		}
+
+		body := map[string]string{}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["client_secret"] != "ok" {
+			json.NewEncoder(w).Encode(map[string]any{"code": 401, "message": "invalid secret"})
+			return
+		}
+
+		if body["client_id"] == "ops" {
+			json.NewEncoder(w).Encode(map[string]any{"code": 200, "message": "ok", "scopes": []string{ScopeExec, ScopeAdmin}})
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]any{"code": 200, "message": "ok"})
+	}))
+	t.Cleanup(ts.Close)
+
+	return ts.URL, calls
+}
+
+func TestAuthService_CachesResults(t *testing.T) {
+	url, calls := newTestAuthService(t, nil)
+	authenticate := createAuthenticator(&Config{AuthService: url})
+
+	for i := 0; i < 3; i++ {
+		identity, err := authenticate(&entities.AuthRequest{ClientID: "ci", ClientSecret: "ok"})
+		if err != nil {
+			t.Fatalf("failed to authenticate: %v", err)
+		}
+		if identity.Name != "ci" {
+			t.Fatalf("unexpected identity: %+v", identity)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := authenticate(&entities.AuthRequest{ClientID: "ci", ClientSecret: "bad"}); err == nil {
+			t.Fatalf("expected bad secret to fail")
+		}
+	}
+
+	if n := atomic.LoadInt64(calls); n != 2 {
+		t.Fatalf("expected 2 calls to auth service with cache, got %d", n)
+	}
+}
+
+func TestAuthService_Scopes(t *testing.T) {
+	url, _ := newTestAuthService(t, nil)
+
+	identity, err := createAuthenticator(&Config{AuthService: url})(&entities.AuthRequest{ClientID: "ci", ClientSecret: "ok"})
+	if err != nil {
+		t.Fatalf("failed to authenticate: %v", err)
+	}
+	if identity.IsAdmin() || !identity.HasScope(ScopeExec) {
+		t.Fatalf("expected default scopes without scopes in response, got %v", identity.Scopes)
+	}
+
+	identity, _ = createAuthenticator(&Config{AuthService: url, AuthServiceScopes: []string{ScopeReadLogs}})(&entities.AuthRequest{ClientID: "ci", ClientSecret: "ok"})
+	if identity == nil || identity.HasScope(ScopeExec) || !identity.HasScope(ScopeReadLogs) {
+		t.Fatalf("expected scopes configured, got %+v", identity)
+	}
+
+	identity, _ = createAuthenticator(&Config{AuthService: url})(&entities.AuthRequest{ClientID: "ops", ClientSecret: "ok"})
+	if identity == nil || !identity.IsAdmin() || identity.HasScope(ScopeTerminal) {
+		t.Fatalf("expected scopes in response, got %+v", identity)
+	}
+}
+
+func TestAuthService_CacheExpires(t *testing.T) {
+	url, calls := newTestAuthService(t, nil)
+	client := newAuthServiceClient(&Config{AuthService: url})
+	client.cacheTTL = 50 * time.Millisecond
+
+	client.Authenticate(&entities.AuthRequest{ClientID: "ci", ClientSecret: "ok"})
+	time.Sleep(100 * time.Millisecond)
+	client.Authenticate(&entities.AuthRequest{ClientID: "ci", ClientSecret: "ok"})
+
+	if n := atomic.LoadInt64(calls); n != 2 {
+		t.Fatalf("expected cache to expire, got %d calls", n)
+	}
+}
+
+func TestAuthService_RetriesServerErrors(t *testing.T) {
+	original := authServiceBackoff
+	authServiceBackoff = time.Millisecond
+	defer func() {
+		authServiceBackoff = original
+	}()
+
+	// fails twice, then succeeds
+	url, calls := newTestAuthService(t, func(n int64) bool {
+		return n > 2
+	})
+	authenticate := createAuthenticator(&Config{AuthService: url})
+
+	if _, err := authenticate(&entities.AuthRequest{ClientID: "ci", ClientSecret: "ok"}); err != nil {
+		t.Fatalf("expected retry to succeed: %v", err)
+	}
+	if n := atomic.LoadInt64(calls); n != 3 {
+		t.Fatalf("expected 3 calls, got %d", n)
+	}
+
+	// rejection is not retried
+	if _, err := authenticate(&entities.AuthRequest{ClientID: "ci", ClientSecret: "bad"}); err == nil {
+		t.Fatalf("expected bad secret to fail")
+	}
+	if n := atomic.LoadInt64(calls); n != 4 {
+		t.Fatalf("expected rejection not to be retried, got %d calls", n)
+	}
+}
+
+func TestAuthService_CircuitBreaker(t *testing.T) {
+	original := authServiceBackoff
+	authServiceBackoff = time.Millisecond
+	defer func() {
+		authServiceBackoff = original
+	}()
+
+	var isDown atomic.Bool
+	isDown.Store(true)
+	url, calls := newTestAuthService(t, func(n int64) bool {
+		return !isDown.Load()
+	})
+
+	client := newAuthServiceClient(&Config{
+		AuthService:                 url,
+		AuthServiceRetries:          -1,
+		AuthServiceBreakerThreshold: 2,
+	})
+	client.breakerCooldown = 100 * time.Millisecond
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.Authenticate(&entities.AuthRequest{ClientID: "ci", ClientSecret: "ok"}); err == nil {
+			t.Fatalf("expected auth service down to fail")
+		}
+	}
+
+	// breaker is open, fails closed without calling auth service
+	isDown.Store(false)
+	if _, err := client.Authenticate(&entities.AuthRequest{ClientID: "ci", ClientSecret: "ok"}); err != errAuthServiceUnavailable {
+		t.Fatalf("expected breaker to be open, got %v", err)
+	}
+	if n := atomic.LoadInt64(calls); n != 2 {
+		t.Fatalf("expected 2 calls before breaker open, got %d", n)
+	}
+
+	// half open after cooldown, the probe closes breaker
+	time.Sleep(150 * time.Millisecond)
+	if _, err := client.Authenticate(&entities.AuthRequest{ClientID: "ci", ClientSecret: "ok"}); err != nil {
+		t.Fatalf("expected probe to succeed: %v", err)
+	}
+	if _, err := client.Authenticate(&entities.AuthRequest{ClientID: "other", ClientSecret: "ok"}); err != nil {
+		t.Fatalf("expected breaker to be closed: %v", err)
+	}
+}
+
+func TestAuthService_Timeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	}))
+	defer ts.Close()
+
+	client := newAuthServiceClient(&Config{AuthService: ts.URL, AuthServiceRetries: -1})
+	client.timeout = 50 * time.Millisecond
+
+	startedAt := time.Now()
+	if _, err := client.Authenticate(&entities.AuthRequest{ClientID: "ci", ClientSecret: "ok"}); err == nil {
+		t.Fatalf("expected timeout to fail")
+	}
+	if elapsed := time.Since(startedAt); elapsed > 400*time.Millisecond {
+		t.Fatalf("expected request to time out early, took %s", elapsed)
+	}
+}
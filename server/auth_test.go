@@ -0,0 +1,270 @@
+package server
+
+import (
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-idp/agent/client"
+	"github.com/go-idp/agent/entities"
+	dcommand "github.com/go-idp/agent/server/data/command"
+	"github.com/go-zoox/zoox"
+	"github.com/go-zoox/zoox/defaults"
+)
+
+func TestAuthenticator_Tokens(t *testing.T) {
+	cfg := &Config{
+		Tokens: []Token{
+			{Name: "ci", Token: "ci-token", Scopes: []string{ScopeExec, ScopeReadLogs}},
+			{Name: "admin", Token: "admin-token", Scopes: []string{ScopeAll}},
+		},
+	}
+	authenticator := createAuthenticator(cfg)
+
+	identity, err := authenticator(&entities.AuthRequest{Token: "ci-token"})
+	if err != nil {
+		t.Fatalf("failed to authenticate token: %v", err)
+	}
+	if identity.Name != "ci" || !identity.HasScope(ScopeExec) || identity.HasScope(ScopeCancel) {
+		t.Fatalf("unexpected identity: %+v", identity)
+	}
+
+	// token as secret of basic auth
+	identity, err = authenticator(&entities.AuthRequest{ClientID: "any", ClientSecret: "admin-token"})
+	if err != nil {
+		t.Fatalf("failed to authenticate token as secret: %v", err)
+	}
+	if identity.Name != "admin" || !identity.HasScope(ScopeTerminal) {
+		t.Fatalf("unexpected identity: %+v", identity)
+	}
+
+	if _, err := authenticator(&entities.AuthRequest{Token: "unknown"}); err == nil {
+		t.Fatalf("expected unknown token to fail")
+	}
+	if _, err := authenticator(&entities.AuthRequest{}); err == nil {
+		t.Fatalf("expected empty credential to fail")
+	}
+}
+
+func TestAuthenticator_StaticClientSecretOnly(t *testing.T) {
+	cfg := &Config{ClientSecret: "secret"}
+	if !cfg.isAuthEnabled() {
+		t.Fatalf("expected client secret alone to enable auth")
+	}
+	authenticator := createAuthenticator(cfg)
+
+	identity, err := authenticator(&entities.AuthRequest{ClientSecret: "secret"})
+	if err != nil {
+		t.Fatalf("failed to authenticate client secret: %v", err)
+	}
+	if identity == anonymous {
+		t.Fatalf("expected identity of client, got anonymous")
+	}
+
+	for _, req := range []*entities.AuthRequest{
+		{},
+		{ClientSecret: "wrong"},
+		{ClientID: "any", ClientSecret: "secret"},
+	} {
+		if _, err := authenticator(req); err == nil {
+			t.Fatalf("expected credential %+v to fail", req)
+		}
+	}
+}
+
+func TestConfig_LoadTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	if err := os.WriteFile(path, []byte(`[{"name":"ci","token":"ci-token","scopes":["exec"]}]`), 0o600); err != nil {
+		t.Fatalf("failed to write tokens file: %v", err)
+	}
+
+	cfg := &Config{TokensFile: path}
+	if err := cfg.loadTokens(); err != nil {
+		t.Fatalf("failed to load tokens: %v", err)
+	}
+	if token := cfg.findToken("ci-token"); token == nil || token.Name != "ci" {
+		t.Fatalf("expected token ci to be loaded, got %+v", cfg.Tokens)
+	}
+}
+
+func TestAuthMiddleware_Scopes(t *testing.T) {
+	cfg := &Config{
+		Tokens: []Token{
+			{Name: "reader", Token: "reader-token", Scopes: []string{ScopeReadLogs}},
+		},
+	}
+	authenticator := createAuthenticator(cfg)
+
+	app := defaults.Application()
+	app.Get("/logs", createAuthMiddleware(cfg, authenticator, ScopeReadLogs), func(ctx *zoox.Context) {
+		identity := ctx.State().Get("identity").(*Identity)
+		ctx.String(200, identity.Name)
+	})
+	app.Post("/exec", createAuthMiddleware(cfg, authenticator, ScopeExec), func(ctx *zoox.Context) {
+		ctx.String(200, "ok")
+	})
+
+	cases := []struct {
+		method        string
+		path          string
+		authorization string
+		status        int
+	}{
+		{"GET", "/logs", "", 401},
+		{"GET", "/logs", "Bearer unknown", 401},
+		{"GET", "/logs", "Bearer reader-token", 200},
+		{"POST", "/exec", "Bearer reader-token", 403},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.path, nil)
+		if c.authorization != "" {
+			req.Header.Set("Authorization", c.authorization)
+		}
+		resp := httptest.NewRecorder()
+		app.ServeHTTP(resp, req)
+
+		if resp.Code != c.status {
+			t.Fatalf("%s %s (%s): expected status %d, got %d", c.method, c.path, c.authorization, c.status, resp.Code)
+		}
+	}
+
+	// token as password of basic auth
+	req := httptest.NewRequest("GET", "/logs", nil)
+	req.SetBasicAuth("reader", "reader-token")
+	resp := httptest.NewRecorder()
+	app.ServeHTTP(resp, req)
+	if resp.Code != 200 || resp.Body.String() != "reader" {
+		t.Fatalf("expected basic auth with token to pass, got %d: %s", resp.Code, resp.Body.String())
+	}
+}
+
+func TestWsService_TokenScopes(t *testing.T) {
+	addr := newTestWsServer(t, &Config{
+		Tokens: []Token{
+			{Name: "ci", Token: "ci-token", Scopes: []string{ScopeExec}},
+			{Name: "reader", Token: "reader-token", Scopes: []string{ScopeReadLogs}},
+		},
+	})
+
+	stdout := &lockedBuffer{}
+	c1 := client.New(&client.Config{Server: addr, Token: "ci-token", Stdout: stdout, Stderr: io.Discard})
+	if err := c1.Connect(); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c1.Close()
+
+	if err := c1.Exec(&entities.Command{Script: "echo hi"}); err != nil {
+		t.Fatalf("failed to exec with exec scope: %v", err)
+	}
+	if stdout.String() != "hi\n" {
+		t.Fatalf("unexpected stdout: %q", stdout.String())
+	}
+
+	stderr := &lockedBuffer{}
+	c2 := client.New(&client.Config{Server: addr, Token: "reader-token", Stdout: io.Discard, Stderr: stderr})
+	if err := c2.Connect(); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c2.Close()
+
+	if err := c2.Exec(&entities.Command{Script: "echo hi"}); err == nil {
+		t.Fatalf("expected exec without exec scope to fail")
+	}
+	waitForOutput(t, stderr, "permission denied")
+}
+
+func TestAuthMiddleware_AuthService(t *testing.T) {
+	url, calls := newTestAuthService(t, nil)
+	cfg := &Config{AuthService: url}
+	authenticator := createAuthenticator(cfg)
+
+	app := defaults.Application()
+	app.Post("/exec", createAuthMiddleware(cfg, authenticator, ScopeExec), func(ctx *zoox.Context) {
+		ctx.String(200, "ok")
+	})
+	app.Get("/commands/:id/log/sse", createAuthMiddleware(cfg, authenticator, ScopeReadLogs), func(ctx *zoox.Context) {
+		ctx.String(200, "ok")
+	})
+
+	cases := []struct {
+		method string
+		path   string
+		secret string
+		status int
+	}{
+		{"POST", "/exec", "", 401},
+		{"POST", "/exec", "bad", 401},
+		{"POST", "/exec", "ok", 200},
+		{"GET", "/commands/x/log/sse", "", 401},
+		{"GET", "/commands/x/log/sse", "ok", 200},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.path, nil)
+		if c.secret != "" {
+			req.SetBasicAuth("ci", c.secret)
+		}
+		resp := httptest.NewRecorder()
+		app.ServeHTTP(resp, req)
+
+		if resp.Code != c.status {
+			t.Fatalf("%s %s (secret: %q): expected status %d, got %d", c.method, c.path, c.secret, c.status, resp.Code)
+		}
+	}
+
+	// the authenticator is shared, so the accepted credential is cached across routes
+	if n := atomic.LoadInt64(calls); n != 2 {
+		t.Fatalf("expected 2 calls to auth service, got %d", n)
+	}
+}
+
+func TestWsService_AuthService(t *testing.T) {
+	url, _ := newTestAuthService(t, nil)
+	addr := newTestWsServer(t, &Config{AuthService: url})
+
+	c1 := client.New(&client.Config{Server: addr, ClientID: "ci", ClientSecret: "ok", Stdout: io.Discard, Stderr: io.Discard})
+	if err := c1.Connect(); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c1.Close()
+
+	if err := c1.Exec(&entities.Command{Script: "true"}); err != nil {
+		t.Fatalf("failed to exec: %v", err)
+	}
+
+	c2 := client.New(&client.Config{Server: addr, ClientID: "ci", ClientSecret: "bad", Stdout: io.Discard, Stderr: io.Discard})
+	if err := c2.Connect(); err == nil {
+		defer c2.Close()
+		if err := c2.Exec(&entities.Command{Script: "true"}); err == nil {
+			t.Fatalf("expected bad secret to fail")
+		}
+	}
+}
+
+func TestIdentityOf_WithoutMiddleware(t *testing.T) {
+	cases := []struct {
+		cfg     *Config
+		isAdmin bool
+	}{
+		{&Config{}, true},
+		{&Config{ClientSecret: "secret"}, false},
+	}
+	for _, c := range cases {
+		var identity *Identity
+		app := defaults.Application()
+		app.Get("/", func(ctx *zoox.Context) {
+			identity = identityOf(c.cfg, ctx)
+			ctx.String(200, "ok")
+		})
+		app.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+		if identity == nil || identity.IsAdmin() != c.isAdmin {
+			t.Fatalf("expected identity without middleware to be admin=%v, got %+v", c.isAdmin, identity)
+		}
+		if !c.isAdmin && (len(identity.Scopes) != 0 || identity.CanAccess(&dcommand.Command{Caller: &dcommand.Caller{}})) {
+			t.Fatalf("expected identity without middleware to have no access, got %+v", identity)
+		}
+	}
+}
@@ -1,20 +1,307 @@
 package server
 
 import (
-	"github.com/go-zoox/core-utils/safe"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/go-zoox/datetime"
+	"github.com/go-zoox/fs"
+	"github.com/go-zoox/logger"
+
+	"github.com/go-idp/agent/entities"
 	dcommand "github.com/go-idp/agent/server/data/command"
 )
 
+// errMessageInterrupted is the error of command unfinished when the agent stopped
+const errMessageInterrupted = "agent restarted while command was running"
+
 // Commands
 var commandsCapacity = 100
-var commandsMap = safe.NewMap[string, *dcommand.Command](func(mc *safe.MapConfig) {
-	mc.Capacity = commandsCapacity
-})
-var commandsIDList = safe.NewList[string](func(lc *safe.ListConfig) {
-	lc.Capacity = commandsCapacity
+var commands dcommand.Store = dcommand.NewMemoryStore(func(cfg *dcommand.StoreConfig) {
+	cfg.MaxCount = commandsCapacity
 })
 
+// newCommandStore creates the command store by config
+func newCommandStore(cfg *Config) (dcommand.Store, error) {
+	retention := func(sc *dcommand.StoreConfig) {
+		sc.MaxCount = cfg.CommandRetentionCount
+		sc.MaxAge = time.Duration(cfg.CommandRetentionAge) * time.Second
+	}
+
+	switch cfg.CommandStore {
+	case "", "memory":
+		if cfg.CommandRetentionCount == 0 {
+			cfg.CommandRetentionCount = commandsCapacity
+		}
+
+		return dcommand.NewMemoryStore(retention), nil
+	case "bolt":
+		if cfg.CommandStorePath == "" {
+			cfg.CommandStorePath = "/tmp/agent/commands.db"
+		}
+
+		return dcommand.NewBoltStore(cfg.CommandStorePath, retention)
+	default:
+		return nil, fmt.Errorf("unsupported command store: %s", cfg.CommandStore)
+	}
+}
+
+// restoreCommands rebuilds the command index from the metadata dir,
+//
+//	which keeps command history available across agent restarts,
+//	the commands saved unfinished are reconciled, none of them runs after restart.
+func restoreCommands(cfg *Config) error {
+	metadataDir := cfg.MetadataDir
+	if metadataDir == "" {
+		metadataDir = "/tmp/agent/metadata"
+	}
+
+	if !fs.IsExist(metadataDir) {
+		return nil
+	}
+
+	entries, err := os.ReadDir(metadataDir)
+	if err != nil {
+		return fmt.Errorf("failed to read metadata dir: %s", err)
+	}
+
+	restored := []*dcommand.Command{}
+	reconciled := []*dcommand.Command{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		id := entry.Name()
+		stored := commands.Get(id)
+		if stored != nil && isCommandFinished(stored) {
+			continue
+		}
+
+		dc, err := restoreCommand(cfg, fmt.Sprintf("%s/%s", metadataDir, id), id)
+		if err != nil {
+			logger.Warnf("[command][id: %s] failed to restore from metadata: %s", id, err)
+			continue
+		}
+
+		// the command saved unfinished by the persistent store keeps its record, only the state is reconciled
+		if stored != nil {
+			stored.SetState(dc.Snapshot())
+			reconciled = append(reconciled, stored)
+			continue
+		}
+
+		restored = append(restored, dc)
+	}
+
+	// oldest first, so the latest command is at the head of the list
+	sort.SliceStable(restored, func(i, j int) bool {
+		left, right := acceptedAt(restored[i]), acceptedAt(restored[j])
+		if left == nil || right == nil {
+			return left == nil && right != nil
+		}
+
+		return left.Before(right)
+	})
+
+	for _, dc := range append(restored, reconciled...) {
+		if err := commands.Set(dc); err != nil {
+			return err
+		}
+	}
+
+	logger.Infof("[command] restored %d commands from metadata dir: %s", len(restored), metadataDir)
+	return failInterruptedCommands()
+}
+
+// failInterruptedCommands marks the commands saved unfinished as error, which stopped with the agent,
+//
+//	e.g. the queued ones or those whose metadata is cleaned.
+func failInterruptedCommands() error {
+	all, _, err := commands.List(nil)
+	if err != nil {
+		return fmt.Errorf("failed to list commands: %s", err)
+	}
+
+	for _, dc := range all {
+		if isCommandFinished(dc) {
+			continue
+		}
+
+		state := &dcommand.State{}
+		if snapshot := dc.Snapshot(); snapshot != nil {
+			state.StartedAt = snapshot.StartedAt
+		}
+		state.IsError = true
+		state.Status = "error"
+		state.Error = errors.New(errMessageInterrupted)
+		state.ErrorMessage = errMessageInterrupted
+		dc.SetState(state)
+
+		if err := commands.Set(dc); err != nil {
+			return err
+		}
+		logger.Infof("[command][id: %s] marked as error, which was unfinished when agent stopped", dc.ID)
+	}
+
+	return nil
+}
+
+// acceptedAt returns when the command started, or queued if it has not started, nil if neither
+func acceptedAt(dc *dcommand.Command) *datetime.DateTime {
+	state := dc.Snapshot()
+	if state.StartedAt != nil {
+		return state.StartedAt
+	}
+
+	return state.QueuedAt
+}
+
+func restoreCommand(cfg *Config, dir string, id string) (*dcommand.Command, error) {
+	startAt, err := readMetadataTime(fmt.Sprintf("%s/start_at", dir))
+	if err != nil {
+		return nil, err
+	}
+	queuedAt, err := readMetadataTime(fmt.Sprintf("%s/queued_at", dir))
+	if err != nil {
+		return nil, err
+	}
+	status, _ := readMetadataFile(fmt.Sprintf("%s/status", dir))
+	// the command cancelled before running has a final status, but has not started
+	if startAt == nil && status == "" {
+		return nil, fmt.Errorf("start_at not found")
+	}
+
+	script, err := readEncryptedMetadataFile(cfg, fmt.Sprintf("%s/script", dir))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read script: %s", err)
+	}
+	env, err := readEncryptedMetadataFile(cfg, fmt.Sprintf("%s/env", dir))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read env: %s", err)
+	}
+	errMessage, _ := readMetadataFile(fmt.Sprintf("%s/error", dir))
+
+	environment := map[string]string{}
+	for _, line := range strings.Split(env, "\n") {
+		if line == "" {
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) == 2 {
+			environment[kv[0]] = kv[1]
+		} else {
+			environment[kv[0]] = ""
+		}
+	}
+
+	state := &dcommand.State{
+		QueuedAt:  queuedAt,
+		StartedAt: startAt,
+	}
+
+	switch status {
+	case "success":
+		state.IsCompleted = true
+		state.Status = "completed"
+		state.CompletedAt, _ = readMetadataTime(fmt.Sprintf("%s/succeed_at", dir))
+	case "cancelled":
+		state.IsCancelled = true
+		state.Status = "cancelled"
+	case "failure":
+		state.IsError = true
+		state.Status = "error"
+		state.ErroredAt, _ = readMetadataTime(fmt.Sprintf("%s/failed_at", dir))
+	default:
+		// no final status means the agent stopped while the command was running
+		state.IsError = true
+		state.Status = "error"
+		if errMessage == "" {
+			errMessage = errMessageInterrupted
+		}
+	}
+
+	if errMessage != "" {
+		state.Error = errors.New(errMessage)
+		state.ErrorMessage = errMessage
+	}
+
+	if raw, _ := readMetadataFile(fmt.Sprintf("%s/exit_code", dir)); raw != "" {
+		if exitCode, err := strconv.Atoi(raw); err != nil {
+			logger.Warnf("[command] failed to parse exit code of %s: %s", id, err)
+		} else {
+			state.ExitCode = &exitCode
+		}
+	}
+
+	if usage, _ := readMetadataFile(fmt.Sprintf("%s/usage", dir)); usage != "" {
+		state.Usage = &dcommand.Usage{}
+		if err := json.Unmarshal([]byte(usage), state.Usage); err != nil {
+			logger.Warnf("[command] failed to parse usage of %s: %s", id, err)
+			state.Usage = nil
+		}
+	}
+
+	var caller *dcommand.Caller
+	if raw, _ := readMetadataFile(fmt.Sprintf("%s/caller", dir)); raw != "" {
+		caller = &dcommand.Caller{}
+		if err := json.Unmarshal([]byte(raw), caller); err != nil {
+			logger.Warnf("[command] failed to parse caller of %s: %s", id, err)
+			caller = nil
+		}
+	}
+
+	return &dcommand.Command{
+		ID: id,
+		Cmd: &entities.Command{
+			ID:          id,
+			Script:      script,
+			Environment: environment,
+		},
+		State:  state,
+		Caller: caller,
+	}, nil
+}
+
+func readMetadataFile(path string) (string, error) {
+	if !fs.IsExist(path) {
+		return "", nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(content)), nil
+}
+
+// readEncryptedMetadataFile reads the metadata file which may be encrypted
+func readEncryptedMetadataFile(cfg *Config, path string) (string, error) {
+	content, err := readCompleteMetadata(cfg, path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(content)), nil
+}
+
+func readMetadataTime(path string) (*datetime.DateTime, error) {
+	content, err := readMetadataFile(path)
+	if err != nil || content == "" {
+		return nil, err
+	}
+
+	return datetime.FromPattern("YYYY-MM-DD HH:mm:ss", content)
+}
+
 // type Command struct {
 // 	ID      string            `json:"id"`
 // 	Command *entities.Command `json:"command"`
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-idp/agent/entities"
+	dcommand "github.com/go-idp/agent/server/data/command"
+	"github.com/go-zoox/datetime"
+)
+
+func writeMetadataFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatalf("failed to create metadata dir: %v", err)
+	}
+
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("failed to write metadata file(%s): %v", name, err)
+		}
+	}
+}
+
+func TestRestoreCommands_RebuildsIndexFromMetadata(t *testing.T) {
+	tmpDir := t.TempDir()
+	cfg := &Config{MetadataDir: tmpDir}
+
+	writeMetadataFiles(t, filepath.Join(tmpDir, "cmd-restore-ok"), map[string]string{
+		"script":     "echo ok",
+		"env":        "FOO=bar\nEMPTY=",
+		"start_at":   "2024-01-01 10:00:00",
+		"succeed_at": "2024-01-01 10:00:05",
+		"status":     "success",
+	})
+	writeMetadataFiles(t, filepath.Join(tmpDir, "cmd-restore-failed"), map[string]string{
+		"script":    "exit 2",
+		"start_at":  "2024-01-01 11:00:00",
+		"failed_at": "2024-01-01 11:00:01",
+		"status":    "failure",
+		"error":     "exit status 2",
+		"exit_code": "2\n",
+	})
+	writeMetadataFiles(t, filepath.Join(tmpDir, "cmd-restore-interrupted"), map[string]string{
+		"script":   "sleep 1000",
+		"start_at": "2024-01-01 12:00:00",
+	})
+	original := commands
+	commands = dcommand.NewMemoryStore()
+	t.Cleanup(func() {
+		commands = original
+	})
+
+	if err := restoreCommands(cfg); err != nil {
+		t.Fatalf("restoreCommands returned error: %v", err)
+	}
+
+	ok := commands.Get("cmd-restore-ok")
+	if ok == nil {
+		t.Fatalf("expected cmd-restore-ok to be restored")
+	}
+	if ok.State.Status != "completed" || !ok.State.IsCompleted || ok.State.CompletedAt == nil {
+		t.Fatalf("unexpected state for cmd-restore-ok: %+v", ok.State)
+	}
+	if ok.Cmd.Script != "echo ok" || ok.Cmd.Environment["FOO"] != "bar" {
+		t.Fatalf("unexpected command for cmd-restore-ok: %+v", ok.Cmd)
+	}
+
+	failed := commands.Get("cmd-restore-failed")
+	if failed == nil {
+		t.Fatalf("expected cmd-restore-failed to be restored")
+	}
+	if failed.State.Status != "error" || failed.State.Error == nil || failed.State.Error.Error() != "exit status 2" {
+		t.Fatalf("unexpected state for cmd-restore-failed: %+v", failed.State)
+	}
+
+	if failed.State.ExitCode == nil || *failed.State.ExitCode != 2 || failed.State.ErrorMessage != "exit status 2" {
+		t.Fatalf("expected exit code and error message of cmd-restore-failed, got %+v", failed.State)
+	}
+
+	interrupted := commands.Get("cmd-restore-interrupted")
+	if interrupted == nil {
+		t.Fatalf("expected cmd-restore-interrupted to be restored")
+	}
+	if interrupted.IsRunning() {
+		t.Fatalf("expected interrupted command not to be running")
+	}
+	if interrupted.State.ExitCode != nil {
+		t.Fatalf("expected exit code of interrupted command to be unknown, got %d", *interrupted.State.ExitCode)
+	}
+
+	latest, _, err := commands.List(&dcommand.ListOption{Limit: 1})
+	if err != nil {
+		t.Fatalf("failed to list commands: %v", err)
+	}
+	if len(latest) != 1 || latest[0].ID != "cmd-restore-interrupted" {
+		t.Fatalf("expected latest command at head of list, got %v", latest)
+	}
+}
+
+func TestRestoreCommands_ReconcilesUnfinishedCommandsInStore(t *testing.T) {
+	tmpDir := t.TempDir()
+	cfg := &Config{MetadataDir: filepath.Join(tmpDir, "metadata")}
+
+	store, err := dcommand.NewBoltStore(filepath.Join(tmpDir, "commands.db"), func(sc *dcommand.StoreConfig) {
+		sc.MaxAge = time.Hour
+	})
+	if err != nil {
+		t.Fatalf("failed to create bolt store: %v", err)
+	}
+	defer store.Close()
+
+	original := commands
+	commands = store
+	t.Cleanup(func() {
+		commands = original
+	})
+
+	// saved before the agent stopped
+	running := &dcommand.State{Status: "running", StartedAt: datetime.FromTime(time.Now().Add(-2 * time.Hour))}
+	for _, dc := range []*dcommand.Command{
+		{ID: "cmd-crashed", Cmd: &entities.Command{ID: "cmd-crashed", Engine: "host"}, State: running},
+		{ID: "cmd-finished-unsaved", Cmd: &entities.Command{ID: "cmd-finished-unsaved"}, State: running},
+		{ID: "cmd-queued", Cmd: &entities.Command{ID: "cmd-queued"}},
+	} {
+		if err := store.Set(dc); err != nil {
+			t.Fatalf("failed to set command: %v", err)
+		}
+	}
+	writeMetadataFiles(t, filepath.Join(cfg.MetadataDir, "cmd-crashed"), map[string]string{
+		"start_at": "2024-01-01 12:00:00",
+	})
+	writeMetadataFiles(t, filepath.Join(cfg.MetadataDir, "cmd-finished-unsaved"), map[string]string{
+		"start_at":   "2024-01-01 12:00:00",
+		"succeed_at": "2024-01-01 12:00:01",
+		"status":     "success",
+		"exit_code":  "0",
+	})
+
+	if err := restoreCommands(cfg); err != nil {
+		t.Fatalf("restoreCommands returned error: %v", err)
+	}
+
+	crashed := commands.Get("cmd-crashed")
+	if crashed == nil || crashed.IsRunning() || crashed.State.ErrorMessage != errMessageInterrupted || crashed.Cmd.Engine != "host" {
+		t.Fatalf("expected crashed command to be interrupted with its record kept, got %+v", crashed)
+	}
+	if finished := commands.Get("cmd-finished-unsaved"); finished == nil || finished.Status() != "completed" {
+		t.Fatalf("expected command to be reconciled with metadata, got %+v", finished)
+	}
+	if queued := commands.Get("cmd-queued"); queued == nil || queued.Status() != "error" || queued.State.ErrorMessage != errMessageInterrupted {
+		t.Fatalf("expected queued command to be interrupted, got %+v", queued)
+	}
+
+	if running, total, _ := commands.List(&dcommand.ListOption{Status: "running"}); total != 0 {
+		t.Fatalf("expected no running commands after restore, got %v", running)
+	}
+
+	// the interrupted commands expire by retention
+	if err := commands.Prune(); err != nil {
+		t.Fatalf("failed to prune: %v", err)
+	}
+	if commands.Has("cmd-crashed") {
+		t.Fatalf("expected interrupted command to expire")
+	}
+}
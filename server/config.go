@@ -1,5 +1,7 @@
 package server
 
+import dcommand "github.com/go-idp/agent/server/data/command"
+
 // Config is the configuration of caas server
 type Config struct {
 	Port int64 `config:"port,default=8838"`
@@ -13,17 +15,78 @@ type Config struct {
 	ClientID     string `config:"client_id"`
 	ClientSecret string `config:"client_secret"`
 	AuthService  string `config:"auth_service"`
+	// AuthServiceTimeout is the timeout of auth service request, in seconds, default: 5
+	AuthServiceTimeout int64 `config:"auth_service_timeout"`
+	// AuthServiceCacheTTL is how long the credential accepted is cached, in seconds, default: 60
+	AuthServiceCacheTTL int64 `config:"auth_service_cache_ttl"`
+	// AuthServiceNegativeCacheTTL is how long the credential rejected is cached, in seconds, default: 10
+	AuthServiceNegativeCacheTTL int64 `config:"auth_service_negative_cache_ttl"`
+	// AuthServiceRetries is the retries when auth service fails, default: 2, -1 to disable
+	AuthServiceRetries int64 `config:"auth_service_retries"`
+	// AuthServiceBreakerThreshold is the failures in a row to open circuit breaker, default: 5
+	AuthServiceBreakerThreshold int64 `config:"auth_service_breaker_threshold"`
+	// AuthServiceBreakerCooldown is how long the circuit breaker keeps open, in seconds, default: 30
+	AuthServiceBreakerCooldown int64 `config:"auth_service_breaker_cooldown"`
+	// AuthServiceScopes are the scopes of identities accepted, unless scopes are in response, default: exec, read-logs, cancel
+	AuthServiceScopes []string `config:"auth_service_scopes"`
+	// Tokens are the api tokens with scopes
+	Tokens []Token `config:"tokens"`
+	// TokensFile is the JSON file of api tokens, which are appended to Tokens
+	TokensFile string `config:"tokens_file"`
+	// JWTSecret is the secret to verify JWT signed by HMAC (HS256, HS384, HS512)
+	JWTSecret string `config:"jwt_secret"`
+	// JWTPublicKeyFile is the PEM public key to verify JWT signed by RSA or ECDSA (RS*, ES*)
+	JWTPublicKeyFile string `config:"jwt_public_key_file"`
+	// JWTJWKSFile is the local JWKS file, whose keys are matched by kid
+	JWTJWKSFile string `config:"jwt_jwks_file"`
+	// JWTIssuer is the iss required, optional
+	JWTIssuer string `config:"jwt_issuer"`
+	// JWTAudience is the aud required, optional
+	JWTAudience string `config:"jwt_audience"`
+	// TLS
+	// TLSCertFile is the certificate of server, which serves https and wss with TLSKeyFile
+	TLSCertFile string `config:"tls_cert_file"`
+	TLSKeyFile  string `config:"tls_key_file"`
+	// TLSClientCAFile is the CA bundle to verify client certificates, whose CN is the identity
+	TLSClientCAFile string `config:"tls_client_ca_file"`
+	// IsTLSClientCertRequired rejects the connections without client certificate
+	IsTLSClientCertRequired bool `config:"is_tls_client_cert_required"`
+	// TLSClientScopes are the scopes of client certificate identities, default: exec, read-logs, cancel
+	TLSClientScopes []string `config:"tls_client_scopes"`
 	//
 	MetadataDir string `config:"metadatadir"`
+	// MetadataEncryptionKey encrypts script, env and log in metadata dir with AES-GCM, base64 encoded 32 bytes
+	MetadataEncryptionKey string `config:"metadata_encryption_key"`
 	//
 	WorkDir string `config:"workdir"`
 	//
 	IsCommandCancelOnCloseDisabled bool `config:"is_command_cancel_on_close_disabled"`
+	// CommandReattachTimeout is how long the command keeps running after all its connections are closed,
+	//	waiting for the client to reattach, in seconds, negative cancels immediately, default: 30
+	CommandReattachTimeout int64 `config:"command_reattach_timeout"`
 	//
 	IsCleanWorkDirEnabled bool `config:"is_clean_workdir_enabled"`
 	//
 	IsCleanMetadataDirEnabled bool `config:"is_clean_metadatadir_enabled"`
 
+	// CommandStore is the storage of command history, options: memory, bolt, default: memory
+	CommandStore string `config:"command_store"`
+	// CommandStorePath is the file path of bolt command store, default: /tmp/agent/commands.db
+	CommandStorePath string `config:"command_store_path"`
+	// CommandRetentionCount is the max number of commands to retain, default: 100 for memory store, unlimited for bolt store
+	CommandRetentionCount int `config:"command_retention_count"`
+	// CommandRetentionAge is the max age of commands to retain, in seconds, default: unlimited
+	CommandRetentionAge int64 `config:"command_retention_age"`
+
+	// AuditLog is the file path of audit log, empty disables audit log
+	AuditLog string `config:"audit_log"`
+	// AuditLogMaxSize is the max size of audit log before rotated, in MB, default: 10
+	AuditLogMaxSize int64 `config:"audit_log_max_size"`
+	// AuditLogMaxBackups is the max number of rotated audit logs to keep, default: 5
+	AuditLogMaxBackups int `config:"audit_log_max_backups"`
+	// TrustedProxies are the addresses or CIDRs of proxies, whose X-Forwarded-For is the address of client
+	TrustedProxies []string `config:"trusted_proxies"`
+
 	// Terminal
 	TerminalPath        string `config:"terminal_path,default=/terminal"`
 	TerminalShell       string `config:"terminal_shell"`
@@ -34,10 +97,24 @@ type Config struct {
 	//
 	TerminalRelay string `config:"terminal_relay"`
 
+	// MaxConcurrentCommands is the max number of commands running at once, the others wait in queue, default: 0 (unlimited)
+	MaxConcurrentCommands int `config:"max_concurrent_commands"`
+	// MaxQueuedCommands is the max number of commands waiting in queue, the others are rejected, default: 0 (unlimited)
+	MaxQueuedCommands int `config:"max_queued_commands"`
+
+	// PolicyFile is the JSON file of policy which commands are allowed by, see dcommand.Policy
+	PolicyFile string `config:"policy_file"`
+
 	//
 	IsAutoReport bool `config:"is_auto_report"`
 	//
 	allowReportFunc func(script string, environment map[string]string) bool
+	//
+	jwt *jwtVerifier
+	//
+	metadataCipher *metadataCipher
+	//
+	policy *dcommand.Policy
 }
 
 func (c *Config) SetAllowReportFunc(f func(script string, environment map[string]string) bool) {
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"sync"
 	"time"
 
 	"github.com/go-idp/agent/entities"
@@ -25,11 +26,18 @@ type Command struct {
 
 	Cmd *entities.Command `json:"command"`
 
+	// State is changed by the command while running, read it by Snapshot, Status or IsRunning
 	State *State `json:"state"`
+	// mu guards State, Log and cmd, which are changed while running
+	mu sync.RWMutex
+
+	// Caller is the identity who created the command
+	Caller *Caller `json:"caller,omitempty"`
 
 	Log *safe.List[Log] `json:"log"`
 
 	//
+	stdin  io.Reader
 	stdout io.Writer
 	stderr io.Writer
 
@@ -39,9 +47,13 @@ type Command struct {
 	IsAutoReport bool
 	//
 	allowReportFunc func(script string, environment map[string]string) bool
+	//
+	policy *Policy
 }
 
 type State struct {
+	// QueuedAt is when the command starts to wait in queue, nil if it runs immediately
+	QueuedAt    *datetime.DateTime `json:"queued_at,omitempty"`
 	StartedAt   *datetime.DateTime `json:"started_at"`
 	CompletedAt *datetime.DateTime `json:"completed_at"`
 	ErroredAt   *datetime.DateTime `json:"errored_at"`
@@ -56,8 +68,45 @@ type State struct {
 	IsTimeout bool `json:"is_timeout"`
 	//
 	Error error `json:"error"`
+	// ErrorMessage is the message of error, which is kept when the state is persisted
+	ErrorMessage string `json:"error_message,omitempty"`
+	// ExitCode is the exit code of command finished, nil if it is not finished
+	ExitCode *int `json:"exit_code,omitempty"`
+	//
+	Status string `json:"status"` // queued, running, cancelled, completed, error
+	//
+	Usage *Usage `json:"usage,omitempty"`
+}
+
+// Caller is the identity who created the command
+type Caller struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes,omitempty"`
+	// ExpiresAt is when the credential of caller expires, in unix seconds, 0 means never
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+	// RemoteAddr is the address of client who created the command
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	// Weight is the share of caller in scheduler, default: 1
+	Weight int `json:"weight,omitempty"`
+}
+
+func (c *Caller) String() string {
+	b, _ := json.Marshal(c)
+	return string(b)
+}
+
+// Summary is the lightweight projection of command, without script and environment
+type Summary struct {
+	ID     string `json:"id"`
+	Engine string `json:"engine"`
+	Image  string `json:"image,omitempty"`
+	User   string `json:"user,omitempty"`
 	//
-	Status string `json:"status"` // running, cancelled, completed, error
+	Status      string             `json:"status"`
+	ExitCode    *int               `json:"exit_code,omitempty"`
+	StartedAt   *datetime.DateTime `json:"started_at"`
+	CompletedAt *datetime.DateTime `json:"completed_at"`
+	ErroredAt   *datetime.DateTime `json:"errored_at"`
 }
 
 type Log struct {
@@ -81,9 +130,14 @@ type Config struct {
 
 	Command *entities.Command `json:"command"`
 
+	Caller *Caller `json:"caller"`
+
 	IsAutoReport bool
 	//
 	allowReportFunc func(script string, environment map[string]string) bool
+
+	// Policy is evaluated before command runs, optional
+	Policy *Policy
 }
 
 func (c *Config) SetAllowReportFunc(f func(script string, environment map[string]string) bool) {
@@ -105,30 +159,111 @@ func New(opts ...Option) (*Command, error) {
 	}
 
 	return &Command{
-		ID:  opt.ID,
-		Cmd: opt.Command,
+		ID:     opt.ID,
+		Cmd:    opt.Command,
+		Caller: opt.Caller,
+		// accepted, not queued or running yet
+		State: &State{},
 		//
 		event: eventemitter.New(),
 		//
 		IsAutoReport: opt.IsAutoReport,
 		//
 		allowReportFunc: opt.allowReportFunc,
+		//
+		policy: opt.Policy,
 	}, nil
 }
 
+// Enforce evaluates the policy of command, returns *PolicyError if it is denied
+func (c *Command) Enforce() error {
+	return c.policy.Enforce(c.Cmd)
+}
+
+// Queue marks the command waiting in queue before Run, returns false if it is cancelled already
+func (c *Command) Queue() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.State != nil && c.State.IsCancelled {
+		return false
+	}
+
+	c.State = &State{
+		QueuedAt: datetime.Now(),
+		Status:   "queued",
+	}
+	return true
+}
+
+// Snapshot returns the copy of state, nil if it is not set
+func (c *Command) Snapshot() *State {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.State == nil {
+		return nil
+	}
+
+	state := *c.State
+	return &state
+}
+
+// SetState replaces the state, e.g. the one restored
+func (c *Command) SetState(state *State) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.State = state
+}
+
+// updateState changes the state under lock, the state is created if it is not set
+func (c *Command) updateState(fn func(state *State)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.State == nil {
+		c.State = &State{}
+	}
+	fn(c.State)
+}
+
+// fail records the error of command run
+func (c *Command) fail(err error) {
+	c.updateState(func(state *State) {
+		state.IsError = true
+		state.Status = "error"
+		state.Error = err
+		state.ErroredAt = datetime.Now()
+	})
+}
+
 func (c *Command) Run() error {
+	c.mu.Lock()
+	var queuedAt *datetime.DateTime
+	if c.State != nil {
+		// cancelled while queued
+		if c.State.IsKilledByClose {
+			c.mu.Unlock()
+			return fmt.Errorf("command is cancelled (connection closed)")
+		}
+		if c.State.IsCancelled {
+			c.mu.Unlock()
+			return fmt.Errorf("command is cancelled")
+		}
+
+		queuedAt = c.State.QueuedAt
+	}
+
 	c.State = &State{
+		QueuedAt:  queuedAt,
 		StartedAt: datetime.Now(),
 		Status:    "running",
 	}
 	// Keep log file as the source of truth to avoid retaining large command output
 	// chunks in memory for long-lived command objects.
 	c.Log = nil
-
-	workdir := fmt.Sprintf("%s/%s", c.Cmd.WorkDirBase, c.ID)
-	if err := fs.Mkdirp(workdir); err != nil {
-		return fmt.Errorf("failed to create work dir: %s", err)
-	}
+	c.mu.Unlock()
 
 	script := c.Cmd.Script
 	environment := c.Cmd.Environment
@@ -174,7 +309,42 @@ func (c *Command) Run() error {
 		}
 	}
 
+	// secrets are not reported, only passed to the command
+	if len(c.Cmd.Secrets) != 0 {
+		merged := make(map[string]string, len(environment)+len(c.Cmd.Secrets))
+		for k, v := range environment {
+			merged[k] = v
+		}
+		for k, v := range c.Cmd.Secrets {
+			merged[k] = v
+		}
+		environment = merged
+	}
+
+	// the policy is enforced on the script and environment to run, which tidp and secrets may change,
+	//	the limits given by policy apply to the command.
+	final := *c.Cmd
+	final.Script = script
+	final.Environment = environment
+	if err := c.policy.Enforce(&final); err != nil {
+		c.event.Emit("error", err)
+		c.fail(err)
+
+		logger.Infof("[command][id: %s] %s", c.ID, err)
+		return err
+	}
+	c.Cmd.CPU, c.Cmd.Memory, c.Cmd.Timeout = final.CPU, final.Memory, final.Timeout
+
+	workdir := fmt.Sprintf("%s/%s", c.Cmd.WorkDirBase, c.ID)
+	if err := fs.Mkdirp(workdir); err != nil {
+		return fmt.Errorf("failed to create work dir: %s", err)
+	}
+
+	// runID is the id of underlying command, which is used to find its process or container
+	runID := fmt.Sprintf("go-idp_agent_%s", uuid.V4())
+
 	cmd, err := gzc.New(&gzc.Config{
+		ID:          runID,
 		Command:     script,
 		Shell:       c.Cmd.Shell,
 		WorkDir:     workdir,
@@ -192,17 +362,24 @@ func (c *Command) Run() error {
 	})
 	if err != nil {
 		c.event.Emit("error", fmt.Errorf("failed to run command: %s", err))
-
-		c.State.IsError = true
-		c.State.Status = "error"
-		c.State.Error = err
-		c.State.ErroredAt = datetime.Now()
+		c.fail(err)
 
 		return fmt.Errorf("failed to run command: %s", err)
 	}
 
-	// set cmd to context
+	// set cmd to context, the command cancelled while preparing does not run
+	c.mu.Lock()
+	if c.State.IsCancelled {
+		isKilledByClose := c.State.IsKilledByClose
+		c.mu.Unlock()
+
+		if isKilledByClose {
+			return fmt.Errorf("command is cancelled (connection closed)")
+		}
+		return fmt.Errorf("command is cancelled")
+	}
 	c.cmd = cmd
+	c.mu.Unlock()
 
 	if c.stdout == nil {
 		return fmt.Errorf("you should call SetStdout(stdout) first")
@@ -211,43 +388,117 @@ func (c *Command) Run() error {
 		return fmt.Errorf("you should call SetStderr(stderr) first")
 	}
 
-	cmd.SetStdout(c.stdout)
-	cmd.SetStderr(c.stderr)
+	usage := newUsageCollector(c.Cmd.Engine, runID)
+
+	if c.stdin != nil {
+		cmd.SetStdin(c.stdin)
+	}
+	cmd.SetStdout(usage.Stdout(c.stdout))
+	cmd.SetStderr(usage.Stderr(c.stderr))
 
 	c.event.Emit("run", c.ID)
 
-	if err := c.cmd.Run(); err != nil {
-		if c.State.IsKilledByClose {
+	usage.Start()
+	defer func() {
+		u := usage.Stop()
+		c.updateState(func(state *State) {
+			state.Usage = u
+		})
+	}()
+
+	if err := cmd.Run(); err != nil {
+		state := c.Snapshot()
+		if state.IsKilledByClose {
 			logger.Infof("[command][id: %s] cancelled (connection closed)", c.ID)
 			return fmt.Errorf("command is cancelled (connection closed)")
 		}
 
-		if c.State.IsCancelled {
+		if state.IsCancelled {
 			logger.Infof("[command][id: %s] cancelled", c.ID)
 			return fmt.Errorf("command is cancelled")
 		}
 
 		c.event.Emit("error", fmt.Errorf("failed to run command: %s", err))
-		c.State.IsError = true
-		c.State.Status = "error"
-		c.State.Error = err
-		c.State.ErroredAt = datetime.Now()
+		c.fail(err)
 
 		logger.Infof("[command][id: %s] failed to run: %s \n\n##### SCRIPT START #####\n%s\n##### SCRIPT START #####\n", c.ID, err.Error(), c.Cmd.Script)
 
-		return fmt.Errorf("failed to run command: %s", err)
+		return fmt.Errorf("failed to run command: %w", err)
 	}
 
 	c.event.Emit("complete", c.ID)
 
-	c.State.IsCompleted = true
-	c.State.Status = "completed"
-	c.State.CompletedAt = datetime.Now()
+	c.updateState(func(state *State) {
+		state.IsCompleted = true
+		state.Status = "completed"
+		state.CompletedAt = datetime.Now()
+	})
 
 	logger.Infof("[command][id: %s] succeed to run", c.ID)
 	return nil
 }
 
+// SetExit records the exit code and error of command finished
+func (c *Command) SetExit(exitCode int, err error) {
+	c.updateState(func(state *State) {
+		state.ExitCode = &exitCode
+		if err != nil {
+			state.ErrorMessage = err.Error()
+		}
+	})
+}
+
+// MarshalJSON encodes the command with secret values masked
+func (c *Command) MarshalJSON() ([]byte, error) {
+	c.mu.RLock()
+	log := c.Log
+	c.mu.RUnlock()
+
+	return json.Marshal(&struct {
+		ID     string            `json:"id"`
+		Cmd    *entities.Command `json:"command"`
+		State  *State            `json:"state"`
+		Caller *Caller           `json:"caller,omitempty"`
+		Log    *safe.List[Log]   `json:"log"`
+	}{
+		ID:     c.ID,
+		Cmd:    c.Cmd.Redacted(),
+		State:  c.Snapshot(),
+		Caller: c.Caller,
+		Log:    log,
+	})
+}
+
+// Summary returns the lightweight projection of command
+func (c *Command) Summary() *Summary {
+	summary := &Summary{
+		ID:     c.ID,
+		Status: c.Status(),
+	}
+
+	if c.Cmd != nil {
+		summary.Engine = c.Cmd.Engine
+		summary.Image = c.Cmd.Image
+		summary.User = c.Cmd.User
+	}
+	if summary.Engine == "" {
+		summary.Engine = "host"
+	}
+
+	if state := c.Snapshot(); state != nil {
+		summary.ExitCode = state.ExitCode
+		summary.StartedAt = state.StartedAt
+		summary.CompletedAt = state.CompletedAt
+		summary.ErroredAt = state.ErroredAt
+	}
+
+	return summary
+}
+
+func (c *Command) SetStdin(r io.Reader) {
+	c.stdin = r
+}
+
 func (c *Command) SetStdout(w io.Writer) {
 	c.stdout = w
 }
@@ -256,24 +507,54 @@ func (c *Command) SetStderr(w io.Writer) {
 	c.stderr = w
 }
 
+// Cancel cancels the command accepted, queued or running, the one not started yet refuses to run
 func (c *Command) Cancel() error {
-	if c.cmd == nil {
-		return fmt.Errorf("command is not running, please do Run() first")
+	return c.cancel(false)
+}
+
+// CancelByClose cancels the command as Cancel, because the connection attached is closed
+func (c *Command) CancelByClose() error {
+	return c.cancel(true)
+}
+
+func (c *Command) cancel(isKilledByClose bool) error {
+	c.mu.Lock()
+	if c.State == nil {
+		c.State = &State{}
+	}
+	if !c.State.isRunning() {
+		c.mu.Unlock()
+		return fmt.Errorf("command is not running")
 	}
 
+	cmd := c.cmd
+	c.State.IsKilledByClose = isKilledByClose
 	c.State.IsCancelled = true
 	c.State.Status = "cancelled"
+	c.mu.Unlock()
 
 	c.event.Emit("cancel", c.ID)
 
-	return c.cmd.Cancel()
+	if cmd == nil {
+		return nil
+	}
+
+	return cmd.Cancel()
 }
 
 func (c *Command) On(event string, fn func(payload any)) {
 	c.event.On(event, eventemitter.HandleFunc(fn))
 }
 
-// IsRunning returns true if the command is running
+// IsRunning returns true if the command is running, or accepted without state
 func (c *Command) IsRunning() bool {
-	return !c.State.IsCancelled && !c.State.IsCompleted && !c.State.IsError
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.State == nil || c.State.isRunning()
+}
+
+// isRunning returns true if the command of state is not finished
+func (s *State) isRunning() bool {
+	return !s.IsCancelled && !s.IsCompleted && !s.IsError
 }
@@ -0,0 +1,163 @@
+package command
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	gzcconfig "github.com/go-zoox/command/config"
+	gzcengine "github.com/go-zoox/command/engine"
+	"github.com/go-zoox/command/engine/host"
+	gzcerrors "github.com/go-zoox/command/errors"
+	"github.com/go-zoox/command/terminal"
+)
+
+// the host engine of go-zoox/command is replaced by one which runs the same,
+//
+//	but gives the process state after exit to the usage collector, which takes the usage from rusage,
+//	the process of host engine is not exposed by go-zoox/command.
+func init() {
+	gzcengine.Register(host.Name, newHostEngine)
+}
+
+type hostProcess struct {
+	cfg *host.Config
+	cmd *exec.Cmd
+}
+
+func newHostEngine(cfg *gzcconfig.Config) (gzcengine.Engine, error) {
+	hc := &host.Config{
+		ID: cfg.ID,
+		//
+		Command:     cfg.Command,
+		WorkDir:     cfg.WorkDir,
+		Environment: cfg.Environment,
+		User:        cfg.User,
+		Shell:       cfg.Shell,
+		//
+		ReadOnly: cfg.ReadOnly,
+		//
+		IsHistoryDisabled: cfg.IsHistoryDisabled,
+		//
+		IsInheritEnvironmentEnabled: cfg.IsInheritEnvironmentEnabled,
+		//
+		AllowedSystemEnvKeys: cfg.AllowedSystemEnvKeys,
+	}
+	if hc.Shell == "" {
+		hc.Shell = "/bin/sh"
+	}
+
+	args := []string{}
+	if hc.Command != "" {
+		args = append(args, "-c", hc.Command)
+	}
+
+	cmd := exec.Command(hc.Shell, args...)
+	cmd.Dir = hc.WorkDir
+	cmd.Env = []string{"TERM=xterm"}
+	if hc.IsInheritEnvironmentEnabled {
+		cmd.Env = append(cmd.Env, os.Environ()...)
+	} else {
+		for _, key := range hc.AllowedSystemEnvKeys {
+			if value, ok := os.LookupEnv(key); ok {
+				cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", key, value))
+			}
+		}
+	}
+	for k, v := range hc.Environment {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
+	}
+
+	if hc.User != "" {
+		u, err := user.Lookup(hc.User)
+		if err != nil {
+			return nil, err
+		}
+
+		uid, _ := strconv.Atoi(u.Uid)
+		gid, _ := strconv.Atoi(u.Gid)
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)},
+		}
+		cmd.Env = append(
+			cmd.Env,
+			"USER="+hc.User,
+			"HOME="+u.HomeDir,
+			"LOGNAME="+hc.User,
+			"UID="+u.Uid,
+			"GID="+u.Gid,
+		)
+	}
+
+	if hc.IsHistoryDisabled {
+		cmd.Env = append(cmd.Env, "HISTFILE=/dev/null")
+	}
+
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return &hostProcess{
+		cfg: hc,
+		cmd: cmd,
+	}, nil
+}
+
+func (h *hostProcess) Start() error {
+	return h.cmd.Start()
+}
+
+// Wait waits for the process to exit, and gives its state to the usage collector
+func (h *hostProcess) Wait() error {
+	err := h.cmd.Wait()
+	if u := usageCollectors.Get(h.cfg.ID); u != nil && h.cmd.ProcessState != nil {
+		u.exited(h.cmd.ProcessState)
+	}
+
+	if err != nil {
+		if v, ok := err.(*exec.ExitError); ok {
+			return &gzcerrors.ExitError{Code: v.ExitCode(), Message: v.Error()}
+		}
+
+		return &gzcerrors.ExitError{Code: 1, Message: err.Error()}
+	}
+
+	return nil
+}
+
+func (h *hostProcess) Cancel() error {
+	if h.cmd.Process == nil {
+		return nil
+	}
+
+	return h.cmd.Process.Kill()
+}
+
+func (h *hostProcess) SetStdin(stdin io.Reader) error {
+	h.cmd.Stdin = stdin
+	return nil
+}
+
+func (h *hostProcess) SetStdout(stdout io.Writer) error {
+	h.cmd.Stdout = stdout
+	return nil
+}
+
+func (h *hostProcess) SetStderr(stderr io.Writer) error {
+	h.cmd.Stderr = stderr
+	return nil
+}
+
+// Terminal runs the command in terminal by the host engine of go-zoox/command, the usage is not collected
+func (h *hostProcess) Terminal() (terminal.Terminal, error) {
+	e, err := host.New(h.cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.Terminal()
+}
@@ -0,0 +1,70 @@
+package command
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	gzc "github.com/go-zoox/command"
+)
+
+func TestHostEngine_Options(t *testing.T) {
+	t.Setenv("GO_IDP_AGENT_TEST_ALLOWED", "allowed")
+	t.Setenv("GO_IDP_AGENT_TEST_DENIED", "denied")
+
+	for _, c := range []struct {
+		Name     string
+		Config   *gzc.Config
+		Expected string
+	}{
+		{
+			Name:     "default",
+			Config:   &gzc.Config{},
+			Expected: "host,/bin/sh,,,",
+		},
+		{
+			Name:     "allowed system env",
+			Config:   &gzc.Config{AllowedSystemEnvKeys: []string{"GO_IDP_AGENT_TEST_ALLOWED"}},
+			Expected: "host,/bin/sh,allowed,,",
+		},
+		{
+			Name:     "inherit env",
+			Config:   &gzc.Config{IsInheritEnvironmentEnabled: true},
+			Expected: "host,/bin/sh,allowed,denied,",
+		},
+		{
+			Name:     "history disabled",
+			Config:   &gzc.Config{IsHistoryDisabled: true},
+			Expected: "host,/bin/sh,,,/dev/null",
+		},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			c.Config.Command = `echo "$GO_ZOOX_COMMAND_ENGINE,$GO_ZOOX_COMMAND_SHELL,$GO_IDP_AGENT_TEST_ALLOWED,$GO_IDP_AGENT_TEST_DENIED,$HISTFILE"`
+			cmd, err := gzc.New(c.Config)
+			if err != nil {
+				t.Fatalf("failed to create command: %v", err)
+			}
+			stdout := &strings.Builder{}
+			cmd.SetStdout(stdout)
+
+			if err := cmd.Run(); err != nil {
+				t.Fatalf("failed to run command: %v", err)
+			}
+			if got := strings.TrimSpace(stdout.String()); got != c.Expected {
+				t.Fatalf("expected %q, got %q", c.Expected, got)
+			}
+		})
+	}
+}
+
+func TestHostEngine_DefaultStdio(t *testing.T) {
+	e, err := newHostEngine(&gzc.Config{Command: "true"})
+	if err != nil {
+		t.Fatalf("failed to create engine: %v", err)
+	}
+
+	h := e.(*hostProcess)
+	if h.cmd.Path != "/bin/sh" || h.cmd.Stdin != os.Stdin || h.cmd.Stdout != os.Stdout || h.cmd.Stderr != os.Stderr {
+		t.Fatalf("expected /bin/sh with stdio of process, got %s, %v, %v, %v", h.cmd.Path, h.cmd.Stdin, h.cmd.Stdout, h.cmd.Stderr)
+	}
+}
@@ -0,0 +1,169 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/go-idp/agent/entities"
+)
+
+// Policy is the rules which commands are allowed by, evaluated before running,
+//
+//	an empty rule means no restriction.
+type Policy struct {
+	// Engines are the engines allowed, the empty engine of command is host
+	Engines []string `json:"engines"`
+	// Images are the image patterns allowed, e.g. alpine:*, docker.io/library/*
+	Images []string `json:"images"`
+	// Users are the users allowed to run as
+	Users []string `json:"users"`
+	// MaxCPU, MaxMemory (MB) and MaxTimeout (milliseconds) are the max limits,
+	//	the command without the limit is given the max.
+	MaxCPU     float64 `json:"max_cpu"`
+	MaxMemory  int64   `json:"max_memory"`
+	MaxTimeout int64   `json:"max_timeout"`
+	// ForbiddenScripts are the regular expressions which the script should not match
+	ForbiddenScripts []string `json:"forbidden_scripts"`
+	// IsPrivilegedDisallowed denies the privileged commands
+	IsPrivilegedDisallowed bool `json:"is_privileged_disallowed"`
+	// WorkDirBases are the work dir bases allowed, including their sub directories
+	WorkDirBases []string `json:"workdir_bases"`
+	//
+	forbiddenScripts []*regexp.Regexp
+}
+
+// PolicyError is the error of command denied by policy
+type PolicyError struct {
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("command is denied by policy: %s", e.Reason)
+}
+
+// ParsePolicy parses the policy in JSON
+func ParsePolicy(raw []byte) (*Policy, error) {
+	p := &Policy{}
+	if err := json.Unmarshal(raw, p); err != nil {
+		return nil, err
+	}
+
+	for _, pattern := range p.ForbiddenScripts {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid forbidden script pattern(%s): %s", pattern, err)
+		}
+
+		p.forbiddenScripts = append(p.forbiddenScripts, re)
+	}
+
+	for _, pattern := range p.Images {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid image pattern(%s): %s", pattern, err)
+		}
+	}
+
+	return p, nil
+}
+
+// Enforce gives the command without limits the max limits, and returns *PolicyError if it is denied
+func (p *Policy) Enforce(cmd *entities.Command) error {
+	if p == nil {
+		return nil
+	}
+
+	engine := cmd.Engine
+	if engine == "" {
+		engine = "host"
+	}
+	if len(p.Engines) != 0 && !contains(p.Engines, engine) {
+		return &PolicyError{Reason: fmt.Sprintf("engine %s is not allowed", engine)}
+	}
+
+	if len(p.Images) != 0 && cmd.Image != "" && !matchAny(p.Images, cmd.Image) {
+		return &PolicyError{Reason: fmt.Sprintf("image %s is not allowed", cmd.Image)}
+	}
+
+	if len(p.Users) != 0 && cmd.User != "" && !contains(p.Users, cmd.User) {
+		return &PolicyError{Reason: fmt.Sprintf("user %s is not allowed", cmd.User)}
+	}
+
+	if p.IsPrivilegedDisallowed && cmd.Privileged {
+		return &PolicyError{Reason: "privileged is not allowed"}
+	}
+
+	if p.MaxCPU != 0 {
+		if cmd.CPU > p.MaxCPU {
+			return &PolicyError{Reason: fmt.Sprintf("cpu %g exceeds max %g", cmd.CPU, p.MaxCPU)}
+		}
+		if cmd.CPU == 0 {
+			cmd.CPU = p.MaxCPU
+		}
+	}
+
+	if p.MaxMemory != 0 {
+		if cmd.Memory > p.MaxMemory {
+			return &PolicyError{Reason: fmt.Sprintf("memory %dMB exceeds max %dMB", cmd.Memory, p.MaxMemory)}
+		}
+		if cmd.Memory == 0 {
+			cmd.Memory = p.MaxMemory
+		}
+	}
+
+	if p.MaxTimeout != 0 {
+		if cmd.Timeout > p.MaxTimeout {
+			return &PolicyError{Reason: fmt.Sprintf("timeout %dms exceeds max %dms", cmd.Timeout, p.MaxTimeout)}
+		}
+		if cmd.Timeout == 0 {
+			cmd.Timeout = p.MaxTimeout
+		}
+	}
+
+	for _, re := range p.forbiddenScripts {
+		if re.MatchString(cmd.Script) {
+			return &PolicyError{Reason: fmt.Sprintf("script matches forbidden pattern %s", re.String())}
+		}
+	}
+
+	if len(p.WorkDirBases) != 0 && !isUnderAny(p.WorkDirBases, cmd.WorkDirBase) {
+		return &PolicyError{Reason: fmt.Sprintf("workdir base %s is not allowed", cmd.WorkDirBase)}
+	}
+
+	return nil
+}
+
+func contains(list []string, v string) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchAny(patterns []string, v string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, v); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isUnderAny(bases []string, dir string) bool {
+	dir = filepath.Clean(dir)
+	for _, base := range bases {
+		base = filepath.Clean(base)
+		if dir == base || strings.HasPrefix(dir, base+string(filepath.Separator)) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,116 @@
+package command
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-idp/agent/entities"
+	"github.com/go-zoox/fs"
+)
+
+func TestPolicy_Enforce(t *testing.T) {
+	policy, err := ParsePolicy([]byte(`{
+		"engines": ["host", "docker"],
+		"images": ["alpine:*", "docker.io/library/*"],
+		"users": ["runner"],
+		"max_cpu": 2,
+		"max_memory": 1024,
+		"max_timeout": 60000,
+		"forbidden_scripts": ["rm\\s+-rf\\s+/(\\s|$)"],
+		"is_privileged_disallowed": true,
+		"workdir_bases": ["/tmp/agent/workdir"]
+	}`))
+	if err != nil {
+		t.Fatalf("failed to parse policy: %v", err)
+	}
+
+	cases := []struct {
+		name   string
+		cmd    entities.Command
+		reason string
+	}{
+		{"allowed", entities.Command{Script: "echo hi", WorkDirBase: "/tmp/agent/workdir"}, ""},
+		{"allowed image", entities.Command{Engine: "docker", Image: "docker.io/library/node:20", WorkDirBase: "/tmp/agent/workdir/ci"}, ""},
+		{"engine", entities.Command{Engine: "ssh", WorkDirBase: "/tmp/agent/workdir"}, "engine ssh is not allowed"},
+		{"image", entities.Command{Engine: "docker", Image: "ubuntu:22.04", WorkDirBase: "/tmp/agent/workdir"}, "image ubuntu:22.04 is not allowed"},
+		{"user", entities.Command{User: "root", WorkDirBase: "/tmp/agent/workdir"}, "user root is not allowed"},
+		{"cpu", entities.Command{CPU: 4, WorkDirBase: "/tmp/agent/workdir"}, "cpu 4 exceeds max 2"},
+		{"memory", entities.Command{Memory: 2048, WorkDirBase: "/tmp/agent/workdir"}, "memory 2048MB exceeds max 1024MB"},
+		{"timeout", entities.Command{Timeout: 120000, WorkDirBase: "/tmp/agent/workdir"}, "timeout 120000ms exceeds max 60000ms"},
+		{"script", entities.Command{Script: "echo bye && rm -rf /", WorkDirBase: "/tmp/agent/workdir"}, "script matches forbidden pattern"},
+		{"privileged", entities.Command{Privileged: true, WorkDirBase: "/tmp/agent/workdir"}, "privileged is not allowed"},
+		{"workdir", entities.Command{WorkDirBase: "/tmp/agent/workdir-other"}, "workdir base /tmp/agent/workdir-other is not allowed"},
+		{"workdir traversal", entities.Command{WorkDirBase: "/tmp/agent/workdir/../other"}, "is not allowed"},
+	}
+	for _, c := range cases {
+		err := policy.Enforce(&c.cmd)
+		if c.reason == "" {
+			if err != nil {
+				t.Fatalf("%s: expected to be allowed, got %v", c.name, err)
+			}
+			continue
+		}
+
+		var errx *PolicyError
+		if !errors.As(err, &errx) || !strings.Contains(errx.Reason, c.reason) {
+			t.Fatalf("%s: expected to be denied with %q, got %v", c.name, c.reason, err)
+		}
+	}
+
+	// the command without limits is given the max
+	cmd := &entities.Command{WorkDirBase: "/tmp/agent/workdir"}
+	if err := policy.Enforce(cmd); err != nil {
+		t.Fatalf("expected to be allowed, got %v", err)
+	}
+	if cmd.CPU != 2 || cmd.Memory != 1024 || cmd.Timeout != 60000 {
+		t.Fatalf("expected max limits to be given, got cpu=%g memory=%d timeout=%d", cmd.CPU, cmd.Memory, cmd.Timeout)
+	}
+}
+
+func TestParsePolicy_Invalid(t *testing.T) {
+	for _, raw := range []string{`{`, `{"forbidden_scripts": ["("]}`, `{"images": ["["]}`} {
+		if _, err := ParsePolicy([]byte(raw)); err == nil {
+			t.Fatalf("expected policy %s to be invalid", raw)
+		}
+	}
+}
+
+func TestCommand_RunDeniedByPolicy(t *testing.T) {
+	policy, _ := ParsePolicy([]byte(`{"engines": ["docker"]}`))
+	dc, _ := New(func(c *Config) {
+		c.Command = &entities.Command{ID: "cmd-denied", Script: "echo hi", WorkDirBase: t.TempDir()}
+		c.Policy = policy
+	})
+
+	err := dc.Run()
+	var errx *PolicyError
+	if !errors.As(err, &errx) {
+		t.Fatalf("expected policy error, got %v", err)
+	}
+	if dc.Status() != "error" || dc.State.Error == nil {
+		t.Fatalf("expected denied command to be error, got %+v", dc.State)
+	}
+	if fs.IsExist(filepath.Join(dc.Cmd.WorkDirBase, "cmd-denied")) {
+		t.Fatalf("expected work dir not to be created for denied command")
+	}
+}
+
+func TestCommand_RunGivenLimitsByPolicy(t *testing.T) {
+	policy, _ := ParsePolicy([]byte(`{"max_timeout": 60000}`))
+	dc, _ := New(func(c *Config) {
+		c.Command = &entities.Command{ID: "cmd-limited", Script: "true", WorkDirBase: t.TempDir()}
+		c.Policy = policy
+	})
+	dc.SetStdout(io.Discard)
+	dc.SetStderr(io.Discard)
+
+	if err := dc.Run(); err != nil {
+		t.Fatalf("failed to run command: %v", err)
+	}
+	if dc.Cmd.Timeout != 60000 {
+		t.Fatalf("expected timeout of policy, got %d", dc.Cmd.Timeout)
+	}
+}
@@ -0,0 +1,184 @@
+package command
+
+import (
+	"time"
+)
+
+// Store is the storage of commands
+type Store interface {
+	// Get returns the command by id, nil if not found
+	Get(id string) *Command
+	// Has returns true if the command exists
+	Has(id string) bool
+	// Set creates or updates the command
+	Set(cmd *Command) error
+	// Del deletes the command by id
+	Del(id string) error
+	// List returns the commands, latest first
+	List(opt *ListOption) (commands []*Command, total int, err error)
+	// Prune removes the commands out of retention
+	Prune() error
+	// Close closes the store
+	Close() error
+}
+
+// ListOption is the option of listing commands
+type ListOption struct {
+	// Status filters by command status, such as running, completed, error, cancelled
+	Status string
+	// Engine filters by command engine, empty engine is treated as host
+	Engine string
+	// User filters by command user
+	User string
+	// Owner filters by the name of caller who created the command
+	Owner string
+	// Since filters by State.StartedAt >= Since
+	Since time.Time
+	// Until filters by State.StartedAt <= Until
+	Until time.Time
+	// Order is the order by creation, options: desc (latest first), asc, default: desc
+	Order string
+	// Cursor is the id of the last command in the previous page
+	Cursor string
+	// Offset is the number of commands to skip
+	Offset int
+	// Limit is the max number of commands to return, 0 means no limit
+	Limit int
+}
+
+// StoreConfig is the configuration of store
+type StoreConfig struct {
+	// MaxCount is the max number of commands to retain, 0 means no limit
+	MaxCount int
+	// MaxAge is the max age of commands to retain, 0 means no limit
+	MaxAge time.Duration
+}
+
+// StoreOption is the option of store
+type StoreOption func(cfg *StoreConfig)
+
+// Status returns the status of command, empty if it has not run yet
+func (c *Command) Status() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.State == nil {
+		return ""
+	}
+
+	return c.State.Status
+}
+
+func (l *ListOption) match(c *Command) bool {
+	if l == nil {
+		return true
+	}
+
+	if l.Status != "" && c.Status() != l.Status {
+		return false
+	}
+
+	if l.Engine != "" || l.User != "" {
+		if c.Cmd == nil {
+			return false
+		}
+
+		engine := c.Cmd.Engine
+		if engine == "" {
+			engine = "host"
+		}
+		if l.Engine != "" && engine != l.Engine {
+			return false
+		}
+
+		if l.User != "" && c.Cmd.User != l.User {
+			return false
+		}
+	}
+
+	if l.Owner != "" && (c.Caller == nil || c.Caller.Name != l.Owner) {
+		return false
+	}
+
+	if !l.Since.IsZero() || !l.Until.IsZero() {
+		state := c.Snapshot()
+		if state == nil || state.StartedAt == nil {
+			return false
+		}
+
+		startedAt := state.StartedAt.Time()
+		if !l.Since.IsZero() && startedAt.Before(l.Since) {
+			return false
+		}
+
+		if !l.Until.IsZero() && startedAt.After(l.Until) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (l *ListOption) paginate(commands []*Command) []*Command {
+	if l == nil {
+		return commands
+	}
+
+	if l.Order == "asc" {
+		for i, j := 0, len(commands)-1; i < j; i, j = i+1, j-1 {
+			commands[i], commands[j] = commands[j], commands[i]
+		}
+	}
+
+	if l.Cursor != "" {
+		index := -1
+		for i, c := range commands {
+			if c.ID == l.Cursor {
+				index = i
+				break
+			}
+		}
+
+		// cursor not found, it may be pruned
+		if index == -1 {
+			return []*Command{}
+		}
+
+		commands = commands[index+1:]
+	}
+
+	if l.Offset > 0 {
+		if l.Offset >= len(commands) {
+			return []*Command{}
+		}
+
+		commands = commands[l.Offset:]
+	}
+
+	if l.Limit > 0 && l.Limit < len(commands) {
+		commands = commands[:l.Limit]
+	}
+
+	return commands
+}
+
+// isExpired returns true if the command is finished and older than maxAge,
+//
+//	running commands are never expired.
+func isExpired(c *Command, createdAt time.Time, maxAge time.Duration) bool {
+	if maxAge <= 0 {
+		return false
+	}
+
+	state := c.Snapshot()
+	if state != nil && state.isRunning() {
+		return false
+	}
+
+	startedAt := createdAt
+	if state != nil && state.StartedAt != nil {
+		startedAt = state.StartedAt.Time()
+	}
+
+	return time.Since(startedAt) > maxAge
+}
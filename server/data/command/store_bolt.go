@@ -0,0 +1,370 @@
+package command
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-idp/agent/entities"
+	"github.com/go-zoox/datetime"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	bucketCommands = []byte("commands")
+	bucketIndex    = []byte("index")
+)
+
+type boltStore struct {
+	sync.RWMutex
+	cfg *StoreConfig
+	//
+	db *bolt.DB
+	// live keeps the commands running in this process,
+	//	which cannot be restored from disk (cancel, events, etc.)
+	live map[string]*Command
+}
+
+// record is the on-disk representation of a command
+type record struct {
+	Seq     uint64            `json:"seq"`
+	ID      string            `json:"id"`
+	Command *entities.Command `json:"command"`
+	State   *State            `json:"state"`
+	Caller  *Caller           `json:"caller,omitempty"`
+	// timestamps and error cannot be decoded from State, keep them separately
+	StartedAt   int64  `json:"started_at,omitempty"`
+	CompletedAt int64  `json:"completed_at,omitempty"`
+	ErroredAt   int64  `json:"errored_at,omitempty"`
+	Error       string `json:"error,omitempty"`
+	//
+	CreatedAt int64 `json:"created_at"`
+}
+
+// NewBoltStore creates a store which persists commands in a single bolt file
+func NewBoltStore(path string, opts ...StoreOption) (Store, error) {
+	cfg := &StoreConfig{}
+	for _, o := range opts {
+		o(cfg)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create command store dir: %s", err)
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 3 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open command store(%s): %s", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(bucketCommands); err != nil {
+			return err
+		}
+
+		_, err := tx.CreateBucketIfNotExists(bucketIndex)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize command store: %s", err)
+	}
+
+	return &boltStore{
+		cfg:  cfg,
+		db:   db,
+		live: map[string]*Command{},
+	}, nil
+}
+
+func (s *boltStore) Get(id string) *Command {
+	var cmd *Command
+	s.db.View(func(tx *bolt.Tx) error {
+		cmd = s.get(tx, id)
+		return nil
+	})
+
+	return cmd
+}
+
+func (s *boltStore) Has(id string) bool {
+	return s.Get(id) != nil
+}
+
+func (s *boltStore) Set(cmd *Command) error {
+	s.Lock()
+	if cmd.IsRunning() {
+		s.live[cmd.ID] = cmd
+	} else {
+		delete(s.live, cmd.ID)
+	}
+	s.Unlock()
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		commands := tx.Bucket(bucketCommands)
+		index := tx.Bucket(bucketIndex)
+
+		r := newRecord(cmd)
+		if old, err := getRecord(tx, cmd.ID); err != nil {
+			return err
+		} else if old != nil {
+			r.Seq = old.Seq
+			r.CreatedAt = old.CreatedAt
+		} else {
+			seq, err := index.NextSequence()
+			if err != nil {
+				return err
+			}
+
+			r.Seq = seq
+			if err := index.Put(seqKey(seq), []byte(cmd.ID)); err != nil {
+				return err
+			}
+		}
+
+		value, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+
+		if err := commands.Put([]byte(cmd.ID), value); err != nil {
+			return err
+		}
+
+		return s.pruneByCount(tx)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save command(%s): %s", cmd.ID, err)
+	}
+
+	return nil
+}
+
+func (s *boltStore) Del(id string) error {
+	s.Lock()
+	delete(s.live, id)
+	s.Unlock()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return delRecord(tx, id)
+	})
+}
+
+func (s *boltStore) List(opt *ListOption) (commands []*Command, total int, err error) {
+	commands = []*Command{}
+
+	err = s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketIndex).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			cmd := s.get(tx, string(v))
+			if cmd == nil {
+				continue
+			}
+
+			if opt.match(cmd) {
+				commands = append(commands, cmd)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return opt.paginate(commands), len(commands), nil
+}
+
+func (s *boltStore) Prune() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if s.cfg.MaxAge > 0 {
+			expired := []string{}
+			err := tx.Bucket(bucketCommands).ForEach(func(k, v []byte) error {
+				r := &record{}
+				if err := json.Unmarshal(v, r); err != nil {
+					return err
+				}
+
+				cmd := r.toCommand()
+				if live := s.getLive(r.ID); live != nil {
+					cmd = live
+				}
+
+				if isExpired(cmd, time.UnixMilli(r.CreatedAt), s.cfg.MaxAge) {
+					expired = append(expired, r.ID)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			for _, id := range expired {
+				if err := delRecord(tx, id); err != nil {
+					return err
+				}
+			}
+		}
+
+		return s.pruneByCount(tx)
+	})
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *boltStore) getLive(id string) *Command {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.live[id]
+}
+
+func (s *boltStore) get(tx *bolt.Tx, id string) *Command {
+	if cmd := s.getLive(id); cmd != nil {
+		return cmd
+	}
+
+	r, err := getRecord(tx, id)
+	if err != nil || r == nil {
+		return nil
+	}
+
+	return r.toCommand()
+}
+
+func (s *boltStore) pruneByCount(tx *bolt.Tx) error {
+	if s.cfg.MaxCount <= 0 {
+		return nil
+	}
+
+	c := tx.Bucket(bucketIndex).Cursor()
+	count := 0
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		count++
+	}
+
+	overflow := count - s.cfg.MaxCount
+	if overflow <= 0 {
+		return nil
+	}
+
+	// running commands are never pruned
+	ids := []string{}
+	for k, v := c.First(); k != nil && len(ids) < overflow; k, v = c.Next() {
+		if s.getLive(string(v)) == nil {
+			ids = append(ids, string(v))
+		}
+	}
+
+	for _, id := range ids {
+		if err := delRecord(tx, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func getRecord(tx *bolt.Tx, id string) (*record, error) {
+	value := tx.Bucket(bucketCommands).Get([]byte(id))
+	if value == nil {
+		return nil, nil
+	}
+
+	r := &record{}
+	if err := json.Unmarshal(value, r); err != nil {
+		return nil, fmt.Errorf("failed to decode command(%s): %s", id, err)
+	}
+
+	return r, nil
+}
+
+func delRecord(tx *bolt.Tx, id string) error {
+	r, err := getRecord(tx, id)
+	if err != nil || r == nil {
+		return err
+	}
+
+	if err := tx.Bucket(bucketIndex).Delete(seqKey(r.Seq)); err != nil {
+		return err
+	}
+
+	return tx.Bucket(bucketCommands).Delete([]byte(id))
+}
+
+func seqKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+func newRecord(cmd *Command) *record {
+	r := &record{
+		ID:        cmd.ID,
+		Command:   cmd.Cmd.Redacted(),
+		Caller:    cmd.Caller,
+		CreatedAt: time.Now().UnixMilli(),
+	}
+
+	if snapshot := cmd.Snapshot(); snapshot != nil {
+		state := *snapshot
+		r.StartedAt = unixMilli(state.StartedAt)
+		r.CompletedAt = unixMilli(state.CompletedAt)
+		r.ErroredAt = unixMilli(state.ErroredAt)
+		if state.Error != nil {
+			r.Error = state.Error.Error()
+		}
+
+		state.StartedAt = nil
+		state.CompletedAt = nil
+		state.ErroredAt = nil
+		state.Error = nil
+		r.State = &state
+	}
+
+	return r
+}
+
+func (r *record) toCommand() *Command {
+	cmd := &Command{
+		ID:     r.ID,
+		Cmd:    r.Command,
+		Caller: r.Caller,
+	}
+
+	if r.State != nil {
+		state := *r.State
+		state.StartedAt = fromUnixMilli(r.StartedAt)
+		state.CompletedAt = fromUnixMilli(r.CompletedAt)
+		state.ErroredAt = fromUnixMilli(r.ErroredAt)
+		if r.Error != "" {
+			state.Error = errors.New(r.Error)
+		}
+		cmd.State = &state
+	}
+
+	return cmd
+}
+
+func unixMilli(dt *datetime.DateTime) int64 {
+	if dt == nil {
+		return 0
+	}
+
+	return dt.Time().UnixMilli()
+}
+
+func fromUnixMilli(ms int64) *datetime.DateTime {
+	if ms == 0 {
+		return nil
+	}
+
+	return datetime.FromTime(time.UnixMilli(ms))
+}
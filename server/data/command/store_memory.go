@@ -0,0 +1,138 @@
+package command
+
+import (
+	"sync"
+	"time"
+)
+
+type memoryStore struct {
+	sync.RWMutex
+	cfg *StoreConfig
+	//
+	commands map[string]*Command
+	created  map[string]time.Time
+	// ids is ordered by creation, oldest first
+	ids []string
+}
+
+// NewMemoryStore creates a store which keeps commands in memory
+func NewMemoryStore(opts ...StoreOption) Store {
+	cfg := &StoreConfig{}
+	for _, o := range opts {
+		o(cfg)
+	}
+
+	return &memoryStore{
+		cfg:      cfg,
+		commands: map[string]*Command{},
+		created:  map[string]time.Time{},
+	}
+}
+
+func (s *memoryStore) Get(id string) *Command {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.commands[id]
+}
+
+func (s *memoryStore) Has(id string) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	_, ok := s.commands[id]
+	return ok
+}
+
+func (s *memoryStore) Set(cmd *Command) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.commands[cmd.ID]; !ok {
+		s.ids = append(s.ids, cmd.ID)
+		s.created[cmd.ID] = time.Now()
+	}
+	s.commands[cmd.ID] = cmd
+
+	s.pruneByCount()
+	return nil
+}
+
+func (s *memoryStore) Del(id string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.del(id)
+	return nil
+}
+
+func (s *memoryStore) List(opt *ListOption) (commands []*Command, total int, err error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	commands = []*Command{}
+	for i := len(s.ids) - 1; i >= 0; i-- {
+		cmd := s.commands[s.ids[i]]
+		if opt.match(cmd) {
+			commands = append(commands, cmd)
+		}
+	}
+
+	return opt.paginate(commands), len(commands), nil
+}
+
+func (s *memoryStore) Prune() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.cfg.MaxAge > 0 {
+		for _, id := range append([]string{}, s.ids...) {
+			if isExpired(s.commands[id], s.created[id], s.cfg.MaxAge) {
+				s.del(id)
+			}
+		}
+	}
+
+	s.pruneByCount()
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+func (s *memoryStore) pruneByCount() {
+	if s.cfg.MaxCount <= 0 {
+		return
+	}
+
+	// running commands are never pruned
+	overflow := len(s.ids) - s.cfg.MaxCount
+	for _, id := range append([]string{}, s.ids...) {
+		if overflow <= 0 {
+			return
+		}
+
+		if cmd := s.commands[id]; cmd.IsRunning() {
+			continue
+		}
+
+		s.del(id)
+		overflow--
+	}
+}
+
+func (s *memoryStore) del(id string) {
+	if _, ok := s.commands[id]; !ok {
+		return
+	}
+
+	delete(s.commands, id)
+	delete(s.created, id)
+	for i, v := range s.ids {
+		if v == id {
+			s.ids = append(s.ids[:i], s.ids[i+1:]...)
+			break
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-idp/agent/entities"
+	"github.com/go-zoox/datetime"
+)
+
+func newFinishedCommand(id string, status string, startedAt time.Time) *Command {
+	state := &State{
+		StartedAt: datetime.FromTime(startedAt),
+		Status:    status,
+	}
+
+	switch status {
+	case "completed":
+		state.IsCompleted = true
+		state.CompletedAt = datetime.FromTime(startedAt.Add(time.Second))
+	case "error":
+		state.IsError = true
+		state.ErroredAt = datetime.FromTime(startedAt.Add(time.Second))
+		state.Error = errors.New("exit status 1")
+	}
+
+	return &Command{
+		ID:    id,
+		Cmd:   &entities.Command{ID: id, Script: "echo " + id},
+		State: state,
+	}
+}
+
+func testStore(t *testing.T, store Store) {
+	t.Helper()
+
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		status := "completed"
+		if i%2 == 1 {
+			status = "error"
+		}
+
+		cmd := newFinishedCommand(fmt.Sprintf("cmd-%d", i), status, now)
+		if i < 2 {
+			cmd.Caller = &Caller{Name: "alice"}
+		}
+
+		if err := store.Set(cmd); err != nil {
+			t.Fatalf("failed to set command: %v", err)
+		}
+	}
+
+	all, total, err := store.List(nil)
+	if err != nil {
+		t.Fatalf("failed to list commands: %v", err)
+	}
+	if total != 5 || len(all) != 5 || all[0].ID != "cmd-4" {
+		t.Fatalf("unexpected list result: total=%d, first=%s", total, all[0].ID)
+	}
+
+	page, total, err := store.List(&ListOption{Status: "completed", Offset: 1, Limit: 1})
+	if err != nil {
+		t.Fatalf("failed to list commands: %v", err)
+	}
+	if total != 3 || len(page) != 1 || page[0].ID != "cmd-2" {
+		t.Fatalf("unexpected page result: total=%d, page=%v", total, page)
+	}
+
+	owned, total, err := store.List(&ListOption{Owner: "alice"})
+	if err != nil {
+		t.Fatalf("failed to list commands: %v", err)
+	}
+	if total != 2 || owned[0].ID != "cmd-1" || owned[1].ID != "cmd-0" {
+		t.Fatalf("unexpected owner result: total=%d, owned=%v", total, owned)
+	}
+
+	failed := store.Get("cmd-1")
+	if failed == nil || failed.State.Error == nil || failed.State.Error.Error() != "exit status 1" {
+		t.Fatalf("unexpected command: %+v", failed)
+	}
+	if failed.State.StartedAt == nil || failed.State.StartedAt.Time().UnixMilli() != now.UnixMilli() {
+		t.Fatalf("unexpected started at: %v", failed.State.StartedAt)
+	}
+
+	if err := store.Del("cmd-1"); err != nil {
+		t.Fatalf("failed to delete command: %v", err)
+	}
+	if store.Has("cmd-1") {
+		t.Fatalf("expected cmd-1 to be deleted")
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestBoltStore(t *testing.T) {
+	store, err := NewBoltStore(filepath.Join(t.TempDir(), "commands.db"))
+	if err != nil {
+		t.Fatalf("failed to create bolt store: %v", err)
+	}
+	defer store.Close()
+
+	testStore(t, store)
+}
+
+func TestBoltStore_PersistsAcrossReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "commands.db")
+
+	store, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatalf("failed to create bolt store: %v", err)
+	}
+	persisted := newFinishedCommand("cmd-persist", "completed", time.Now())
+	persisted.Cmd.Secrets = map[string]string{"TOKEN": "s3cr3t"}
+	persisted.SetExit(0, nil)
+	if err := store.Set(persisted); err != nil {
+		t.Fatalf("failed to set command: %v", err)
+	}
+	store.Close()
+
+	store, err = NewBoltStore(path)
+	if err != nil {
+		t.Fatalf("failed to reopen bolt store: %v", err)
+	}
+	defer store.Close()
+
+	cmd := store.Get("cmd-persist")
+	if cmd == nil || cmd.Status() != "completed" || cmd.Cmd.Script != "echo cmd-persist" {
+		t.Fatalf("unexpected command after reopen: %+v", cmd)
+	}
+	if cmd.State.ExitCode == nil || *cmd.State.ExitCode != 0 {
+		t.Fatalf("expected exit code to be persisted, got %+v", cmd.State)
+	}
+	if cmd.Cmd.Secrets["TOKEN"] != entities.SecretMask || persisted.Cmd.Secrets["TOKEN"] != "s3cr3t" {
+		t.Fatalf("expected secret to be masked on disk only, got %v", cmd.Cmd.Secrets)
+	}
+}
+
+func TestStore_Retention(t *testing.T) {
+	store, err := NewBoltStore(filepath.Join(t.TempDir(), "commands.db"), func(cfg *StoreConfig) {
+		cfg.MaxCount = 2
+		cfg.MaxAge = time.Hour
+	})
+	if err != nil {
+		t.Fatalf("failed to create bolt store: %v", err)
+	}
+	defer store.Close()
+
+	memory := NewMemoryStore(func(cfg *StoreConfig) {
+		cfg.MaxCount = 2
+		cfg.MaxAge = time.Hour
+	})
+
+	for _, s := range []Store{store, memory} {
+		s.Set(newFinishedCommand("cmd-old", "completed", time.Now().Add(-2*time.Hour)))
+		s.Set(newFinishedCommand("cmd-a", "completed", time.Now()))
+		s.Set(newFinishedCommand("cmd-b", "completed", time.Now()))
+		s.Set(newFinishedCommand("cmd-c", "completed", time.Now()))
+
+		if s.Has("cmd-old") || s.Has("cmd-a") {
+			t.Fatalf("expected oldest commands to be pruned by count")
+		}
+
+		s.Set(newFinishedCommand("cmd-expired", "completed", time.Now().Add(-2*time.Hour)))
+		if err := s.Prune(); err != nil {
+			t.Fatalf("failed to prune: %v", err)
+		}
+		if s.Has("cmd-expired") {
+			t.Fatalf("expected expired command to be pruned by age")
+		}
+		if !s.Has("cmd-c") {
+			t.Fatalf("expected cmd-c to be retained")
+		}
+	}
+}
+
+func TestStore_RetentionKeepsRunning(t *testing.T) {
+	bolt, err := NewBoltStore(filepath.Join(t.TempDir(), "commands.db"), func(cfg *StoreConfig) {
+		cfg.MaxCount = 3
+	})
+	if err != nil {
+		t.Fatalf("failed to create bolt store: %v", err)
+	}
+	defer bolt.Close()
+
+	memory := NewMemoryStore(func(cfg *StoreConfig) {
+		cfg.MaxCount = 3
+	})
+
+	for _, s := range []Store{bolt, memory} {
+		s.Set(&Command{ID: "cmd-queued", Cmd: &entities.Command{ID: "cmd-queued"}})
+		s.Set(&Command{ID: "cmd-running", Cmd: &entities.Command{ID: "cmd-running"}, State: &State{Status: "running"}})
+		s.Set(newFinishedCommand("cmd-a", "completed", time.Now()))
+		s.Set(newFinishedCommand("cmd-b", "completed", time.Now()))
+
+		if !s.Has("cmd-queued") || !s.Has("cmd-running") {
+			t.Fatalf("expected queued and running commands to be retained")
+		}
+		if s.Has("cmd-a") || !s.Has("cmd-b") {
+			t.Fatalf("expected oldest finished command to be pruned by count")
+		}
+	}
+}
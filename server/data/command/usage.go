@@ -0,0 +1,253 @@
+package command
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/go-zoox/core-utils/safe"
+	"github.com/go-zoox/logger"
+)
+
+// Usage is the resource usage of command run
+type Usage struct {
+	// WallTime is the elapsed time of run, in milliseconds
+	WallTime int64 `json:"wall_time"`
+	// CPUTime is the total cpu time (user + system) of processes, in milliseconds
+	CPUTime int64 `json:"cpu_time"`
+	// UserCPUTime is the user cpu time of processes, in milliseconds
+	UserCPUTime int64 `json:"user_cpu_time"`
+	// SystemCPUTime is the system cpu time of processes, in milliseconds
+	SystemCPUTime int64 `json:"system_cpu_time"`
+	// MaxRSS is the max resident memory of processes, in bytes
+	MaxRSS int64 `json:"max_rss"`
+	// StdoutBytes is the bytes written to stdout
+	StdoutBytes int64 `json:"stdout_bytes"`
+	// StderrBytes is the bytes written to stderr
+	StderrBytes int64 `json:"stderr_bytes"`
+}
+
+// String returns the usage in JSON
+func (u *Usage) String() string {
+	b, _ := json.Marshal(u)
+	return string(b)
+}
+
+// usageInterval is the interval to sample cpu and memory of container
+var usageInterval = 250 * time.Millisecond
+
+// usageCollectors are the usage collectors of commands running, by run id
+var usageCollectors = safe.NewMap[string, *usageCollector]()
+
+// usageSample is the cpu and memory of processes at a moment
+type usageSample struct {
+	UserCPUTime   time.Duration
+	SystemCPUTime time.Duration
+	RSS           int64
+}
+
+// usageSampler samples the cpu and memory of command by engine
+type usageSampler interface {
+	Sample() (*usageSample, error)
+	Close() error
+}
+
+// usageCollector collects the usage of command while running,
+//
+//	the usage of host process is taken from its rusage after exit,
+//	the one of container is sampled, so the last moment before exit may be missed.
+type usageCollector struct {
+	runID   string
+	sampler usageSampler
+	//
+	startedAt time.Time
+	stdout    int64
+	stderr    int64
+	//
+	sync.Mutex
+	last   usageSample
+	maxRSS int64
+	//
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+// newUsageCollector creates the usage collector, runID is the id of underlying command
+func newUsageCollector(engine string, runID string) *usageCollector {
+	u := &usageCollector{
+		runID:  runID,
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+	}
+
+	switch engine {
+	case "", "host":
+		// the host engine gives the process state on exit
+		usageCollectors.Set(runID, u)
+	case "docker":
+		if s, err := newDockerSampler(runID); err != nil {
+			logger.Warnf("[usage] failed to create docker sampler: %s", err)
+		} else {
+			u.sampler = s
+		}
+	}
+
+	return u
+}
+
+// Start starts sampling
+func (u *usageCollector) Start() {
+	u.startedAt = time.Now()
+
+	go func() {
+		defer close(u.doneCh)
+
+		if u.sampler == nil {
+			return
+		}
+		defer u.sampler.Close()
+
+		ticker := time.NewTicker(usageInterval)
+		defer ticker.Stop()
+		for {
+			u.sample()
+
+			select {
+			case <-u.stopCh:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop stops sampling, and returns the usage
+func (u *usageCollector) Stop() *Usage {
+	close(u.stopCh)
+	<-u.doneCh
+	usageCollectors.Del(u.runID)
+
+	u.Lock()
+	defer u.Unlock()
+
+	return &Usage{
+		WallTime:      time.Since(u.startedAt).Milliseconds(),
+		CPUTime:       (u.last.UserCPUTime + u.last.SystemCPUTime).Milliseconds(),
+		UserCPUTime:   u.last.UserCPUTime.Milliseconds(),
+		SystemCPUTime: u.last.SystemCPUTime.Milliseconds(),
+		MaxRSS:        u.maxRSS,
+		StdoutBytes:   atomic.LoadInt64(&u.stdout),
+		StderrBytes:   atomic.LoadInt64(&u.stderr),
+	}
+}
+
+// exited records the usage of host process exited, which includes its children waited
+func (u *usageCollector) exited(state *os.ProcessState) {
+	u.Lock()
+	defer u.Unlock()
+
+	u.last.UserCPUTime = state.UserTime()
+	u.last.SystemCPUTime = state.SystemTime()
+	u.maxRSS = max(u.maxRSS, maxRSSOf(state))
+}
+
+// Stdout wraps the writer to count stdout bytes
+func (u *usageCollector) Stdout(w io.Writer) io.Writer {
+	return &countWriter{Writer: w, n: &u.stdout}
+}
+
+// Stderr wraps the writer to count stderr bytes
+func (u *usageCollector) Stderr(w io.Writer) io.Writer {
+	return &countWriter{Writer: w, n: &u.stderr}
+}
+
+func (u *usageCollector) sample() {
+	s, err := u.sampler.Sample()
+	if err != nil {
+		logger.Debugf("[usage] failed to sample: %s", err)
+		return
+	}
+
+	// processes may be gone when exiting, keep the last one
+	if s == nil {
+		return
+	}
+
+	u.Lock()
+	defer u.Unlock()
+
+	// cpu time only grows, it may decrease when processes exit without being waited
+	if s.UserCPUTime+s.SystemCPUTime >= u.last.UserCPUTime+u.last.SystemCPUTime {
+		u.last.UserCPUTime = s.UserCPUTime
+		u.last.SystemCPUTime = s.SystemCPUTime
+	}
+
+	u.maxRSS = max(u.maxRSS, s.RSS)
+}
+
+type countWriter struct {
+	io.Writer
+	n *int64
+}
+
+func (w *countWriter) Write(p []byte) (n int, err error) {
+	n, err = w.Writer.Write(p)
+	atomic.AddInt64(w.n, int64(n))
+	return
+}
+
+// dockerSampler samples the container stats
+type dockerSampler struct {
+	client    *client.Client
+	container string
+}
+
+func newDockerSampler(container string) (*dockerSampler, error) {
+	c, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, err
+	}
+
+	return &dockerSampler{
+		client:    c,
+		container: container,
+	}, nil
+}
+
+func (s *dockerSampler) Sample() (*usageSample, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	response, err := s.client.ContainerStatsOneShot(ctx, s.container)
+	if err != nil {
+		// container is not created yet, or removed after exit
+		if client.IsErrNotFound(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	stats := &container.StatsResponse{}
+	if err := json.NewDecoder(response.Body).Decode(stats); err != nil {
+		return nil, err
+	}
+
+	rss := int64(max(stats.MemoryStats.MaxUsage, stats.MemoryStats.Usage))
+	return &usageSample{
+		UserCPUTime:   time.Duration(stats.CPUStats.CPUUsage.UsageInUsermode),
+		SystemCPUTime: time.Duration(stats.CPUStats.CPUUsage.UsageInKernelmode),
+		RSS:           rss,
+	}, nil
+}
+
+func (s *dockerSampler) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,19 @@
+//go:build linux
+
+package command
+
+import (
+	"os"
+	"syscall"
+)
+
+// maxRSSOf returns the max resident memory of process exited, in bytes,
+//
+//	it is the largest one of the process and its children waited, ru_maxrss is in kilobytes on linux.
+func maxRSSOf(state *os.ProcessState) int64 {
+	if rusage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		return rusage.Maxrss * 1024
+	}
+
+	return 0
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package command
+
+import "os"
+
+// maxRSSOf is not supported on this platform, only cpu time, wall time and output bytes are collected
+func maxRSSOf(state *os.ProcessState) int64 {
+	return 0
+}
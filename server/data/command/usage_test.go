@@ -0,0 +1,71 @@
+package command
+
+import (
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/go-idp/agent/entities"
+)
+
+func TestCommand_RecordsUsage(t *testing.T) {
+	cmd, err := New(func(cfg *Config) {
+		cfg.ID = "cmd-usage"
+		cfg.Command = &entities.Command{
+			Script:      "echo hello; echo oops >&2; i=0; while [ $i -lt 200000 ]; do i=$((i+1)); done",
+			WorkDirBase: t.TempDir(),
+		}
+	})
+	if err != nil {
+		t.Fatalf("failed to create command: %v", err)
+	}
+	cmd.SetStdout(io.Discard)
+	cmd.SetStderr(io.Discard)
+
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("failed to run command: %v", err)
+	}
+
+	usage := cmd.State.Usage
+	if usage == nil {
+		t.Fatalf("expected usage to be recorded")
+	}
+	if usage.StdoutBytes != 6 || usage.StderrBytes != 5 {
+		t.Fatalf("unexpected output bytes: stdout=%d, stderr=%d", usage.StdoutBytes, usage.StderrBytes)
+	}
+	if usage.WallTime <= 0 {
+		t.Fatalf("expected wall time, got %d", usage.WallTime)
+	}
+
+	if runtime.GOOS == "linux" && (usage.CPUTime <= 0 || usage.MaxRSS <= 0) {
+		t.Fatalf("expected cpu time and max rss on linux, got %+v", usage)
+	}
+}
+
+func TestCommand_RunsOnHost(t *testing.T) {
+	cmd, err := New(func(cfg *Config) {
+		cfg.ID = "cmd-host"
+		cfg.Command = &entities.Command{
+			Script:      "echo $GO_ZOOX_COMMAND_ENGINE; exit 3",
+			Engine:      "host",
+			WorkDirBase: t.TempDir(),
+		}
+	})
+	if err != nil {
+		t.Fatalf("failed to create command: %v", err)
+	}
+	stdout := &strings.Builder{}
+	cmd.SetStdout(stdout)
+	cmd.SetStderr(io.Discard)
+
+	if err := cmd.Run(); err == nil || !strings.Contains(err.Error(), "exit status 3") {
+		t.Fatalf("expected exit status 3, got %v", err)
+	}
+	if stdout.String() != "host\n" {
+		t.Fatalf("expected the engine seen by command to be host, got %q", stdout.String())
+	}
+	if cmd.State.Usage == nil || len(usageCollectors.Keys()) != 0 {
+		t.Fatalf("expected usage to be recorded and collector to be removed, got %+v", cmd.State.Usage)
+	}
+}
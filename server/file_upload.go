@@ -48,6 +48,12 @@ func appendFileAPI() func(ctx *zoox.Context) {
 		defer f.Close()
 
 		written, err := io.Copy(f, ctx.Request.Body)
+		metricUploadBytes.Add(float64(written))
+		event := &AuditEvent{Action: AuditActionFileWrite, Path: cleanPath}
+		if err != nil {
+			event.Reason = err.Error()
+		}
+		auditHTTP(ctx, event)
 		if err != nil {
 			ctx.Fail(fmt.Errorf("failed to write file: %s", err), 500, "failed to write file")
 			return
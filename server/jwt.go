@@ -0,0 +1,394 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// jwtLeeway is the clock skew allowed when checking exp and nbf
+const jwtLeeway = 30 * time.Second
+
+// jwtVerifier verifies the JWT signed by HMAC secret, or RSA / ECDSA keys
+type jwtVerifier struct {
+	secret []byte
+	// publicKey is the key of public key file, used when kid is not matched in keys
+	publicKey crypto.PublicKey
+	// keys are the keys of JWKS by kid
+	keys map[string]crypto.PublicKey
+	//
+	issuer   string
+	audience string
+}
+
+// jwtHeader is the JOSE header of JWT
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+// jwtClaims is the claims of JWT used by agent
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt int64           `json:"exp"`
+	NotBefore int64           `json:"nbf"`
+	// Scope is the space-separated scopes (RFC 8693), or an array of scopes
+	Scope json.RawMessage `json:"scope"`
+	// Scp is the array of scopes used by some issuers
+	Scp []string `json:"scp"`
+	// Weight is the share of caller in scheduler, optional
+	Weight int `json:"weight"`
+}
+
+// isJWTEnabled returns true if any JWT key is configured
+func (c *Config) isJWTEnabled() bool {
+	return c.JWTSecret != "" || c.JWTPublicKeyFile != "" || c.JWTJWKSFile != ""
+}
+
+// loadJWT loads the keys of JWT verifier
+func (c *Config) loadJWT() error {
+	if !c.isJWTEnabled() {
+		return nil
+	}
+
+	v := &jwtVerifier{
+		secret:   []byte(c.JWTSecret),
+		keys:     map[string]crypto.PublicKey{},
+		issuer:   c.JWTIssuer,
+		audience: c.JWTAudience,
+	}
+
+	if c.JWTPublicKeyFile != "" {
+		raw, err := os.ReadFile(c.JWTPublicKeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to read jwt public key file: %s", err)
+		}
+
+		if v.publicKey, err = parsePublicKey(raw); err != nil {
+			return fmt.Errorf("failed to parse jwt public key: %s", err)
+		}
+	}
+
+	if c.JWTJWKSFile != "" {
+		raw, err := os.ReadFile(c.JWTJWKSFile)
+		if err != nil {
+			return fmt.Errorf("failed to read jwks file: %s", err)
+		}
+
+		if v.keys, err = parseJWKS(raw); err != nil {
+			return fmt.Errorf("failed to parse jwks: %s", err)
+		}
+	}
+
+	c.jwt = v
+	return nil
+}
+
+// Verify verifies the token, and returns the identity of claims
+func (v *jwtVerifier) Verify(token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	header := &jwtHeader{}
+	if err := decodeJWTPart(parts[0], header); err != nil {
+		return nil, fmt.Errorf("invalid header: %s", err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %s", err)
+	}
+
+	if err := v.verifySignature(header, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	claims := &jwtClaims{}
+	if err := decodeJWTPart(parts[1], claims); err != nil {
+		return nil, fmt.Errorf("invalid claims: %s", err)
+	}
+
+	if err := v.verifyClaims(claims); err != nil {
+		return nil, err
+	}
+
+	scopes, err := claims.scopes()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Identity{
+		Name:      claims.Subject,
+		Scopes:    scopes,
+		ExpiresAt: claims.ExpiresAt,
+		Weight:    claims.Weight,
+	}, nil
+}
+
+func (v *jwtVerifier) verifySignature(header *jwtHeader, signed, signature []byte) error {
+	var hash crypto.Hash
+	switch header.Algorithm {
+	case "HS256", "RS256", "ES256":
+		hash = crypto.SHA256
+	case "HS384", "RS384", "ES384":
+		hash = crypto.SHA384
+	case "HS512", "RS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm: %s", header.Algorithm)
+	}
+
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	if strings.HasPrefix(header.Algorithm, "HS") {
+		if len(v.secret) == 0 {
+			return fmt.Errorf("no secret for algorithm %s", header.Algorithm)
+		}
+
+		mac := hmac.New(hash.New, v.secret)
+		mac.Write(signed)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return fmt.Errorf("signature mismatch")
+		}
+
+		return nil
+	}
+
+	key := v.keys[header.KeyID]
+	if key == nil {
+		key = v.publicKey
+	}
+	// JWKS with a single key does not require kid
+	if key == nil && header.KeyID == "" && len(v.keys) == 1 {
+		for _, k := range v.keys {
+			key = k
+		}
+	}
+	if key == nil {
+		return fmt.Errorf("no key for kid %q", header.KeyID)
+	}
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(header.Algorithm, "RS") {
+			return fmt.Errorf("algorithm %s does not match rsa key", header.Algorithm)
+		}
+
+		if err := rsa.VerifyPKCS1v15(k, hash, digest, signature); err != nil {
+			return fmt.Errorf("signature mismatch")
+		}
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(header.Algorithm, "ES") {
+			return fmt.Errorf("algorithm %s does not match ecdsa key", header.Algorithm)
+		}
+
+		// signature is r || s in fixed size
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return fmt.Errorf("signature mismatch")
+		}
+
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return fmt.Errorf("signature mismatch")
+		}
+	default:
+		return fmt.Errorf("unsupported key type: %T", key)
+	}
+
+	return nil
+}
+
+func (v *jwtVerifier) verifyClaims(claims *jwtClaims) error {
+	now := time.Now()
+
+	// short-lived tokens are expected, so exp is required
+	if claims.ExpiresAt == 0 {
+		return fmt.Errorf("exp is required")
+	}
+	if now.After(time.Unix(claims.ExpiresAt, 0).Add(jwtLeeway)) {
+		return fmt.Errorf("token is expired")
+	}
+	if claims.NotBefore != 0 && now.Add(jwtLeeway).Before(time.Unix(claims.NotBefore, 0)) {
+		return fmt.Errorf("token is not valid yet")
+	}
+
+	if claims.Subject == "" {
+		return fmt.Errorf("sub is required")
+	}
+
+	if v.issuer != "" && claims.Issuer != v.issuer {
+		return fmt.Errorf("unexpected issuer: %s", claims.Issuer)
+	}
+
+	if v.audience != "" {
+		audiences := []string{}
+		if len(claims.Audience) != 0 {
+			// aud is a string or an array of strings
+			var one string
+			if err := json.Unmarshal(claims.Audience, &one); err == nil {
+				audiences = append(audiences, one)
+			} else if err := json.Unmarshal(claims.Audience, &audiences); err != nil {
+				return fmt.Errorf("invalid aud: %s", err)
+			}
+		}
+
+		for _, aud := range audiences {
+			if aud == v.audience {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("unexpected audience")
+	}
+
+	return nil
+}
+
+func (c *jwtClaims) scopes() ([]string, error) {
+	scopes := append([]string{}, c.Scp...)
+	if len(c.Scope) == 0 {
+		return scopes, nil
+	}
+
+	var scope string
+	if err := json.Unmarshal(c.Scope, &scope); err == nil {
+		return append(scopes, strings.Fields(scope)...), nil
+	}
+
+	list := []string{}
+	if err := json.Unmarshal(c.Scope, &list); err != nil {
+		return nil, fmt.Errorf("invalid scope: %s", err)
+	}
+
+	return append(scopes, list...), nil
+}
+
+// isJWT returns true if the token looks like a JWT
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2 && strings.HasPrefix(token, "eyJ")
+}
+
+func decodeJWTPart(part string, v any) error {
+	raw, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(raw, v)
+}
+
+func parsePublicKey(raw []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("no pem block found")
+	}
+
+	switch block.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		return cert.PublicKey, nil
+	}
+
+	return nil, fmt.Errorf("unsupported pem type: %s", block.Type)
+}
+
+// parseJWKS parses the RSA and EC keys of JWKS (RFC 7517), keys of other types are ignored
+func parseJWKS(raw []byte) (map[string]crypto.PublicKey, error) {
+	jwks := &struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			// RSA
+			N string `json:"n"`
+			E string `json:"e"`
+			// EC
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}{}
+	if err := json.Unmarshal(raw, jwks); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		switch k.Kty {
+		case "RSA":
+			n, err := base64.RawURLEncoding.DecodeString(k.N)
+			if err != nil {
+				return nil, fmt.Errorf("invalid n of key %s: %s", k.Kid, err)
+			}
+			e, err := base64.RawURLEncoding.DecodeString(k.E)
+			if err != nil {
+				return nil, fmt.Errorf("invalid e of key %s: %s", k.Kid, err)
+			}
+
+			keys[k.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				return nil, fmt.Errorf("unsupported curve of key %s: %s", k.Kid, k.Crv)
+			}
+
+			x, err := base64.RawURLEncoding.DecodeString(k.X)
+			if err != nil {
+				return nil, fmt.Errorf("invalid x of key %s: %s", k.Kid, err)
+			}
+			y, err := base64.RawURLEncoding.DecodeString(k.Y)
+			if err != nil {
+				return nil, fmt.Errorf("invalid y of key %s: %s", k.Kid, err)
+			}
+
+			keys[k.Kid] = &ecdsa.PublicKey{
+				Curve: curve,
+				X:     new(big.Int).SetBytes(x),
+				Y:     new(big.Int).SetBytes(y),
+			}
+		}
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-idp/agent/client"
+	"github.com/go-idp/agent/entities"
+)
+
+// signTestJWT signs the claims with HS256 secret, RS256 or ES256 private key
+func signTestJWT(t *testing.T, alg string, kid string, key any, claims map[string]any) string {
+	t.Helper()
+
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatalf("failed to sign: %v", err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatalf("failed to sign: %v", err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTVerifier_HMAC(t *testing.T) {
+	cfg := &Config{JWTSecret: "secret", JWTIssuer: "platform", JWTAudience: "agent"}
+	if err := cfg.loadJWT(); err != nil {
+		t.Fatalf("failed to load jwt: %v", err)
+	}
+
+	exp := time.Now().Add(time.Minute).Unix()
+	identity, err := cfg.jwt.Verify(signTestJWT(t, "HS256", "", []byte("secret"), map[string]any{
+		"sub":   "alice",
+		"iss":   "platform",
+		"aud":   []string{"agent"},
+		"exp":   exp,
+		"scope": "exec read-logs",
+	}))
+	if err != nil {
+		t.Fatalf("failed to verify: %v", err)
+	}
+	if identity.Name != "alice" || identity.ExpiresAt != exp || !identity.HasScope(ScopeExec) || identity.HasScope(ScopeCancel) {
+		t.Fatalf("unexpected identity: %+v", identity)
+	}
+
+	cases := map[string]map[string]any{
+		"expired":     {"sub": "alice", "iss": "platform", "aud": "agent", "exp": time.Now().Add(-time.Hour).Unix()},
+		"missing exp": {"sub": "alice", "iss": "platform", "aud": "agent"},
+		"wrong iss":   {"sub": "alice", "iss": "other", "aud": "agent", "exp": exp},
+		"wrong aud":   {"sub": "alice", "iss": "platform", "aud": "other", "exp": exp},
+		"missing sub": {"iss": "platform", "aud": "agent", "exp": exp},
+	}
+	for name, claims := range cases {
+		if _, err := cfg.jwt.Verify(signTestJWT(t, "HS256", "", []byte("secret"), claims)); err == nil {
+			t.Fatalf("%s: expected verify to fail", name)
+		}
+	}
+
+	if _, err := cfg.jwt.Verify(signTestJWT(t, "HS256", "", []byte("other"), map[string]any{"sub": "alice", "iss": "platform", "aud": "agent", "exp": exp})); err == nil {
+		t.Fatalf("expected wrong secret to fail")
+	}
+}
+
+func TestJWTVerifier_PublicKeys(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate rsa key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate ec key: %v", err)
+	}
+
+	dir := t.TempDir()
+
+	// ecdsa key in pem
+	der, err := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to marshal ec key: %v", err)
+	}
+	pemPath := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(pemPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("failed to write pem: %v", err)
+	}
+
+	// rsa key in jwks
+	jwks, _ := json.Marshal(map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "rsa-1",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+		}},
+	})
+	jwksPath := filepath.Join(dir, "jwks.json")
+	if err := os.WriteFile(jwksPath, jwks, 0o600); err != nil {
+		t.Fatalf("failed to write jwks: %v", err)
+	}
+
+	cfg := &Config{JWTPublicKeyFile: pemPath, JWTJWKSFile: jwksPath}
+	if err := cfg.loadJWT(); err != nil {
+		t.Fatalf("failed to load jwt: %v", err)
+	}
+
+	claims := map[string]any{"sub": "ci", "exp": time.Now().Add(time.Minute).Unix(), "scp": []string{"exec"}}
+
+	identity, err := cfg.jwt.Verify(signTestJWT(t, "RS256", "rsa-1", rsaKey, claims))
+	if err != nil {
+		t.Fatalf("failed to verify rs256: %v", err)
+	}
+	if identity.Name != "ci" || !identity.HasScope(ScopeExec) {
+		t.Fatalf("unexpected identity: %+v", identity)
+	}
+
+	if _, err := cfg.jwt.Verify(signTestJWT(t, "ES256", "", ecKey, claims)); err != nil {
+		t.Fatalf("failed to verify es256: %v", err)
+	}
+
+	// unknown kid falls back to the pem key, which does not accept rsa signature
+	if _, err := cfg.jwt.Verify(signTestJWT(t, "RS256", "unknown", rsaKey, claims)); err == nil {
+		t.Fatalf("expected rs256 with unknown kid to fail")
+	}
+
+	// hmac is not accepted without secret
+	if _, err := cfg.jwt.Verify(signTestJWT(t, "HS256", "", []byte(""), claims)); err == nil {
+		t.Fatalf("expected hs256 without secret to fail")
+	}
+}
+
+func TestWsService_JWTRecordsCaller(t *testing.T) {
+	cfg := &Config{JWTSecret: "secret"}
+	if err := cfg.loadJWT(); err != nil {
+		t.Fatalf("failed to load jwt: %v", err)
+	}
+	addr := newTestWsServer(t, cfg)
+
+	token := signTestJWT(t, "HS256", "", []byte("secret"), map[string]any{
+		"sub":   "alice",
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"scope": "exec",
+	})
+
+	c := client.New(&client.Config{Server: addr, Token: token, Stdout: io.Discard, Stderr: io.Discard})
+	if err := c.Connect(); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+
+	id := fmt.Sprintf("cmd-jwt-%d", time.Now().UnixNano())
+	if err := c.Exec(&entities.Command{ID: id, Script: "echo hi"}); err != nil {
+		t.Fatalf("failed to exec: %v", err)
+	}
+
+	dc := commands.Get(id)
+	if dc == nil || dc.Caller == nil || dc.Caller.Name != "alice" {
+		t.Fatalf("expected caller alice to be recorded, got %+v", dc)
+	}
+	if !strings.HasPrefix(dc.Caller.RemoteAddr, "127.0.0.1:") {
+		t.Fatalf("expected remote address to be recorded, got %q", dc.Caller.RemoteAddr)
+	}
+}
+
+func TestWsService_JWTExpiresOnConnection(t *testing.T) {
+	cfg := &Config{JWTSecret: "secret"}
+	if err := cfg.loadJWT(); err != nil {
+		t.Fatalf("failed to load jwt: %v", err)
+	}
+	addr := newTestWsServer(t, cfg)
+
+	// accepted within the leeway, and expires in seconds
+	exp := time.Now().Add(2*time.Second - jwtLeeway).Unix()
+	token := signTestJWT(t, "HS256", "", []byte("secret"), map[string]any{
+		"sub":   "alice",
+		"exp":   exp,
+		"scope": "exec",
+	})
+
+	c := client.New(&client.Config{Server: addr, Token: token, Stdout: io.Discard, Stderr: io.Discard})
+	if err := c.Connect(); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+
+	if err := c.Exec(&entities.Command{ID: fmt.Sprintf("cmd-jwt-valid-%d", time.Now().UnixNano()), Script: "true"}); err != nil {
+		t.Fatalf("failed to exec before expiry: %v", err)
+	}
+
+	time.Sleep(time.Until(time.Unix(exp, 0).Add(jwtLeeway)) + 100*time.Millisecond)
+
+	id := fmt.Sprintf("cmd-jwt-expired-%d", time.Now().UnixNano())
+	if err := c.Exec(&entities.Command{ID: id, Script: "true"}); err == nil {
+		t.Fatalf("expected exec after expiry to be rejected")
+	}
+	if dc := commands.Get(id); dc != nil {
+		t.Fatalf("expected command after expiry not to be created, got %+v", dc)
+	}
+}
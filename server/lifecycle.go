@@ -0,0 +1,213 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-idp/agent/entities"
+	dcommand "github.com/go-idp/agent/server/data/command"
+	"github.com/go-zoox/datetime"
+	"github.com/go-zoox/fs"
+	"github.com/go-zoox/logger"
+)
+
+// commandRun is the lifecycle of command accepted, shared by websocket and REST,
+//
+//	it waits in queue, runs, records the result in metadata and cleans up.
+type commandRun struct {
+	cfg *Config
+	dc  *dcommand.Command
+	//
+	cmdCfg *CommandConfig
+	Stream *CommandStream
+	//
+	ticket *ticket
+	finish func()
+}
+
+// errCommandExists is the error of command id already accepted
+var errCommandExists = fmt.Errorf("command already exists")
+
+// validateCommandID rejects the command id which is not a single path element,
+//
+//	because it is joined into the metadata dir and work dir, which are removed by clean.
+func validateCommandID(id string) error {
+	if id == "" || id == "." || strings.Contains(id, "..") || strings.ContainsAny(id, "/\\") {
+		return fmt.Errorf("invalid command id: %q", id)
+	}
+
+	return nil
+}
+
+// newDataCommand creates the command of request by config, the config overrides the timeout,
+//
+//	and gives the default of shell, work dir and environment.
+func newDataCommand(cfg *Config, request *entities.Command, caller *dcommand.Caller) (*dcommand.Command, error) {
+	return dcommand.New(func(c *dcommand.Config) {
+		c.ID = request.ID
+		c.Command = request
+		c.Caller = caller
+
+		// cfg.Timeout is seconds, but command.Timeout is milliseconds
+		if cfg.Timeout != 0 {
+			c.Command.Timeout = cfg.Timeout * 1000
+		}
+
+		if c.Command.Shell == "" {
+			c.Command.Shell = cfg.Shell
+		}
+
+		// fix workdir
+		if c.Command.WorkDirBase == "" {
+			c.Command.WorkDirBase = cfg.WorkDir
+		}
+
+		if cfg.Environment != nil {
+			if c.Command.Environment == nil {
+				c.Command.Environment = map[string]string{}
+			}
+
+			for k, v := range cfg.Environment {
+				c.Command.Environment[k] = v
+			}
+		}
+
+		if cfg.IsAutoReport {
+			c.IsAutoReport = cfg.IsAutoReport
+			c.SetAllowReportFunc(cfg.allowReportFunc)
+		}
+
+		c.Policy = cfg.policy
+	})
+}
+
+// startCommand saves the command admitted, and prepares its metadata and stream,
+//
+//	the ticket is released if it fails, otherwise by Run, errCommandExists if the id is taken.
+func startCommand(cfg *Config, dc *dcommand.Command, t *ticket) (*commandRun, error) {
+	finish, err := watchCommand(dc.ID)
+	if err != nil {
+		t.Release()
+		return nil, err
+	}
+
+	if err := commands.Set(dc); err != nil {
+		finish()
+		t.Release()
+		return nil, fmt.Errorf("failed to save command: %s", err)
+	}
+	trackCommand(dc)
+
+	cmdCfg, err := cfg.GetCommandConfig(dc.ID, dc.Cmd)
+	if err != nil {
+		finish()
+		t.Release()
+		return nil, fmt.Errorf("failed to get command config: %s", err)
+	}
+
+	stream := newCommandStream(cfg, dc, cmdCfg.Log)
+	dc.SetStdout(stream.Stdout())
+	dc.SetStderr(stream.Stderr())
+
+	return &commandRun{
+		cfg:    cfg,
+		dc:     dc,
+		cmdCfg: cmdCfg,
+		Stream: stream,
+		ticket: t,
+		finish: finish,
+	}, nil
+}
+
+// Run waits for the command to be admitted, runs it and records the result,
+//
+//	onQueued is called with the position when it is queued or moved.
+func (r *commandRun) Run(onQueued func(position int)) error {
+	dc, cmdCfg := r.dc, r.cmdCfg
+	defer r.finish()
+	defer r.ticket.Release()
+	defer r.clean()
+	defer cmdCfg.Log.Close()
+
+	// the command is recorded once accepted, so the one cancelled while queued is restored too
+	cmdCfg.Script.WriteString(dc.Cmd.Script)
+	cmdCfg.Caller.WriteString(dc.Caller.String())
+	if len(dc.Cmd.Environment) > 0 {
+		env := []string{}
+		for k, v := range dc.Cmd.Environment {
+			env = append(env, fmt.Sprintf("%s=%s", k, v))
+		}
+		sort.Strings(env)
+		cmdCfg.Env.WriteString(strings.Join(env, "\n"))
+	}
+
+	// the command cancelled while queued is recorded as cancelled, without running
+	err := r.ticket.Wait(onQueued)
+	if state := dc.Snapshot(); state != nil && state.QueuedAt != nil {
+		cmdCfg.QueuedAt.WriteString(state.QueuedAt.Format("YYYY-MM-DD HH:mm:ss"))
+	}
+	if err == nil {
+		logger.Infof("[command][id: %s] start to run ...", dc.ID)
+		cmdCfg.StartAt.WriteString(datetime.Now().Format("YYYY-MM-DD HH:mm:ss"))
+
+		err = dc.Run()
+	}
+
+	exitCode := recordExit(dc, cmdCfg, err)
+	if errx := commands.Set(dc); errx != nil {
+		logger.Warnf("[command][id: %s] failed to save command: %s", dc.ID, errx)
+	}
+	if state := dc.Snapshot(); state.Usage != nil {
+		cmdCfg.Usage.WriteString(state.Usage.String())
+	}
+
+	if err != nil {
+		cmdCfg.Error.WriteString(err.Error())
+
+		if dc.Status() == "cancelled" {
+			cmdCfg.Status.WriteString("cancelled")
+			logger.Infof("[command][id: %s] cancelled", dc.ID)
+		} else {
+			cmdCfg.FailedAt.WriteString(datetime.Now().Format("YYYY-MM-DD HH:mm:ss"))
+			cmdCfg.Status.WriteString("failure")
+
+			if asExitError(err) == nil {
+				r.Stream.Stderr().Write([]byte(err.Error() + "\n"))
+			}
+
+			logger.Errorf("[command][id: %s] failed to run (err: %v, exit code: %d)", dc.ID, err, exitCode)
+		}
+
+		// the connection requested cancel has been detached, the others attached are notified
+		r.Stream.Exit(exitCode, exitReasonOf(dc, err))
+		return err
+	}
+
+	cmdCfg.SucceedAt.WriteString(datetime.Now().Format("YYYY-MM-DD HH:mm:ss"))
+	cmdCfg.Status.WriteString("success")
+
+	r.Stream.Exit(0, "")
+	return nil
+}
+
+// clean removes the work dir and metadata dir of command if enabled
+func (r *commandRun) clean() {
+	if r.cfg.IsCleanWorkDirEnabled || r.dc.Cmd.EnableCleanWorkDir {
+		if ok := fs.IsExist(r.cmdCfg.WorkDir); ok {
+			logger.Infof("[command] clean work dir: %s", r.cmdCfg.WorkDir)
+			if err := fs.Remove(r.cmdCfg.WorkDir); err != nil {
+				logger.Warnf("failed to clean workdir(%s): %s", r.cmdCfg.WorkDir, err)
+			}
+		}
+	}
+
+	if r.cfg.IsCleanMetadataDirEnabled || r.dc.Cmd.EnableCleanMetadataDir {
+		if ok := fs.IsExist(r.cmdCfg.MetadataDir); ok {
+			logger.Infof("[command] clean metadata dir: %s", r.cmdCfg.MetadataDir)
+			if err := fs.Remove(r.cmdCfg.MetadataDir); err != nil {
+				logger.Warnf("failed to clean metadatadir(%s): %s", r.cmdCfg.MetadataDir, err)
+			}
+		}
+	}
+}
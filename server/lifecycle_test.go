@@ -0,0 +1,329 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-idp/agent/client"
+	"github.com/go-idp/agent/entities"
+	dcommand "github.com/go-idp/agent/server/data/command"
+	"github.com/go-zoox/zoox"
+	"github.com/go-zoox/zoox/defaults"
+)
+
+// volatileMetadata are the metadata files which differ by run, only their presence is compared
+var volatileMetadata = map[string]bool{
+	"queued_at":  true,
+	"start_at":   true,
+	"succeed_at": true,
+	"failed_at":  true,
+	"usage":      true,
+	"caller":     true,
+}
+
+type lifecycleEntries struct {
+	cfg *Config
+	ws  client.Client
+	app *zoox.Application
+}
+
+func newLifecycleEntries(t *testing.T) *lifecycleEntries {
+	t.Helper()
+
+	original := commands
+	commands = dcommand.NewMemoryStore()
+	t.Cleanup(func() {
+		commands = original
+	})
+
+	cfg := &Config{
+		Shell:       "bash",
+		Environment: map[string]string{"AGENT_ENV": "from-config"},
+	}
+	addr := newTestWsServer(t, cfg)
+
+	ws := client.New(&client.Config{Server: addr, Stdout: io.Discard, Stderr: io.Discard})
+	if err := ws.Connect(); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() {
+		ws.Close()
+	})
+
+	app := defaults.Application()
+	app.Post("/commands", createCommandAPI(cfg))
+	app.Post("/commands/:id/cancel", cancelCommandAPI(cfg))
+
+	return &lifecycleEntries{cfg: cfg, ws: ws, app: app}
+}
+
+func (e *lifecycleEntries) post(t *testing.T, path string, body any) {
+	t.Helper()
+
+	if resp := e.request(path, body); resp.Code != 200 {
+		t.Fatalf("unexpected response of %s: %d %s", path, resp.Code, resp.Body.String())
+	}
+}
+
+func (e *lifecycleEntries) request(path string, body any) *httptest.ResponseRecorder {
+	raw, _ := json.Marshal(body)
+	req := httptest.NewRequest("POST", path, strings.NewReader(string(raw)))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+	e.app.ServeHTTP(resp, req)
+	return resp
+}
+
+// metadataOf reads the metadata files of command, the volatile ones are replaced by their presence
+func (e *lifecycleEntries) metadataOf(t *testing.T, id string) map[string]string {
+	t.Helper()
+
+	dir := filepath.Join(e.cfg.MetadataDir, id)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read metadata dir: %v", err)
+	}
+
+	metadata := map[string]string{}
+	for _, entry := range entries {
+		if volatileMetadata[entry.Name()] {
+			metadata[entry.Name()] = "<present>"
+			continue
+		}
+
+		content, _ := os.ReadFile(filepath.Join(dir, entry.Name()))
+		metadata[entry.Name()] = string(content)
+	}
+
+	return metadata
+}
+
+// waitForFinished waits for the command watched to finish, nil means it has finished
+func waitForFinished(t *testing.T, done <-chan struct{}) {
+	t.Helper()
+
+	if done == nil {
+		return
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for command to finish")
+	}
+}
+
+func assertSameMetadata(t *testing.T, ws, rest map[string]string) {
+	t.Helper()
+
+	for name, content := range ws {
+		if rest[name] != content {
+			t.Fatalf("metadata %s differs, websocket: %q, rest: %q", name, content, rest[name])
+		}
+	}
+	for name := range rest {
+		if _, ok := ws[name]; !ok {
+			t.Fatalf("metadata %s is written by rest only", name)
+		}
+	}
+}
+
+func TestCommandLifecycle_SameMetadataForEntries(t *testing.T) {
+	e := newLifecycleEntries(t)
+
+	script := `[ -n "$BASH_VERSION" ] && echo shell=bash; echo "$AGENT_ENV $FOO"; exit 3`
+	environment := map[string]string{"FOO": "bar"}
+
+	exec, err := e.ws.ExecAsync(&entities.Command{ID: "ws-exit", Script: script, Environment: environment})
+	if err != nil {
+		t.Fatalf("failed to exec: %v", err)
+	}
+	exec.Wait()
+	waitForFinished(t, commandFinished("ws-exit"))
+
+	e.post(t, "/commands?wait=true", &entities.Command{ID: "rest-exit", Engine: "host", Script: script, Environment: environment})
+
+	ws, rest := e.metadataOf(t, "ws-exit"), e.metadataOf(t, "rest-exit")
+	assertSameMetadata(t, ws, rest)
+	if ws["log"] != "shell=bash\nfrom-config bar\n" || ws["status"] != "failure" || ws["exit_code"] != "3" {
+		t.Fatalf("unexpected metadata: %v", ws)
+	}
+	if ws["env"] != "AGENT_ENV=from-config\nFOO=bar" {
+		t.Fatalf("expected environment of config and command, got %q", ws["env"])
+	}
+
+	// the command without environment is given the environment of config
+	e.post(t, "/commands?wait=true", &entities.Command{ID: "rest-no-env", Engine: "host", Script: "echo $AGENT_ENV"})
+	if metadata := e.metadataOf(t, "rest-no-env"); metadata["log"] != "from-config\n" || metadata["status"] != "success" {
+		t.Fatalf("unexpected metadata of command without environment: %v", metadata)
+	}
+}
+
+func TestCommandLifecycle_CancelledQueuedForEntries(t *testing.T) {
+	original := commandScheduler
+	commandScheduler = newScheduler(1, 0)
+	t.Cleanup(func() {
+		commandScheduler = original
+	})
+
+	blocker, _ := commandScheduler.Admit(&admission{ID: "blocker"})
+	defer blocker.Release()
+
+	e := newLifecycleEntries(t)
+
+	exec, err := e.ws.ExecAsync(&entities.Command{ID: "ws-cancelled", Script: "echo never"})
+	if err != nil {
+		t.Fatalf("failed to exec: %v", err)
+	}
+	waitForScheduler(t, 1, 1)
+	done := commandFinished("ws-cancelled")
+	exec.Cancel()
+	waitForFinished(t, done)
+
+	e.post(t, "/commands", &entities.Command{ID: "rest-cancelled", Engine: "host", Script: "echo never"})
+	waitForScheduler(t, 1, 1)
+	done = commandFinished("rest-cancelled")
+	e.post(t, "/commands/rest-cancelled/cancel", nil)
+	waitForFinished(t, done)
+
+	ws, rest := e.metadataOf(t, "ws-cancelled"), e.metadataOf(t, "rest-cancelled")
+	assertSameMetadata(t, ws, rest)
+	if ws["status"] != "cancelled" || ws["exit_code"] != "130" {
+		t.Fatalf("unexpected metadata: %v", ws)
+	}
+	if _, ok := ws["start_at"]; ok {
+		t.Fatalf("expected start_at not to be written for command cancelled while queued, got %v", ws)
+	}
+	for _, name := range []string{"script", "caller", "queued_at"} {
+		if _, ok := ws[name]; !ok {
+			t.Fatalf("expected %s to be written for command cancelled while queued, got %v", name, ws)
+		}
+	}
+
+	// the command cancelled while queued is restored after restart
+	commands = dcommand.NewMemoryStore()
+	if err := restoreCommands(e.cfg); err != nil {
+		t.Fatalf("failed to restore commands: %v", err)
+	}
+	for _, id := range []string{"ws-cancelled", "rest-cancelled"} {
+		dc := commands.Get(id)
+		if dc == nil || dc.Status() != "cancelled" || dc.State.QueuedAt == nil || dc.Cmd.Script != "echo never" {
+			t.Fatalf("expected %s to be restored as cancelled, got %+v", id, dc)
+		}
+	}
+}
+
+func TestCommandLifecycle_CancelledBeforeQueued(t *testing.T) {
+	original := commandScheduler
+	commandScheduler = newScheduler(1, 0)
+	t.Cleanup(func() {
+		commandScheduler = original
+	})
+
+	blocker, _ := commandScheduler.Admit(&admission{ID: "blocker"})
+	defer blocker.Release()
+
+	e := newLifecycleEntries(t)
+
+	dc, err := newDataCommand(e.cfg, &entities.Command{ID: "cancelled-early", Script: "echo never"}, nil)
+	if err != nil {
+		t.Fatalf("failed to create command: %v", err)
+	}
+	if err := dc.Cancel(); err != nil {
+		t.Fatalf("failed to cancel command accepted: %v", err)
+	}
+
+	ticket, err := admitCommand(dc)
+	if err != nil {
+		t.Fatalf("failed to admit command: %v", err)
+	}
+	run, err := startCommand(e.cfg, dc, ticket)
+	if err != nil {
+		t.Fatalf("failed to start command: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- run.Run(nil)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected command cancelled before queued not to wait in queue")
+	}
+
+	if dc.Status() != "cancelled" {
+		t.Fatalf("expected command to be cancelled, got %q", dc.Status())
+	}
+	if metadata := e.metadataOf(t, "cancelled-early"); metadata["status"] != "cancelled" {
+		t.Fatalf("expected cancelled to be recorded, got %v", metadata)
+	}
+
+	restored, err := restoreCommand(e.cfg, filepath.Join(e.cfg.MetadataDir, "cancelled-early"), "cancelled-early")
+	if err != nil || restored.Status() != "cancelled" {
+		t.Fatalf("expected command cancelled before queued to be restored, got %v", err)
+	}
+}
+
+func TestCommandLifecycle_AcceptedHasState(t *testing.T) {
+	dc, err := newDataCommand(&Config{}, &entities.Command{ID: "accepted", Script: "true"}, nil)
+	if err != nil {
+		t.Fatalf("failed to create command: %v", err)
+	}
+
+	// cancel and stdin read the state before it runs
+	if !dc.IsRunning() || isCommandFinished(dc) || dc.Status() != "" {
+		t.Fatalf("unexpected state of command accepted: %+v", dc.State)
+	}
+}
+
+func TestCommandLifecycle_CleansWorkDir(t *testing.T) {
+	e := newLifecycleEntries(t)
+	e.cfg.IsCleanWorkDirEnabled = true
+
+	e.post(t, "/commands?wait=true", &entities.Command{ID: "rest-clean", Engine: "host", Script: "touch artifact"})
+
+	if _, err := os.Stat(filepath.Join(e.cfg.WorkDir, "rest-clean")); !os.IsNotExist(err) {
+		t.Fatalf("expected work dir to be cleaned, got %v", err)
+	}
+	if metadata := e.metadataOf(t, "rest-clean"); metadata["status"] != "success" {
+		t.Fatalf("expected metadata to be kept, got %v", metadata)
+	}
+}
+
+func TestCommandLifecycle_RejectsTakenAndInvalidIDs(t *testing.T) {
+	e := newLifecycleEntries(t)
+
+	e.post(t, "/commands?wait=true", &entities.Command{ID: "taken", Engine: "host", Script: "echo first"})
+
+	if resp := e.request("/commands", &entities.Command{ID: "taken", Engine: "host", Script: "echo second"}); resp.Code != 409 {
+		t.Fatalf("expected id taken to conflict, got %d %s", resp.Code, resp.Body.String())
+	}
+	if err := e.ws.Exec(&entities.Command{ID: "taken", Script: "echo second"}); err == nil {
+		t.Fatalf("expected id taken to be rejected by websocket")
+	}
+	if metadata := e.metadataOf(t, "taken"); metadata["log"] != "first\n" {
+		t.Fatalf("expected command taken to be kept, got %v", metadata)
+	}
+	if dc := commands.Get("taken"); dc == nil || dc.Cmd.Script != "echo first" {
+		t.Fatalf("expected record taken to be kept, got %+v", dc)
+	}
+
+	for _, id := range []string{"..", "../escape", "a/b", `a\b`} {
+		if resp := e.request("/commands", &entities.Command{ID: id, Engine: "host", Script: "true"}); resp.Code != 400 {
+			t.Fatalf("expected invalid id %q to be rejected, got %d %s", id, resp.Code, resp.Body.String())
+		}
+		if err := e.ws.Exec(&entities.Command{ID: id, Script: "true"}); err == nil {
+			t.Fatalf("expected invalid id %q to be rejected by websocket", id)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(e.cfg.MetadataDir, "escape")); !os.IsNotExist(err) {
+		t.Fatalf("expected no metadata outside of command dir, got %v", err)
+	}
+}
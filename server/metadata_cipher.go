@@ -0,0 +1,231 @@
+package server
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/go-zoox/fs"
+)
+
+// metadataMagic is the header of encrypted metadata file
+var metadataMagic = []byte("GOIDPENC")
+
+// errMetadataTruncated is the error of encrypted metadata file without its final record
+var errMetadataTruncated = fmt.Errorf("metadata is truncated")
+
+// metadataCipher encrypts the metadata files with AES-GCM,
+//
+//	each write is sealed as a record: length(4) | nonce | ciphertext,
+//	so the log is appended without rewriting, and read from any offset of plaintext.
+//	The record is bound to its file and sequence number by the additional data,
+//	and the file is completed by a final record, so the records moved, reordered or cut are rejected.
+type metadataCipher struct {
+	aead cipher.AEAD
+}
+
+func newMetadataCipher(key string) (*metadataCipher, error) {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("key should be base64 encoded: %s", err)
+	}
+	if len(raw) != 32 {
+		return nil, fmt.Errorf("key should be 32 bytes, got %d", len(raw))
+	}
+
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &metadataCipher{aead: aead}, nil
+}
+
+// loadMetadataCipher loads the cipher of metadata files if encryption key is set
+func (c *Config) loadMetadataCipher() error {
+	if c.MetadataEncryptionKey == "" {
+		return nil
+	}
+
+	m, err := newMetadataCipher(c.MetadataEncryptionKey)
+	if err != nil {
+		return fmt.Errorf("invalid metadata encryption key: %s", err)
+	}
+
+	c.metadataCipher = m
+	return nil
+}
+
+// metadataRecordName returns the name of metadata file bound to its records, e.g. <command id>/log,
+//
+//	the metadata dir is not bound, so it can be moved.
+func metadataRecordName(path string) string {
+	return filepath.Base(filepath.Dir(path)) + "/" + filepath.Base(path)
+}
+
+// additionalData returns the additional data of record: magic | name | 0 | seq(8) | final(1)
+func (m *metadataCipher) additionalData(name string, seq uint64, final bool) []byte {
+	ad := make([]byte, 0, len(metadataMagic)+len(name)+10)
+	ad = append(append(append(ad, metadataMagic...), name...), 0)
+	ad = binary.BigEndian.AppendUint64(ad, seq)
+	if final {
+		return append(ad, 1)
+	}
+
+	return append(ad, 0)
+}
+
+// seal returns the record of p, which is the seq-th record of file name, final if it completes the file
+func (m *metadataCipher) seal(name string, seq uint64, final bool, p []byte) ([]byte, error) {
+	nonceSize := m.aead.NonceSize()
+	record := make([]byte, 4+nonceSize, 4+nonceSize+len(p)+m.aead.Overhead())
+	if _, err := rand.Read(record[4 : 4+nonceSize]); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %s", err)
+	}
+
+	record = m.aead.Seal(record, record[4:4+nonceSize], p, m.additionalData(name, seq, final))
+	binary.BigEndian.PutUint32(record[:4], uint32(len(record)-4-nonceSize))
+	return record, nil
+}
+
+// open reads the records of file name from r, returns the plaintext from offset, the next offset,
+//
+//	and whether the file is completed by the final record, which is empty.
+//	The records before offset are skipped without decrypting, the incomplete record at the end is left for next read.
+func (m *metadataCipher) open(r io.ReadSeeker, name string, offset int64) ([]byte, int64, bool, error) {
+	nonceSize := m.aead.NonceSize()
+	header := make([]byte, 4+nonceSize)
+
+	var plaintext []byte
+	var pos int64
+	var seq uint64
+	sealed := false
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			return nil, offset, false, err
+		}
+
+		if sealed {
+			return nil, offset, false, fmt.Errorf("malformed record after final record")
+		}
+
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		if size < int64(m.aead.Overhead()) {
+			return nil, offset, false, fmt.Errorf("malformed record")
+		}
+
+		length := size - int64(m.aead.Overhead())
+		if length > 0 && pos+length <= offset {
+			if _, err := r.Seek(size, io.SeekCurrent); err != nil {
+				return nil, offset, false, err
+			}
+			pos += length
+			seq++
+			continue
+		}
+
+		ciphertext := make([]byte, size)
+		if _, err := io.ReadFull(r, ciphertext); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			return nil, offset, false, err
+		}
+
+		// only the empty record may be final
+		sealed = length == 0
+		p, err := m.aead.Open(nil, header[4:], ciphertext, m.additionalData(name, seq, sealed))
+		if err != nil {
+			return nil, offset, false, fmt.Errorf("failed to decrypt: %s", err)
+		}
+		seq++
+
+		if length == 0 {
+			continue
+		}
+		if pos < offset {
+			p = p[offset-pos:]
+		}
+		plaintext = append(plaintext, p...)
+		pos += length
+	}
+
+	if pos < offset {
+		return nil, offset, sealed, nil
+	}
+
+	return plaintext, pos, sealed, nil
+}
+
+// readMetadataFrom reads the metadata file from offset of plaintext, decrypted if it is encrypted,
+//
+//	returns the content and the next offset.
+func readMetadataFrom(cfg *Config, path string, offset int64) ([]byte, int64, error) {
+	content, next, _, err := readMetadata(cfg, path, offset)
+	return content, next, err
+}
+
+// readCompleteMetadata reads the metadata file written at once, the encrypted one without final record is rejected
+func readCompleteMetadata(cfg *Config, path string) ([]byte, error) {
+	content, _, complete, err := readMetadata(cfg, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	if !complete {
+		return nil, errMetadataTruncated
+	}
+
+	return content, nil
+}
+
+// readMetadata reads the metadata file from offset, and returns whether it is complete,
+//
+//	the clear text is always complete, the encrypted one is completed by its final record.
+func readMetadata(cfg *Config, path string, offset int64) ([]byte, int64, bool, error) {
+	if !fs.IsExist(path) {
+		return nil, offset, true, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, offset, false, err
+	}
+	defer f.Close()
+
+	header := make([]byte, len(metadataMagic))
+	if _, err := io.ReadFull(f, header); err == nil && bytes.Equal(header, metadataMagic) {
+		if cfg.metadataCipher == nil {
+			return nil, offset, false, fmt.Errorf("metadata is encrypted, but no encryption key is configured")
+		}
+
+		return cfg.metadataCipher.open(f, metadataRecordName(path), offset)
+	}
+
+	// clear text
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, offset, false, err
+	}
+
+	content, err := io.ReadAll(f)
+	if err != nil {
+		return nil, offset, false, err
+	}
+
+	return content, offset + int64(len(content)), true, nil
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-idp/agent/client"
+	"github.com/go-idp/agent/entities"
+)
+
+func newTestMetadataEncryptionKey(t *testing.T) string {
+	t.Helper()
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func TestReadCommandLogChunk_Encrypted(t *testing.T) {
+	cfg := &Config{MetadataDir: t.TempDir(), MetadataEncryptionKey: newTestMetadataEncryptionKey(t)}
+	if err := cfg.loadMetadataCipher(); err != nil {
+		t.Fatalf("failed to load metadata cipher: %v", err)
+	}
+
+	commandID := "cmd-encrypted"
+	cmdCfg, err := cfg.GetCommandConfig(commandID, &entities.Command{})
+	if err != nil {
+		t.Fatalf("failed to get command config: %v", err)
+	}
+	for _, chunk := range []string{"abc", "def", "ghi"} {
+		cmdCfg.Log.Write([]byte(chunk))
+	}
+
+	raw, _ := os.ReadFile(cmdCfg.Log.Path)
+	if bytes.Contains(raw, []byte("abc")) {
+		t.Fatalf("expected log to be encrypted, got %q", raw)
+	}
+
+	got, err := readCommandLog(cfg, commandID)
+	if err != nil || got != "abcdefghi" {
+		t.Fatalf("unexpected log: %q, err=%v", got, err)
+	}
+
+	// offset in the middle of record
+	chunk, offset, err := readCommandLogChunk(cfg, commandID, 4)
+	if err != nil || chunk != "efghi" || offset != 9 {
+		t.Fatalf("unexpected chunk: %q, offset=%d, err=%v", chunk, offset, err)
+	}
+
+	// the incomplete record being written is left for next read
+	record, err := cfg.metadataCipher.seal(metadataRecordName(cmdCfg.Log.Path), cmdCfg.Log.seq, false, []byte("jkl"))
+	if err != nil {
+		t.Fatalf("failed to seal: %v", err)
+	}
+	cmdCfg.Log.seq++
+	f, _ := os.OpenFile(cmdCfg.Log.Path, os.O_APPEND|os.O_WRONLY, 0o644)
+	f.Write(record[:len(record)-2])
+	f.Close()
+	if chunk, offset, err = readCommandLogChunk(cfg, commandID, offset); err != nil || chunk != "" || offset != 9 {
+		t.Fatalf("expected incomplete record to be skipped, got %q, offset=%d, err=%v", chunk, offset, err)
+	}
+
+	f, _ = os.OpenFile(cmdCfg.Log.Path, os.O_APPEND|os.O_WRONLY, 0o644)
+	f.Write(record[len(record)-2:])
+	f.Close()
+	if chunk, offset, err = readCommandLogChunk(cfg, commandID, offset); err != nil || chunk != "jkl" || offset != 12 {
+		t.Fatalf("unexpected chunk: %q, offset=%d, err=%v", chunk, offset, err)
+	}
+
+	// the log being written is not complete until it is closed
+	if _, err := readCompleteMetadata(cfg, cmdCfg.Log.Path); err != errMetadataTruncated {
+		t.Fatalf("expected log being written to be incomplete, got %v", err)
+	}
+	cmdCfg.Log.Close()
+	if content, err := readCompleteMetadata(cfg, cmdCfg.Log.Path); err != nil || string(content) != "abcdefghijkl" {
+		t.Fatalf("unexpected log closed: %q, err=%v", content, err)
+	}
+	if chunk, offset, err = readCommandLogChunk(cfg, commandID, offset); err != nil || chunk != "" || offset != 12 {
+		t.Fatalf("expected nothing after final record, got %q, offset=%d, err=%v", chunk, offset, err)
+	}
+
+	// encrypted log without key
+	if _, err := readCommandLog(&Config{MetadataDir: cfg.MetadataDir}, commandID); err == nil {
+		t.Fatalf("expected reading encrypted log without key to fail")
+	}
+	// wrong key
+	other := &Config{MetadataDir: cfg.MetadataDir, MetadataEncryptionKey: newTestMetadataEncryptionKey(t)}
+	other.loadMetadataCipher()
+	if _, err := readCommandLog(other, commandID); err == nil {
+		t.Fatalf("expected reading encrypted log with wrong key to fail")
+	}
+}
+
+// splitMetadataRecords splits the encrypted metadata file into its magic header and records
+func splitMetadataRecords(t *testing.T, cfg *Config, raw []byte) [][]byte {
+	t.Helper()
+
+	parts := [][]byte{raw[:len(metadataMagic)]}
+	for rest := raw[len(metadataMagic):]; len(rest) > 0; {
+		size := 4 + cfg.metadataCipher.aead.NonceSize() + int(binary.BigEndian.Uint32(rest[:4]))
+		parts = append(parts, rest[:size])
+		rest = rest[size:]
+	}
+
+	return parts
+}
+
+func TestMetadataCipher_RejectsTamperedRecords(t *testing.T) {
+	cfg := &Config{MetadataDir: t.TempDir(), MetadataEncryptionKey: newTestMetadataEncryptionKey(t)}
+	if err := cfg.loadMetadataCipher(); err != nil {
+		t.Fatalf("failed to load metadata cipher: %v", err)
+	}
+
+	a, _ := cfg.GetCommandConfig("cmd-a", &entities.Command{})
+	b, _ := cfg.GetCommandConfig("cmd-b", &entities.Command{})
+	a.Script.WriteString("echo a")
+	b.Script.WriteString("echo b")
+	for _, chunk := range []string{"abc", "def", "ghi"} {
+		a.Log.Write([]byte(chunk))
+	}
+	a.Log.Close()
+
+	// records moved to another file
+	raw, _ := os.ReadFile(a.Script.Path)
+	os.WriteFile(b.Script.Path, raw, 0o644)
+	if _, err := readCompleteMetadata(cfg, b.Script.Path); err == nil {
+		t.Fatalf("expected script of another command to be rejected")
+	}
+	os.WriteFile(filepath.Join(a.MetadataDir, "env"), raw, 0o644)
+	if _, err := readCompleteMetadata(cfg, filepath.Join(a.MetadataDir, "env")); err == nil {
+		t.Fatalf("expected script moved to env to be rejected")
+	}
+
+	raw, _ = os.ReadFile(a.Log.Path)
+	records := splitMetadataRecords(t, cfg, raw)
+	if len(records) != 5 {
+		t.Fatalf("expected magic, 3 records and final record, got %d parts", len(records))
+	}
+	cases := map[string][][]byte{
+		"reordered":        {records[0], records[2], records[1], records[3], records[4]},
+		"dropped":          {records[0], records[1], records[3], records[4]},
+		"after final":      {records[0], records[1], records[2], records[3], records[4], records[3]},
+		"truncated record": {records[0], records[1], records[2], records[3][:len(records[3])-1]},
+	}
+	for name, parts := range cases {
+		os.WriteFile(a.Log.Path, bytes.Join(parts, nil), 0o644)
+		if _, err := readCompleteMetadata(cfg, a.Log.Path); err == nil {
+			t.Fatalf("expected log %s to be rejected", name)
+		}
+	}
+
+	// the final record cut is detected by complete read, the running log is read as it is
+	os.WriteFile(a.Log.Path, bytes.Join(records[:4], nil), 0o644)
+	if _, err := readCompleteMetadata(cfg, a.Log.Path); err != errMetadataTruncated {
+		t.Fatalf("expected log truncated to be rejected, got %v", err)
+	}
+	if got, err := readCommandLog(cfg, "cmd-a"); err != nil || got != "abcdefghi" {
+		t.Fatalf("unexpected log: %q, err=%v", got, err)
+	}
+
+	// empty content is completed by the final record only
+	b.Env.WriteString("")
+	if content, err := readCompleteMetadata(cfg, b.Env.Path); err != nil || len(content) != 0 {
+		t.Fatalf("unexpected empty env: %q, err=%v", content, err)
+	}
+}
+
+func TestLoadMetadataCipher_InvalidKey(t *testing.T) {
+	for _, key := range []string{"not base64!", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if err := (&Config{MetadataEncryptionKey: key}).loadMetadataCipher(); err == nil {
+			t.Fatalf("expected key %q to be invalid", key)
+		}
+	}
+}
+
+func TestWsService_EncryptsMetadata(t *testing.T) {
+	cfg := &Config{MetadataEncryptionKey: newTestMetadataEncryptionKey(t)}
+	if err := cfg.loadMetadataCipher(); err != nil {
+		t.Fatalf("failed to load metadata cipher: %v", err)
+	}
+	addr := newTestWsServer(t, cfg)
+
+	c := client.New(&client.Config{
+		Server: addr,
+		Stdout: io.Discard,
+		Stderr: io.Discard,
+	})
+	if err := c.Connect(); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+
+	id := fmt.Sprintf("cmd-encrypted-%d", time.Now().UnixNano())
+	if err := c.Exec(&entities.Command{
+		ID:          id,
+		Script:      "echo hello-$NAME",
+		Environment: map[string]string{"NAME": "agent"},
+	}); err != nil {
+		t.Fatalf("failed to exec: %v", err)
+	}
+
+	dir := filepath.Join(cfg.MetadataDir, id)
+	for name, plaintext := range map[string]string{"script": "echo hello", "env": "NAME=agent", "log": "hello-agent"} {
+		raw, _ := os.ReadFile(filepath.Join(dir, name))
+		if !bytes.HasPrefix(raw, metadataMagic) || strings.Contains(string(raw), plaintext) {
+			t.Fatalf("expected %s to be encrypted, got %q", name, raw)
+		}
+	}
+
+	if got, err := readCommandLog(cfg, id); err != nil || got != "hello-agent\n" {
+		t.Fatalf("unexpected log: %q, err=%v", got, err)
+	}
+
+	dc, err := restoreCommand(cfg, dir, id)
+	if err != nil {
+		t.Fatalf("failed to restore command: %v", err)
+	}
+	if dc.Cmd.Script != "echo hello-$NAME" || dc.Cmd.Environment["NAME"] != "agent" {
+		t.Fatalf("unexpected restored command: %+v", dc.Cmd)
+	}
+}
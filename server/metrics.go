@@ -0,0 +1,199 @@
+package server
+
+import (
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	dcommand "github.com/go-idp/agent/server/data/command"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "agent"
+
+// auth failure reasons
+const (
+	authFailureMissingCredentials = "missing_credentials"
+	authFailureInvalidCredentials = "invalid_credentials"
+	authFailureServiceUnavailable = "auth_service_unavailable"
+	authFailureServiceRejected    = "auth_service_rejected"
+	authFailureTimeout            = "timeout"
+	authFailureNotAuthenticated   = "not_authenticated"
+	authFailureExpired            = "expired"
+)
+
+// metrics are registered to the default registry, which is served by middleware.Prometheus
+var (
+	metricCommandsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "commands_total",
+		Help:      "Total number of commands created.",
+	}, []string{"engine", "user"})
+	metricCommandsRunning = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "commands_running",
+		Help:      "Number of commands running.",
+	}, []string{"engine", "user"})
+	metricCommandsQueued = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "commands_queued",
+		Help:      "Number of commands waiting in queue.",
+	})
+	metricCommandsCompleted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "commands_completed_total",
+		Help:      "Total number of commands completed.",
+	}, []string{"engine", "user"})
+	metricCommandsCancelled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "commands_cancelled_total",
+		Help:      "Total number of commands cancelled.",
+	}, []string{"engine", "user"})
+	metricCommandsError = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "commands_error_total",
+		Help:      "Total number of commands failed.",
+	}, []string{"engine", "user"})
+	metricCommandDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "command_duration_seconds",
+		Help:      "Wall time of commands run.",
+		Buckets:   []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 1800, 3600},
+	}, []string{"engine", "user"})
+	metricCommandExitCodes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "command_exit_codes_total",
+		Help:      "Total number of commands exited, by exit code.",
+	}, []string{"engine", "user", "code"})
+	metricWebSocketConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "websocket_connections",
+		Help:      "Number of websocket connections active.",
+	})
+	metricAuthFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "auth_failures_total",
+		Help:      "Total number of authentication failures, by reason.",
+	}, []string{"reason"})
+	metricUploadBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "upload_bytes_total",
+		Help:      "Total bytes of files uploaded.",
+	})
+	metricLogStreamSubscribers = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "log_stream_subscribers",
+		Help:      "Number of clients following command logs.",
+	})
+)
+
+// trackCommand counts the command, and updates the state and metrics by its events
+func trackCommand(dc *dcommand.Command) {
+	engine, user := commandLabels(dc)
+
+	// events are handled asynchronously and may be out of order, error may also be emitted without run,
+	//	so running is increased by the first of run, and decreased by the end only if increased.
+	var phase atomic.Int32
+	stopRunning := func() {
+		if phase.Swap(2) == 1 {
+			state.Command.Running.Dec(1)
+			metricCommandsRunning.WithLabelValues(engine, user).Dec()
+		}
+	}
+
+	dc.On("error", func(payload any) {
+		stopRunning()
+		state.Command.Error.Inc(1)
+		metricCommandsError.WithLabelValues(engine, user).Inc()
+	})
+	dc.On("run", func(payload any) {
+		if phase.CompareAndSwap(0, 1) {
+			state.Command.Running.Inc(1)
+			metricCommandsRunning.WithLabelValues(engine, user).Inc()
+		}
+	})
+	dc.On("cancel", func(payload any) {
+		stopRunning()
+		state.Command.Cancelled.Inc(1)
+		metricCommandsCancelled.WithLabelValues(engine, user).Inc()
+	})
+	dc.On("complete", func(payload any) {
+		stopRunning()
+		state.Command.Completed.Inc(1)
+		metricCommandsCompleted.WithLabelValues(engine, user).Inc()
+	})
+
+	state.Command.Total.Inc(1)
+	metricCommandsTotal.WithLabelValues(engine, user).Inc()
+}
+
+// observeCommandExit records the exit code and duration of command
+func observeCommandExit(dc *dcommand.Command, code int) {
+	if dc == nil {
+		return
+	}
+
+	engine, user := commandLabels(dc)
+	metricCommandExitCodes.WithLabelValues(engine, user, strconv.Itoa(code)).Inc()
+
+	// usage is absent if command failed to start
+	if state := dc.Snapshot(); state != nil && state.Usage != nil {
+		duration := time.Duration(state.Usage.WallTime) * time.Millisecond
+		metricCommandDuration.WithLabelValues(engine, user).Observe(duration.Seconds())
+	}
+}
+
+// maxMetricUsers is the max number of callers labeled by name, the others are labeled as metricLabelOther
+const maxMetricUsers = 100
+
+// metricLabelOther is the label of callers beyond maxMetricUsers, and of engines unknown
+const metricLabelOther = "other"
+
+// metricEngines are the engines labeled by name, the others are labeled as metricLabelOther
+var metricEngines = []string{"host", "docker", "caas", "dind", "ssh"}
+
+// metricUsers are the caller names labeled, bounded by maxMetricUsers
+var metricUsers = &metricUserSet{names: map[string]bool{}}
+
+type metricUserSet struct {
+	sync.Mutex
+	names map[string]bool
+}
+
+// label returns the label of caller name, the names beyond maxMetricUsers share one label
+func (s *metricUserSet) label(name string) string {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.names[name] {
+		return name
+	}
+	if len(s.names) >= maxMetricUsers {
+		return metricLabelOther
+	}
+
+	s.names[name] = true
+	return name
+}
+
+// commandLabels returns the engine and user labels of command, the user is the caller identity,
+//
+//	empty for anonymous, both are bounded so the series of metrics do not grow with requests.
+func commandLabels(dc *dcommand.Command) (engine, user string) {
+	engine = "host"
+	if dc.Cmd != nil && dc.Cmd.Engine != "" {
+		engine = dc.Cmd.Engine
+	}
+	if !slices.Contains(metricEngines, engine) {
+		engine = metricLabelOther
+	}
+
+	if dc.Caller == nil || dc.Caller.Name == "" {
+		return engine, ""
+	}
+
+	return engine, metricUsers.label(dc.Caller.Name)
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-idp/agent/entities"
+	dcommand "github.com/go-idp/agent/server/data/command"
+	"github.com/go-zoox/zoox/defaults"
+	"github.com/go-zoox/zoox/middleware"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics_CommandLifecycle(t *testing.T) {
+	cfg := &Config{MetadataDir: t.TempDir()}
+
+	total := testutil.ToFloat64(metricCommandsTotal.WithLabelValues("host", ""))
+	errors := testutil.ToFloat64(metricCommandsError.WithLabelValues("host", ""))
+	exitCodes := testutil.ToFloat64(metricCommandExitCodes.WithLabelValues("host", "", "3"))
+	running := testutil.ToFloat64(metricCommandsRunning.WithLabelValues("host", ""))
+
+	dc, err := dcommand.New(func(c *dcommand.Config) {
+		c.ID = "cmd-metrics"
+		c.Command = &entities.Command{
+			Script:      "exit 3",
+			WorkDirBase: t.TempDir(),
+		}
+	})
+	if err != nil {
+		t.Fatalf("failed to create command: %v", err)
+	}
+	trackCommand(dc)
+
+	stream := newCommandStream(cfg, dc, io.Discard)
+	dc.SetStdout(stream.Stdout())
+	dc.SetStderr(stream.Stderr())
+
+	err = dc.Run()
+	stream.Exit(exitCodeOf(dc, err), exitReasonOf(dc, err))
+
+	if got := testutil.ToFloat64(metricCommandsTotal.WithLabelValues("host", "")); got != total+1 {
+		t.Fatalf("expected commands total %v, got %v", total+1, got)
+	}
+	if got := testutil.ToFloat64(metricCommandExitCodes.WithLabelValues("host", "", "3")); got != exitCodes+1 {
+		t.Fatalf("expected exit code 3 count %v, got %v", exitCodes+1, got)
+	}
+
+	// command events are handled asynchronously
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		gotErrors := testutil.ToFloat64(metricCommandsError.WithLabelValues("host", ""))
+		gotRunning := testutil.ToFloat64(metricCommandsRunning.WithLabelValues("host", ""))
+		if gotErrors == errors+1 && gotRunning == running {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected commands error %v and running %v, got %v and %v", errors+1, running, gotErrors, gotRunning)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestMetrics_CommandLabels(t *testing.T) {
+	original := metricUsers
+	metricUsers = &metricUserSet{names: map[string]bool{}}
+	t.Cleanup(func() {
+		metricUsers = original
+	})
+
+	cases := []struct {
+		cmd    *entities.Command
+		caller *dcommand.Caller
+		engine string
+		user   string
+	}{
+		{&entities.Command{User: "root"}, nil, "host", ""},
+		{&entities.Command{User: "root"}, &dcommand.Caller{Name: "alice"}, "host", "alice"},
+		{&entities.Command{Engine: "docker"}, &dcommand.Caller{Name: "bob"}, "docker", "bob"},
+		{&entities.Command{Engine: "unknown-engine"}, &dcommand.Caller{Name: "bob"}, metricLabelOther, "bob"},
+	}
+	for _, c := range cases {
+		engine, user := commandLabels(&dcommand.Command{Cmd: c.cmd, Caller: c.caller})
+		if engine != c.engine || user != c.user {
+			t.Fatalf("expected labels (%s, %s), got (%s, %s)", c.engine, c.user, engine, user)
+		}
+	}
+
+	// the callers beyond the limit share one label
+	for i := 0; i < maxMetricUsers; i++ {
+		metricUsers.label(fmt.Sprintf("caller-%d", i))
+	}
+	if _, user := commandLabels(&dcommand.Command{Cmd: &entities.Command{}, Caller: &dcommand.Caller{Name: "late"}}); user != metricLabelOther {
+		t.Fatalf("expected caller beyond limit to be labeled %s, got %s", metricLabelOther, user)
+	}
+	if _, user := commandLabels(&dcommand.Command{Cmd: &entities.Command{}, Caller: &dcommand.Caller{Name: "alice"}}); user != "alice" {
+		t.Fatalf("expected caller labeled before to keep its label, got %s", user)
+	}
+}
+
+func TestMetrics_Endpoint(t *testing.T) {
+	metricAuthFailures.WithLabelValues(authFailureInvalidCredentials).Inc()
+	metricUploadBytes.Add(3)
+
+	app := defaults.Application()
+	app.Use(middleware.Prometheus())
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	resp := httptest.NewRecorder()
+	app.ServeHTTP(resp, req)
+
+	if resp.Code != 200 {
+		t.Fatalf("expected status 200, got %d", resp.Code)
+	}
+
+	body := resp.Body.String()
+	for _, name := range []string{
+		`agent_auth_failures_total{reason="invalid_credentials"}`,
+		"agent_upload_bytes_total",
+		"agent_websocket_connections",
+		"agent_log_stream_subscribers",
+	} {
+		if !strings.Contains(body, name) {
+			t.Fatalf("expected metric %s in response", name)
+		}
+	}
+}
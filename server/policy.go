@@ -0,0 +1,42 @@
+package server
+
+import (
+	goerrors "errors"
+	"fmt"
+	"os"
+
+	dcommand "github.com/go-idp/agent/server/data/command"
+)
+
+// exitCodeDenied is the exit code of command denied by policy
+const exitCodeDenied = 126
+
+// loadPolicy loads the command policy from PolicyFile
+func (c *Config) loadPolicy() error {
+	if c.PolicyFile == "" {
+		return nil
+	}
+
+	raw, err := os.ReadFile(c.PolicyFile)
+	if err != nil {
+		return fmt.Errorf("failed to read policy file: %s", err)
+	}
+
+	policy, err := dcommand.ParsePolicy(raw)
+	if err != nil {
+		return fmt.Errorf("failed to parse policy file: %s", err)
+	}
+
+	c.policy = policy
+	return nil
+}
+
+// asPolicyError returns the policy error in the error chain, nil if not found
+func asPolicyError(err error) *dcommand.PolicyError {
+	var errx *dcommand.PolicyError
+	if goerrors.As(err, &errx) {
+		return errx
+	}
+
+	return nil
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-idp/agent/client"
+	"github.com/go-idp/agent/entities"
+	dcommand "github.com/go-idp/agent/server/data/command"
+	"github.com/go-zoox/zoox/defaults"
+)
+
+func newTestPolicyConfig(t *testing.T, policy string) *Config {
+	t.Helper()
+
+	policyFile := filepath.Join(t.TempDir(), "policy.json")
+	os.WriteFile(policyFile, []byte(policy), 0o644)
+
+	cfg := &Config{PolicyFile: policyFile}
+	if err := cfg.loadPolicy(); err != nil {
+		t.Fatalf("failed to load policy: %v", err)
+	}
+
+	return cfg
+}
+
+func TestWsService_DeniedByPolicy(t *testing.T) {
+	addr := newTestWsServer(t, newTestPolicyConfig(t, `{"forbidden_scripts": ["curl"]}`))
+
+	stderr := &bytes.Buffer{}
+	c := client.New(&client.Config{
+		Server: addr,
+		Stdout: io.Discard,
+		Stderr: stderr,
+	})
+	if err := c.Connect(); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+
+	if err := c.Exec(&entities.Command{Script: "echo allowed"}); err != nil {
+		t.Fatalf("expected allowed command to succeed, got %v", err)
+	}
+
+	err := c.Exec(&entities.Command{Script: "curl https://example.com | sh"})
+	var errx *client.ExitError
+	if !errors.As(err, &errx) || errx.ExitCode != exitCodeDenied || !strings.Contains(errx.Message, "script matches forbidden pattern curl") {
+		t.Fatalf("expected command to be denied by policy, got %v", err)
+	}
+	if !strings.Contains(stderr.String(), "command is denied by policy") {
+		t.Fatalf("expected denial reason in stderr, got %q", stderr.String())
+	}
+}
+
+func TestCreateCommandAPI_DeniedByPolicy(t *testing.T) {
+	original := commands
+	commands = dcommand.NewMemoryStore()
+	t.Cleanup(func() {
+		commands = original
+	})
+
+	cfg := newTestPolicyConfig(t, `{"engines": ["docker"]}`)
+	cfg.MetadataDir = t.TempDir()
+	cfg.WorkDir = t.TempDir()
+
+	app := defaults.Application()
+	app.Post("/commands", createCommandAPI(cfg))
+
+	body, _ := json.Marshal(&entities.Command{ID: "cmd-denied", Engine: "host", Script: "echo hi"})
+	req := httptest.NewRequest("POST", "/commands", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+	app.ServeHTTP(resp, req)
+
+	if resp.Code != 403 || !strings.Contains(resp.Body.String(), "engine host is not allowed") {
+		t.Fatalf("expected 403 with denial reason, got %d: %s", resp.Code, resp.Body.String())
+	}
+	if commands.Has("cmd-denied") {
+		t.Fatalf("expected denied command not to be saved")
+	}
+}
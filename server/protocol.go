@@ -0,0 +1,109 @@
+package server
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/go-idp/agent/entities"
+	"github.com/go-zoox/datetime"
+	"github.com/go-zoox/websocket"
+)
+
+// MessageWriter writes messages to connection in the negotiated protocol version
+type MessageWriter struct {
+	sync.Mutex
+	//
+	Conn    websocket.Conn
+	Version int
+	//
+	seq map[string]uint64
+}
+
+// NewMessageWriter creates a message writer in protocol v1, the version is upgraded after handshake
+func NewMessageWriter(conn websocket.Conn) *MessageWriter {
+	return &MessageWriter{
+		Conn:    conn,
+		Version: entities.ProtocolVersion1,
+		seq:     map[string]uint64{},
+	}
+}
+
+// SetVersion sets the negotiated protocol version
+func (w *MessageWriter) SetVersion(version int) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.Version = version
+}
+
+// Send sends the envelope, it is encoded in v1 framing for v1 connection
+func (w *MessageWriter) Send(env *entities.Envelope) error {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.Version < entities.ProtocolVersion2 {
+		msg, err := env.Message()
+		if err != nil {
+			return err
+		}
+
+		return w.Conn.WriteTextMessage(msg)
+	}
+
+	w.seq[env.CommandID]++
+	env.Seq = w.seq[env.CommandID]
+	env.Timestamp = datetime.Now().UnixMilli()
+
+	msg, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+
+	return w.Conn.WriteTextMessage(msg)
+}
+
+// Stdout sends stdout of command
+func (w *MessageWriter) Stdout(id string, p []byte) error {
+	return w.Send(&entities.Envelope{Type: entities.EnvelopeTypeOutput, CommandID: id, Stream: entities.StreamStdout, Data: p})
+}
+
+// Stderr sends stderr of command
+func (w *MessageWriter) Stderr(id string, p []byte) error {
+	return w.Send(&entities.Envelope{Type: entities.EnvelopeTypeOutput, CommandID: id, Stream: entities.StreamStderr, Data: p})
+}
+
+// Exit sends exit code of command, with reason if it is not exited normally
+func (w *MessageWriter) Exit(id string, code int, reason string) error {
+	return w.Send(&entities.Envelope{Type: entities.EnvelopeTypeExit, CommandID: id, ExitCode: code, Reason: reason})
+}
+
+// Queued sends the position of command in queue, it is not sent to v1 connection
+func (w *MessageWriter) Queued(id string, position int) error {
+	w.Lock()
+	version := w.Version
+	w.Unlock()
+
+	if version < entities.ProtocolVersion2 {
+		return nil
+	}
+
+	return w.Send(&entities.Envelope{Type: entities.EnvelopeTypeQueued, CommandID: id, Position: position})
+}
+
+// Fail sends the error message to stderr, and exits with code 1
+func (w *MessageWriter) Fail(id string, reason string) error {
+	if err := w.Stderr(id, []byte(reason+"\n")); err != nil {
+		return err
+	}
+
+	return w.Exit(id, 1, reason)
+}
+
+// negotiateVersion returns the protocol version both sides support
+func negotiateVersion(clientVersion int) int {
+	if clientVersion < entities.ProtocolVersion1 {
+		return entities.ProtocolVersion1
+	}
+
+	return min(clientVersion, entities.ProtocolVersion)
+}
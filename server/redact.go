@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/go-idp/agent/entities"
+)
+
+// redactWriter masks the secrets in output before writing,
+//
+//	the tail which may be the beginning of a secret is held until the next write or flush,
+//	so the secret split across writes is masked too.
+type redactWriter struct {
+	sync.Mutex
+	w       io.Writer
+	secrets [][]byte
+	pending []byte
+}
+
+func newRedactWriter(w io.Writer, secrets map[string]string) *redactWriter {
+	r := &redactWriter{w: w}
+	for _, v := range secrets {
+		if v != "" {
+			r.secrets = append(r.secrets, []byte(v))
+		}
+	}
+
+	// the longer secret first, which may contain the shorter one
+	sort.Slice(r.secrets, func(i, j int) bool {
+		return len(r.secrets[i]) > len(r.secrets[j])
+	})
+
+	return r
+}
+
+func (r *redactWriter) Write(p []byte) (n int, err error) {
+	if len(r.secrets) == 0 {
+		return r.w.Write(p)
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	buf := append(r.pending, p...)
+	i := r.cut(buf)
+	r.pending = append([]byte{}, buf[i:]...)
+	if i > 0 {
+		if _, err := r.w.Write(r.redact(buf[:i])); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// Flush writes the tail held, as the output ends
+func (r *redactWriter) Flush() error {
+	r.Lock()
+	defer r.Unlock()
+
+	if len(r.pending) == 0 {
+		return nil
+	}
+
+	_, err := r.w.Write(r.redact(r.pending))
+	r.pending = nil
+	return err
+}
+
+func (r *redactWriter) redact(p []byte) []byte {
+	for _, secret := range r.secrets {
+		p = bytes.ReplaceAll(p, secret, []byte(entities.SecretMask))
+	}
+
+	return p
+}
+
+// cut returns where the output is safe to write before,
+//
+//	the tail which may be the beginning of a secret, or a secret across it, is held.
+func (r *redactWriter) cut(buf []byte) int {
+	i := len(buf)
+	for _, secret := range r.secrets {
+		for k := min(len(secret)-1, len(buf)); k > 0; k-- {
+			if bytes.HasSuffix(buf, secret[:k]) {
+				i = min(i, len(buf)-k)
+				break
+			}
+		}
+	}
+
+	for isChanged := true; isChanged; {
+		isChanged = false
+		for _, secret := range r.secrets {
+			for start := max(0, i-len(secret)+1); start < i; start++ {
+				if bytes.HasPrefix(buf[start:], secret) && start+len(secret) > i {
+					i = start
+					isChanged = true
+					break
+				}
+			}
+		}
+	}
+
+	return i
+}
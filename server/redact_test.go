@@ -0,0 +1,91 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-idp/agent/client"
+	"github.com/go-idp/agent/entities"
+)
+
+func TestRedactWriter(t *testing.T) {
+	out := &bytes.Buffer{}
+	w := newRedactWriter(out, map[string]string{"TOKEN": "s3cr3t", "SHORT": "s3", "EMPTY": ""})
+
+	// the secret is split across writes
+	for _, chunk := range []string{"token=s3c", "r3t\n", "short=s3\n", "tail=s3c"} {
+		w.Write([]byte(chunk))
+	}
+	if out.String() != "token=******\nshort=******\ntail=" {
+		t.Fatalf("unexpected output before flush: %q", out.String())
+	}
+
+	// the tail is written as the output ends, "s3" is a secret too
+	w.Flush()
+	if out.String() != "token=******\nshort=******\ntail=******c" {
+		t.Fatalf("unexpected output after flush: %q", out.String())
+	}
+}
+
+func TestRedactWriter_NoSecrets(t *testing.T) {
+	out := &bytes.Buffer{}
+	w := newRedactWriter(out, nil)
+
+	w.Write([]byte("s3c"))
+	if out.String() != "s3c" {
+		t.Fatalf("expected output to pass through, got %q", out.String())
+	}
+}
+
+func TestWsService_MasksSecrets(t *testing.T) {
+	cfg := &Config{}
+	addr := newTestWsServer(t, cfg)
+
+	stdout := &bytes.Buffer{}
+	c := client.New(&client.Config{
+		Server: addr,
+		Stdout: stdout,
+		Stderr: io.Discard,
+	})
+	if err := c.Connect(); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+
+	id := fmt.Sprintf("cmd-secret-%d", time.Now().UnixNano())
+	if err := c.Exec(&entities.Command{
+		ID:          id,
+		Script:      "echo token=$TOKEN",
+		Environment: map[string]string{"NAME": "agent"},
+		Secrets:     map[string]string{"TOKEN": "s3cr3t"},
+	}); err != nil {
+		t.Fatalf("failed to exec: %v", err)
+	}
+
+	if stdout.String() != "token=******\n" {
+		t.Fatalf("expected secret to be masked in stdout, got %q", stdout.String())
+	}
+
+	for _, name := range []string{"log", "env", "script"} {
+		content, _ := os.ReadFile(filepath.Join(cfg.MetadataDir, id, name))
+		if strings.Contains(string(content), "s3cr3t") {
+			t.Fatalf("expected secret not to be persisted in %s, got %q", name, string(content))
+		}
+	}
+
+	dc := commands.Get(id)
+	if dc == nil {
+		t.Fatalf("expected command %s to be saved", id)
+	}
+	encoded, _ := json.Marshal(dc)
+	if strings.Contains(string(encoded), "s3cr3t") || !strings.Contains(string(encoded), entities.SecretMask) {
+		t.Fatalf("expected secret to be masked in command, got %s", string(encoded))
+	}
+}
@@ -0,0 +1,408 @@
+package server
+
+import (
+	"errors"
+	"slices"
+	"sort"
+	"sync"
+
+	dcommand "github.com/go-idp/agent/server/data/command"
+)
+
+// ErrQueueFull is the error of command rejected when the queue is full
+var ErrQueueFull = errors.New("too many commands: queue is full")
+
+// errTicketCancelled is the error of ticket cancelled while waiting
+var errTicketCancelled = errors.New("command is cancelled while queued")
+
+// commandScheduler limits the commands running concurrently, it is replaced by config when server runs
+var commandScheduler = newScheduler(0, 0)
+
+// scheduler admits the commands to run, at most maxConcurrent commands run at once,
+//
+//	the others wait in a queue of at most maxQueued, 0 means unlimited.
+//	The command of higher priority runs first, the commands of same priority are shared fairly between principals
+//	by their running commands per weight, and run in FIFO order of one principal.
+type scheduler struct {
+	sync.Mutex
+	//
+	maxConcurrent int
+	maxQueued     int
+	//
+	running    int
+	queue      []*ticket
+	principals map[string]*principalState
+	// seq is the sequence of the last admission
+	seq uint64
+}
+
+// principalState is the commands of one principal in scheduler
+type principalState struct {
+	Weight  int `json:"weight"`
+	Running int `json:"running"`
+	Queued  int `json:"queued"`
+}
+
+// SchedulerState is the state of scheduler
+type SchedulerState struct {
+	MaxConcurrent int                        `json:"max_concurrent"`
+	MaxQueued     int                        `json:"max_queued"`
+	Running       int                        `json:"running"`
+	Queued        int                        `json:"queued"`
+	Principals    map[string]*principalState `json:"principals"`
+}
+
+// admission is the request of command to run
+type admission struct {
+	ID string
+	// Owner is the principal of command
+	Owner string
+	// Weight is the share of owner, default: 1
+	Weight int
+	// Priority is the priority of command, higher runs first
+	Priority int
+}
+
+// ticket is the admission of command, it runs when ready is closed
+type ticket struct {
+	*admission
+	s *scheduler
+	//
+	ready   chan struct{}
+	changed chan struct{}
+	//
+	cancelled  chan struct{}
+	cancelOnce sync.Once
+	//
+	seq uint64
+	// position is the position in queue, starts from 1, 0 means running, updated on notify
+	position   int
+	isRunning  bool
+	isReleased bool
+}
+
+func newScheduler(maxConcurrent, maxQueued int) *scheduler {
+	return &scheduler{
+		maxConcurrent: maxConcurrent,
+		maxQueued:     maxQueued,
+		principals:    map[string]*principalState{},
+	}
+}
+
+// Admit admits the command, it runs immediately if there is a free slot, or waits in queue,
+//
+//	returns ErrQueueFull if the queue is full.
+func (s *scheduler) Admit(a *admission) (*ticket, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if a.Weight <= 0 {
+		a.Weight = 1
+	}
+
+	s.seq++
+	t := &ticket{
+		admission: a,
+		s:         s,
+		seq:       s.seq,
+		ready:     make(chan struct{}),
+		changed:   make(chan struct{}, 1),
+		cancelled: make(chan struct{}),
+	}
+	// the weight of principal is updated by the latest command
+	s.principal(t).Weight = a.Weight
+
+	if s.maxConcurrent <= 0 || (s.running < s.maxConcurrent && len(s.queue) == 0) {
+		s.principal(t).Running++
+		s.running++
+		t.isRunning = true
+		close(t.ready)
+		return t, nil
+	}
+
+	if s.maxQueued > 0 && len(s.queue) >= s.maxQueued {
+		s.forget(a.Owner)
+		return nil, ErrQueueFull
+	}
+
+	s.principal(t).Queued++
+	s.queue = append(s.queue, t)
+	s.notify(s.order())
+	return t, nil
+}
+
+// State returns the commands running and queued, by principal
+func (s *scheduler) State() *SchedulerState {
+	s.Lock()
+	defer s.Unlock()
+
+	state := &SchedulerState{
+		MaxConcurrent: s.maxConcurrent,
+		MaxQueued:     s.maxQueued,
+		Running:       s.running,
+		Queued:        len(s.queue),
+		Principals:    map[string]*principalState{},
+	}
+	for name, p := range s.principals {
+		copied := *p
+		state.Principals[name] = &copied
+	}
+
+	return state
+}
+
+// principal returns the state of ticket owner, with lock held
+func (s *scheduler) principal(t *ticket) *principalState {
+	p, ok := s.principals[t.Owner]
+	if !ok {
+		p = &principalState{Weight: t.Weight}
+		s.principals[t.Owner] = p
+	}
+
+	return p
+}
+
+// forget removes the principal without commands, with lock held
+func (s *scheduler) forget(owner string) {
+	if p, ok := s.principals[owner]; ok && p.Running == 0 && p.Queued == 0 {
+		delete(s.principals, owner)
+	}
+}
+
+// order returns the queue in the order to run, with lock held
+//
+//	The commands of one principal run by priority then FIFO, so only the first ones of principals are compared.
+func (s *scheduler) order() []*ticket {
+	running := map[string]int{}
+	for name, p := range s.principals {
+		running[name] = p.Running
+	}
+
+	owners := []string{}
+	queues := map[string][]*ticket{}
+	for _, t := range s.queue {
+		if _, ok := queues[t.Owner]; !ok {
+			owners = append(owners, t.Owner)
+		}
+		queues[t.Owner] = append(queues[t.Owner], t)
+	}
+	for _, q := range queues {
+		sort.SliceStable(q, func(i, j int) bool {
+			return q[i].Priority > q[j].Priority
+		})
+	}
+
+	ordered := make([]*ticket, 0, len(s.queue))
+	for len(ordered) != len(s.queue) {
+		var best *ticket
+		for _, owner := range owners {
+			if q := queues[owner]; len(q) != 0 && (best == nil || q[0].isBefore(best, running)) {
+				best = q[0]
+			}
+		}
+
+		ordered = append(ordered, best)
+		running[best.Owner]++
+		queues[best.Owner] = queues[best.Owner][1:]
+	}
+
+	return ordered
+}
+
+// isBefore returns true if the ticket runs before other, the earlier one wins the tie
+func (t *ticket) isBefore(other *ticket, running map[string]int) bool {
+	if t.Priority != other.Priority {
+		return t.Priority > other.Priority
+	}
+
+	// running per weight of principal, compared without division
+	weight, otherWeight := t.s.principals[t.Owner].Weight, t.s.principals[other.Owner].Weight
+	if left, right := running[t.Owner]*otherWeight, running[other.Owner]*weight; left != right {
+		return left < right
+	}
+
+	return t.seq < other.seq
+}
+
+// dispatch runs the commands in order while there are free slots, with lock held
+func (s *scheduler) dispatch() {
+	if len(s.queue) == 0 || s.running >= s.maxConcurrent {
+		return
+	}
+
+	ordered := s.order()
+	for len(ordered) != 0 && s.running < s.maxConcurrent {
+		t := ordered[0]
+		ordered = ordered[1:]
+
+		s.remove(t)
+		p := s.principal(t)
+		p.Queued--
+		p.Running++
+		s.running++
+		t.isRunning = true
+		t.position = 0
+		close(t.ready)
+	}
+
+	s.notify(ordered)
+}
+
+// remove removes the ticket from queue, with lock held
+func (s *scheduler) remove(t *ticket) bool {
+	for i, q := range s.queue {
+		if q == t {
+			s.queue = append(s.queue[:i:i], s.queue[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// notify gives the tickets in queue their positions by the order to run, and tells the moved ones, with lock held
+func (s *scheduler) notify(ordered []*ticket) {
+	metricCommandsQueued.Set(float64(len(s.queue)))
+
+	for i, t := range ordered {
+		if t.position == i+1 {
+			continue
+		}
+
+		t.position = i + 1
+		select {
+		case t.changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Position returns the position of ticket in queue, starts from 1, 0 means running
+func (t *ticket) Position() int {
+	t.s.Lock()
+	defer t.s.Unlock()
+
+	return t.position
+}
+
+// Cancel stops waiting for the ticket to run
+func (t *ticket) Cancel() {
+	t.cancelOnce.Do(func() {
+		close(t.cancelled)
+	})
+}
+
+// Wait waits for the ticket to run, onPosition is called with the position when queued or moved,
+//
+//	returns errTicketCancelled if it is cancelled before running, the ticket is released then.
+func (t *ticket) Wait(onPosition func(position int)) error {
+	lastPosition := 0
+	report := func() {
+		if position := t.Position(); position != 0 && position != lastPosition {
+			lastPosition = position
+			if onPosition != nil {
+				onPosition(position)
+			}
+		}
+	}
+
+	report()
+	for {
+		select {
+		case <-t.ready:
+			return nil
+		case <-t.changed:
+			report()
+		case <-t.cancelled:
+			// it may be ready at the same time
+			if !t.dequeue() {
+				return nil
+			}
+
+			return errTicketCancelled
+		}
+	}
+}
+
+// dequeue removes the ticket from queue, returns false if it is not in queue
+func (t *ticket) dequeue() bool {
+	s := t.s
+	s.Lock()
+	defer s.Unlock()
+
+	if !s.remove(t) {
+		return false
+	}
+
+	t.isReleased = true
+	t.position = 0
+	s.principal(t).Queued--
+	s.forget(t.Owner)
+	s.notify(s.order())
+	return true
+}
+
+// Release frees the slot of ticket running, or removes it from queue
+func (t *ticket) Release() {
+	if t.dequeue() {
+		return
+	}
+
+	s := t.s
+	s.Lock()
+	defer s.Unlock()
+
+	if t.isRunning && !t.isReleased {
+		t.isReleased = true
+		s.principal(t).Running--
+		s.running--
+		s.forget(t.Owner)
+		s.dispatch()
+	}
+}
+
+// admitCommand admits the command by scheduler, the command waiting in queue is marked queued,
+//
+//	and stops waiting once cancelled.
+func admitCommand(dc *dcommand.Command) (*ticket, error) {
+	a := &admission{
+		ID:       dc.ID,
+		Priority: priorityOf(dc),
+	}
+	if dc.Caller != nil {
+		a.Owner = dc.Caller.Name
+		a.Weight = dc.Caller.Weight
+	}
+
+	t, err := commandScheduler.Admit(a)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.Position() != 0 {
+		dc.On("cancel", func(payload any) {
+			t.Cancel()
+		})
+		// cancelled before the cancel handler is registered
+		if !dc.Queue() {
+			t.Cancel()
+		}
+	}
+
+	return t, nil
+}
+
+// priorityOf returns the priority of command in scheduler, any caller may lower it,
+//
+//	but only admin raises it, or one caller would run before all the others.
+func priorityOf(dc *dcommand.Command) int {
+	if dc.Cmd.Priority <= 0 {
+		return dc.Cmd.Priority
+	}
+
+	if dc.Caller == nil || !(slices.Contains(dc.Caller.Scopes, ScopeAdmin) || slices.Contains(dc.Caller.Scopes, ScopeAll)) {
+		return 0
+	}
+
+	return dc.Cmd.Priority
+}
@@ -0,0 +1,316 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-idp/agent/client"
+	"github.com/go-idp/agent/entities"
+	dcommand "github.com/go-idp/agent/server/data/command"
+	"github.com/go-zoox/zoox/defaults"
+)
+
+func TestScheduler_QueueAndReject(t *testing.T) {
+	s := newScheduler(1, 2)
+
+	first, err := s.Admit(&admission{ID: "first"})
+	if err != nil || first.Position() != 0 {
+		t.Fatalf("expected first to run, got position %d, err=%v", first.Position(), err)
+	}
+
+	second, _ := s.Admit(&admission{ID: "second"})
+	third, _ := s.Admit(&admission{ID: "third"})
+	if second.Position() != 1 || third.Position() != 2 {
+		t.Fatalf("expected second and third to be queued, got %d, %d", second.Position(), third.Position())
+	}
+
+	if _, err := s.Admit(&admission{ID: "fourth"}); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("expected fourth to be rejected, got %v", err)
+	}
+
+	// the cancelled leaves the queue, the others move forward
+	positions := make(chan int, 4)
+	done := make(chan error, 1)
+	go func() {
+		done <- third.Wait(func(position int) {
+			positions <- position
+		})
+	}()
+	if p := <-positions; p != 2 {
+		t.Fatalf("expected third to be reported at 2, got %d", p)
+	}
+
+	second.Cancel()
+	if err := second.Wait(nil); !errors.Is(err, errTicketCancelled) {
+		t.Fatalf("expected second to be cancelled, got %v", err)
+	}
+	if p := <-positions; p != 1 {
+		t.Fatalf("expected third to move to 1, got %d", p)
+	}
+
+	first.Release()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expected third to run, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout waiting for third to run")
+	}
+
+	if state := s.State(); state.Running != 1 || state.Queued != 0 {
+		t.Fatalf("unexpected state: running=%d queued=%d", state.Running, state.Queued)
+	}
+
+	third.Release()
+	third.Release()
+	if state := s.State(); state.Running != 0 || len(state.Principals) != 0 {
+		t.Fatalf("expected release to be idempotent, got running=%d principals=%v", state.Running, state.Principals)
+	}
+}
+
+func TestScheduler_PriorityAndFairShare(t *testing.T) {
+	s := newScheduler(2, 0)
+
+	admit := func(id, owner string, weight, priority int) *ticket {
+		t.Helper()
+
+		ticket, err := s.Admit(&admission{ID: id, Owner: owner, Weight: weight, Priority: priority})
+		if err != nil {
+			t.Fatalf("failed to admit %s: %v", id, err)
+		}
+		return ticket
+	}
+
+	// team-a fans out, occupies all slots and queues more
+	running := []*ticket{admit("a-1", "team-a", 1, 0), admit("a-2", "team-a", 1, 0)}
+	fanout := []*ticket{admit("a-3", "team-a", 1, 0), admit("a-4", "team-a", 1, 0)}
+	// team-b comes later, it runs before the rest of team-a, which runs 2 already
+	b := admit("b-1", "team-b", 1, 0)
+	// the hotfix of higher priority runs first
+	hotfix := admit("a-hotfix", "team-a", 1, 10)
+
+	if got := strings.Join(orderOf(s), ","); got != "a-hotfix,b-1,a-3,a-4" {
+		t.Fatalf("unexpected order: %s", got)
+	}
+	if b.Position() != 2 || hotfix.Position() != 1 {
+		t.Fatalf("unexpected positions: hotfix=%d b=%d", hotfix.Position(), b.Position())
+	}
+
+	state := s.State()
+	if a := state.Principals["team-a"]; a.Running != 2 || a.Queued != 3 {
+		t.Fatalf("unexpected team-a state: %+v", a)
+	}
+	if b := state.Principals["team-b"]; b.Running != 0 || b.Queued != 1 {
+		t.Fatalf("unexpected team-b state: %+v", b)
+	}
+
+	running[0].Release()
+	running[1].Release()
+	for _, ticket := range []*ticket{hotfix, b} {
+		select {
+		case <-ticket.ready:
+		case <-time.After(time.Second):
+			t.Fatalf("expected %s to run", ticket.ID)
+		}
+	}
+	if fanout[0].Position() != 1 || fanout[1].Position() != 2 {
+		t.Fatalf("expected fan-out to wait, got %d, %d", fanout[0].Position(), fanout[1].Position())
+	}
+}
+
+func TestScheduler_Weight(t *testing.T) {
+	s := newScheduler(1, 0)
+
+	s.Admit(&admission{ID: "running", Owner: "other"})
+	for _, a := range []*admission{
+		{ID: "small-1", Owner: "small"},
+		{ID: "big-1", Owner: "big", Weight: 3},
+		{ID: "small-2", Owner: "small"},
+		{ID: "big-2", Owner: "big", Weight: 3},
+		{ID: "big-3", Owner: "big", Weight: 3},
+		{ID: "big-4", Owner: "big", Weight: 3},
+		{ID: "small-3", Owner: "small"},
+	} {
+		s.Admit(a)
+	}
+
+	// big is given 3 slots per slot of small
+	if got := strings.Join(orderOf(s), ","); got != "small-1,big-1,big-2,big-3,small-2,big-4,small-3" {
+		t.Fatalf("unexpected order: %s", got)
+	}
+}
+
+func TestWsService_QueuesCommands(t *testing.T) {
+	original := commandScheduler
+	commandScheduler = newScheduler(1, 1)
+	t.Cleanup(func() {
+		commandScheduler = original
+	})
+
+	addr := newTestWsServer(t, &Config{})
+	c := client.New(&client.Config{Server: addr, Stdout: io.Discard, Stderr: io.Discard})
+	if err := c.Connect(); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+
+	running, err := c.ExecAsync(&entities.Command{Script: "sleep 1"})
+	if err != nil {
+		t.Fatalf("failed to exec: %v", err)
+	}
+	waitForScheduler(t, 1, 0)
+
+	var mu sync.Mutex
+	positions := []int{}
+	queued, err := c.ExecAsync(&entities.Command{Script: "echo queued"}, func(opt *client.ExecOption) {
+		opt.OnQueued = func(position int) {
+			mu.Lock()
+			defer mu.Unlock()
+			positions = append(positions, position)
+		}
+	})
+	if err != nil {
+		t.Fatalf("failed to exec: %v", err)
+	}
+	waitForScheduler(t, 1, 1)
+
+	rejected, err := c.ExecAsync(&entities.Command{Script: "echo rejected"})
+	if err != nil {
+		t.Fatalf("failed to exec: %v", err)
+	}
+	var errx *client.ExitError
+	if err := rejected.Wait(); !errors.As(err, &errx) || !strings.Contains(errx.Message, "queue is full") {
+		t.Fatalf("expected command to be rejected, got %v", err)
+	}
+	if commands.Has(rejected.ID()) {
+		t.Fatalf("expected rejected command not to be saved")
+	}
+
+	if err := running.Wait(); err != nil {
+		t.Fatalf("expected running command to succeed, got %v", err)
+	}
+	if err := queued.Wait(); err != nil {
+		t.Fatalf("expected queued command to succeed, got %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(positions) != 1 || positions[0] != 1 {
+		t.Fatalf("expected queued position 1 to be reported, got %v", positions)
+	}
+	if dc := commands.Get(queued.ID()); dc.State.QueuedAt == nil || dc.Status() != "completed" {
+		t.Fatalf("expected queued command to be completed with queued_at, got %+v", dc.State)
+	}
+}
+
+func TestWsService_CancelQueuedCommand(t *testing.T) {
+	original := commandScheduler
+	commandScheduler = newScheduler(1, 0)
+	t.Cleanup(func() {
+		commandScheduler = original
+	})
+
+	addr := newTestWsServer(t, &Config{})
+	c := client.New(&client.Config{Server: addr, Stdout: io.Discard, Stderr: io.Discard})
+	if err := c.Connect(); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+
+	running, _ := c.ExecAsync(&entities.Command{Script: "sleep 1"})
+	waitForScheduler(t, 1, 0)
+
+	queued, _ := c.ExecAsync(&entities.Command{Script: "echo never"})
+	waitForScheduler(t, 1, 1)
+
+	queued.Cancel()
+	running.Wait()
+	waitForScheduler(t, 0, 0)
+
+	if dc := commands.Get(queued.ID()); dc.Status() != "cancelled" || dc.State.StartedAt != nil {
+		t.Fatalf("expected queued command to be cancelled without running, got %+v", dc.State)
+	}
+}
+
+func TestCreateCommandAPI_QueueFull(t *testing.T) {
+	original := commandScheduler
+	commandScheduler = newScheduler(1, 1)
+	t.Cleanup(func() {
+		commandScheduler = original
+	})
+
+	running, _ := commandScheduler.Admit(&admission{ID: "running"})
+	defer running.Release()
+	queued, _ := commandScheduler.Admit(&admission{ID: "queued"})
+	defer queued.Release()
+
+	app := defaults.Application()
+	app.Post("/exec", createCommandAPI(&Config{MetadataDir: t.TempDir(), WorkDir: t.TempDir()}))
+
+	req := httptest.NewRequest("POST", "/exec", strings.NewReader(`{"id": "cmd-rejected", "engine": "host", "script": "echo hi"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+	app.ServeHTTP(resp, req)
+
+	if resp.Code != 429 || !strings.Contains(resp.Body.String(), "queue is full") {
+		t.Fatalf("expected 429 when queue is full, got %d: %s", resp.Code, resp.Body.String())
+	}
+	if commands.Has("cmd-rejected") {
+		t.Fatalf("expected rejected command not to be saved")
+	}
+}
+
+func orderOf(s *scheduler) []string {
+	s.Lock()
+	defer s.Unlock()
+
+	ids := []string{}
+	for _, t := range s.order() {
+		ids = append(ids, t.ID)
+	}
+	return ids
+}
+
+func waitForScheduler(t *testing.T, running, queued int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		state := commandScheduler.State()
+		r, q := state.Running, state.Queued
+		if r == running && q == queued {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for scheduler (running=%d queued=%d), got running=%d queued=%d", running, queued, r, q)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestPriorityOf(t *testing.T) {
+	for _, c := range []struct {
+		Scopes   []string
+		Priority int
+		Expected int
+	}{
+		{Scopes: []string{ScopeExec}, Priority: 10, Expected: 0},
+		{Scopes: []string{ScopeExec}, Priority: -1, Expected: -1},
+		{Scopes: []string{ScopeAdmin}, Priority: 10, Expected: 10},
+		{Scopes: []string{ScopeAll}, Priority: 10, Expected: 10},
+	} {
+		dc := &dcommand.Command{
+			Cmd:    &entities.Command{Priority: c.Priority},
+			Caller: &dcommand.Caller{Name: "user", Scopes: c.Scopes},
+		}
+		if got := priorityOf(dc); got != c.Expected {
+			t.Fatalf("expected priority %d of scopes %v, got %d", c.Expected, c.Scopes, got)
+		}
+	}
+}
@@ -1,8 +1,13 @@
 package server
 
 import (
+	"crypto/tls"
 	"fmt"
+	"log"
+	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/go-idp/agent"
 	"github.com/go-idp/agent/entities"
@@ -22,6 +27,9 @@ import (
 
 const DefaultShell = "sh"
 
+// DefaultCommandReattachTimeout is the seconds to wait for client to reattach, which covers the reconnect timeout of client
+const DefaultCommandReattachTimeout = 30
+
 // Server is the server interface of caas
 type Server interface {
 	Run() error
@@ -35,11 +43,15 @@ type CommandConfig struct {
 	Script    *WriterFile
 	Log       *WriterFile
 	Env       *WriterFile
+	QueuedAt  *WriterFile
 	StartAt   *WriterFile
 	SucceedAt *WriterFile
 	FailedAt  *WriterFile
 	Status    *WriterFile
 	Error     *WriterFile
+	ExitCode  *WriterFile
+	Usage     *WriterFile
+	Caller    *WriterFile
 }
 
 func (c *Config) GetCommandConfig(id string, command *entities.Command) (*CommandConfig, error) {
@@ -72,14 +84,18 @@ func (c *Config) GetCommandConfig(id string, command *entities.Command) (*Comman
 	return &CommandConfig{
 		WorkDir:     oneWorkDir,
 		MetadataDir: oneMetadataDir,
-		Script:      &WriterFile{Path: fmt.Sprintf("%s/script", oneMetadataDir), IsNeedWrite: isNeedWrite},
-		Log:         &WriterFile{Path: fmt.Sprintf("%s/log", oneMetadataDir), IsNeedWrite: isNeedWrite},
-		Env:         &WriterFile{Path: fmt.Sprintf("%s/env", oneMetadataDir), IsNeedWrite: isNeedWrite},
+		Script:      &WriterFile{Path: fmt.Sprintf("%s/script", oneMetadataDir), IsNeedWrite: isNeedWrite, cipher: c.metadataCipher},
+		Log:         &WriterFile{Path: fmt.Sprintf("%s/log", oneMetadataDir), IsNeedWrite: isNeedWrite, cipher: c.metadataCipher},
+		Env:         &WriterFile{Path: fmt.Sprintf("%s/env", oneMetadataDir), IsNeedWrite: isNeedWrite, cipher: c.metadataCipher},
+		QueuedAt:    &WriterFile{Path: fmt.Sprintf("%s/queued_at", oneMetadataDir), IsNeedWrite: isNeedWrite},
 		StartAt:     &WriterFile{Path: fmt.Sprintf("%s/start_at", oneMetadataDir), IsNeedWrite: isNeedWrite},
 		SucceedAt:   &WriterFile{Path: fmt.Sprintf("%s/succeed_at", oneMetadataDir), IsNeedWrite: isNeedWrite},
 		FailedAt:    &WriterFile{Path: fmt.Sprintf("%s/failed_at", oneMetadataDir), IsNeedWrite: isNeedWrite},
 		Status:      &WriterFile{Path: fmt.Sprintf("%s/status", oneMetadataDir), IsNeedWrite: isNeedWrite},
 		Error:       &WriterFile{Path: fmt.Sprintf("%s/error", oneMetadataDir), IsNeedWrite: isNeedWrite},
+		ExitCode:    &WriterFile{Path: fmt.Sprintf("%s/exit_code", oneMetadataDir), IsNeedWrite: isNeedWrite},
+		Usage:       &WriterFile{Path: fmt.Sprintf("%s/usage", oneMetadataDir), IsNeedWrite: isNeedWrite},
+		Caller:      &WriterFile{Path: fmt.Sprintf("%s/caller", oneMetadataDir), IsNeedWrite: isNeedWrite},
 	}, nil
 }
 
@@ -88,6 +104,10 @@ type WriterFile struct {
 	IsNeedWrite bool
 	//
 	file *os.File
+	// cipher encrypts the content if set
+	cipher *metadataCipher
+	// seq is the sequence number of next record
+	seq uint64
 }
 
 func (w *WriterFile) Write(p []byte) (n int, err error) {
@@ -96,7 +116,7 @@ func (w *WriterFile) Write(p []byte) (n int, err error) {
 	}
 
 	if w.file == nil {
-		if f, err := os.OpenFile(w.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		if f, err := w.open(); err != nil {
 			logger.Errorf("failed to open file: %s", err)
 		} else {
 			w.file = f
@@ -104,18 +124,68 @@ func (w *WriterFile) Write(p []byte) (n int, err error) {
 	}
 
 	if w.file != nil {
+		if w.cipher != nil {
+			// the empty record is the final one
+			if len(p) == 0 {
+				return 0, nil
+			}
+
+			record, err := w.cipher.seal(metadataRecordName(w.Path), w.seq, false, p)
+			if err != nil {
+				return 0, err
+			}
+			if _, err := w.file.Write(record); err != nil {
+				return 0, err
+			}
+			w.seq++
+			return len(p), nil
+		}
+
 		return w.file.Write(p)
 	}
 
 	return len(p), nil
 }
 
+// open opens the file to append, the encrypted one is created with the magic header,
+//
+//	the records are bound to their sequence number, so the encrypted file existing is not appended.
+func (w *WriterFile) open() (*os.File, error) {
+	if w.cipher == nil {
+		return os.OpenFile(w.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	}
+
+	f, err := os.OpenFile(w.Path, os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := f.Write(metadataMagic); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Close closes the file, the encrypted one is completed by the final record
 func (w *WriterFile) Close() error {
-	if w.file != nil {
-		return w.file.Close()
+	if w.file == nil {
+		return nil
+	}
+
+	if w.cipher != nil {
+		record, err := w.cipher.seal(metadataRecordName(w.Path), w.seq, true, nil)
+		if err == nil {
+			_, err = w.file.Write(record)
+		}
+		if err != nil {
+			w.file.Close()
+			return fmt.Errorf("failed to write final record: %s", err)
+		}
 	}
 
-	return nil
+	return w.file.Close()
 }
 
 func (w *WriterFile) WriteString(content string) {
@@ -123,7 +193,27 @@ func (w *WriterFile) WriteString(content string) {
 		return
 	}
 
-	if err := fs.WriteFile(w.Path, []byte(content)); err != nil {
+	data := []byte(content)
+	if w.cipher != nil {
+		// the content and the final record, the empty content has only the final record
+		records := [][]byte{}
+		if len(data) != 0 {
+			records = append(records, data)
+		}
+		records = append(records, nil)
+
+		data = append([]byte{}, metadataMagic...)
+		for seq, p := range records {
+			record, err := w.cipher.seal(metadataRecordName(w.Path), uint64(seq), seq == len(records)-1, p)
+			if err != nil {
+				logger.Errorf("failed to write file(%s): %s", w.Path, err)
+				return
+			}
+			data = append(data, record...)
+		}
+	}
+
+	if err := fs.WriteFile(w.Path, data); err != nil {
 		logger.Errorf("failed to write file(%s): %s", w.Path, err)
 	}
 }
@@ -146,6 +236,10 @@ func New(cfg *Config) Server {
 		cfg.Shell = DefaultShell
 	}
 
+	if cfg.CommandReattachTimeout == 0 {
+		cfg.CommandReattachTimeout = DefaultCommandReattachTimeout
+	}
+
 	return &server{
 		cfg: cfg,
 	}
@@ -154,29 +248,64 @@ func New(cfg *Config) Server {
 func (s *server) Run() error {
 	app := defaults.Application()
 
-	authMiddleware := func(ctx *zoox.Context) {
-		if s.cfg.ClientID == "" && s.cfg.ClientSecret == "" {
-			ctx.Next()
-			return
-		}
-
-		user, pass, ok := ctx.Request.BasicAuth()
-		if !ok {
-			ctx.Set("WWW-Authenticate", `Basic realm="go-zoox"`)
-			ctx.Status(401)
-			return
-		}
+	if err := s.cfg.loadTokens(); err != nil {
+		return fmt.Errorf("failed to load tokens: %s", err)
+	}
+	if err := s.cfg.loadJWT(); err != nil {
+		return fmt.Errorf("failed to load jwt keys: %s", err)
+	}
+	if err := s.cfg.loadMetadataCipher(); err != nil {
+		return err
+	}
+	if err := s.cfg.loadPolicy(); err != nil {
+		return err
+	}
 
-		if !(user == s.cfg.ClientID && pass == s.cfg.ClientSecret) {
-			ctx.Status(401)
-			return
+	var tlsConfig *tls.Config
+	if s.cfg.TLSClientCAFile != "" && !s.cfg.isTLSEnabled() {
+		return fmt.Errorf("tls client ca requires tls cert and key")
+	}
+	if s.cfg.isTLSEnabled() {
+		var err error
+		if tlsConfig, err = s.cfg.loadTLSConfig(); err != nil {
+			return err
 		}
+	}
 
-		ctx.Next()
+	authenticator := createAuthenticator(s.cfg)
+	authMiddleware := func(scope string) func(ctx *zoox.Context) {
+		return createAuthMiddleware(s.cfg, authenticator, scope)
 	}
 
 	app.Use(middleware.Prometheus())
 
+	commandScheduler = newScheduler(s.cfg.MaxConcurrentCommands, s.cfg.MaxQueuedCommands)
+
+	store, err := newCommandStore(s.cfg)
+	if err != nil {
+		return fmt.Errorf("failed to create command store: %s", err)
+	}
+	defer store.Close()
+	commands = store
+
+	if trustedProxies, err = parseTrustedProxies(s.cfg.TrustedProxies); err != nil {
+		return err
+	}
+
+	if s.cfg.AuditLog != "" {
+		auditLog, err := NewAuditLog(s.cfg.AuditLog, s.cfg.AuditLogMaxSize*1024*1024, s.cfg.AuditLogMaxBackups)
+		if err != nil {
+			return fmt.Errorf("failed to open audit log: %s", err)
+		}
+		defer auditLog.Close()
+		audit = auditLog
+	}
+
+	// restore command history from metadata dir
+	if err := restoreCommands(s.cfg); err != nil {
+		logger.Warnf("failed to restore commands: %s", err)
+	}
+
 	// clean metadata dir at 3:00 first day of every month
 	app.Cron().AddJob("clean-metadata", "0 3 1 * *", func() error {
 		// if !s.cfg.IsCleanMetadataDirEnabled {
@@ -213,25 +342,49 @@ func (s *server) Run() error {
 		return nil
 	})
 
+	// prune command history out of retention every hour
+	app.Cron().AddJob("prune-commands", "0 * * * *", func() error {
+		return commands.Prune()
+	})
+
 	wsServer, err := websocket.NewServer()
 	if err != nil {
 		return err
 	}
 
-	createWsService(s.cfg)(wsServer)
+	createWsService(s.cfg, authenticator)(wsServer)
 
 	app.WebSocket(s.cfg.Path, func(opt *zoox.WebSocketOption) {
 		opt.Server = wsServer
 	})
 
 	{ // Web Terminal
-		app.Get(s.cfg.TerminalPath, authMiddleware, func(ctx *zoox.Context) {
+		app.Get(s.cfg.TerminalPath, authMiddleware(ScopeTerminal), func(ctx *zoox.Context) {
 			ctx.HTML(200, terminal.RenderXTerm(zoox.H{
 				"wsPath": s.cfg.TerminalPath,
 			}))
 		})
 
 		if s.cfg.TerminalRelay != "" {
+			// proxy is a middleware, which runs before routes, so auth is applied before it
+			terminalAuthMiddleware := authMiddleware(ScopeTerminal)
+			app.Use(func(ctx *zoox.Context) {
+				if strings.HasPrefix(ctx.Path, s.cfg.TerminalPath) {
+					terminalAuthMiddleware(ctx)
+					return
+				}
+
+				ctx.Next()
+			})
+			app.Use(func(ctx *zoox.Context) {
+				if strings.HasPrefix(ctx.Path, s.cfg.TerminalPath) {
+					auditTerminalSession(ctx)
+					return
+				}
+
+				ctx.Next()
+			})
+
 			app.Proxy(s.cfg.TerminalPath, s.cfg.TerminalRelay, func(cfg *zoox.ProxyConfig) {
 				cfg.Rewrites = []rewriter.Rewriter{
 					{
@@ -257,7 +410,7 @@ func (s *server) Run() error {
 			app.WebSocket(s.cfg.TerminalPath, func(opt *zoox.WebSocketOption) {
 				opt.Server = server
 
-				opt.Middlewares = append(opt.Middlewares, authMiddleware)
+				opt.Middlewares = append(opt.Middlewares, authMiddleware(ScopeTerminal), auditTerminalSession)
 			})
 		}
 	}
@@ -270,26 +423,27 @@ func (s *server) Run() error {
 	// 	})
 	// }
 
-	app.Post("/exec", authMiddleware, createCommandAPI(s.cfg))
-	app.Post("/files/append", authMiddleware, appendFileAPI())
+	app.Post("/exec", authMiddleware(ScopeExec), createCommandAPI(s.cfg))
+	app.Post("/files/append", authMiddleware(ScopeFilesWrite), appendFileAPI())
 
-	app.Group("/commands", func(group *zoox.RouterGroup) {
-		group.Use(authMiddleware)
+	app.Get("/audit", authMiddleware(ScopeAudit), queryAuditAPI(s.cfg))
 
+	app.Group("/commands", func(group *zoox.RouterGroup) {
 		// latest command
-		group.Get("/latest", getLatestCommandAPI(s.cfg))
-		group.Get("/latest/log", getLatestCommandLogAPI(s.cfg))
-		group.Get("/latest/log/sse", getLatestCommandLogSSEAPI(s.cfg))
+		group.Get("/latest", authMiddleware(ScopeReadLogs), getLatestCommandAPI(s.cfg))
+		group.Get("/latest/log", authMiddleware(ScopeReadLogs), getLatestCommandLogAPI(s.cfg))
+		group.Get("/latest/log/sse", authMiddleware(ScopeReadLogs), getLatestCommandLogSSEAPI(s.cfg))
 
-		group.Get("/", listCommandsAPI(s.cfg))
-		group.Post("/", createCommandAPI(s.cfg))
-		group.Get("/:id", retvieveCommandAPI(s.cfg))
+		group.Get("/", authMiddleware(ScopeReadLogs), listCommandsAPI(s.cfg))
+		group.Post("/", authMiddleware(ScopeExec), createCommandAPI(s.cfg))
+		group.Get("/:id", authMiddleware(ScopeReadLogs), retvieveCommandAPI(s.cfg))
+		group.Get("/:id/wait", authMiddleware(ScopeReadLogs), waitCommandAPI(s.cfg))
 
-		group.Get("/:id/log", retrieveCommandLogAPI(s.cfg))
-		group.Get("/:id/log/sse", retrieveCommandLogSSEAPI(s.cfg))
+		group.Get("/:id/log", authMiddleware(ScopeReadLogs), retrieveCommandLogAPI(s.cfg))
+		group.Get("/:id/log/sse", authMiddleware(ScopeReadLogs), retrieveCommandLogSSEAPI(s.cfg))
 
-		group.Post("/:id/create", createCommandAPI(s.cfg))
-		group.Post("/:id/cancel", cancelCommandAPI(s.cfg))
+		group.Post("/:id/create", authMiddleware(ScopeExec), createCommandAPI(s.cfg))
+		group.Post("/:id/cancel", authMiddleware(ScopeCancel), cancelCommandAPI(s.cfg))
 
 		// group.Post("/:id/pause", pauseCommandAPI(s.cfg))
 		// group.Post("/:id/resume", resumeCommandAPI(s.cfg))
@@ -304,6 +458,7 @@ func (s *server) Run() error {
 			"description": "the agent of idp",
 			"version":     agent.Version,
 			"state":       state,
+			"scheduler":   commandScheduler.State(),
 			"running_at":  runningAt,
 		})
 	})
@@ -319,5 +474,42 @@ ____________________________________O/_______
                                     O\
 `, chalk.Green("v"+agent.Version)))
 
+	if tlsConfig != nil {
+		return runTLS(app, s.cfg.Port, tlsConfig)
+	}
+
 	return app.Run(fmt.Sprintf("0.0.0.0:%d", s.cfg.Port))
 }
+
+// runTLS runs the app over tls as app.Run does, with its banner, defaults and timeouts,
+//
+//	because zoox serves https only along with plain http on another port.
+//	The lifecycle hooks of zoox are not run, which server does not register.
+func runTLS(app *zoox.Application, port int64, tlsConfig *tls.Config) error {
+	log.Println(app.Config.Banner)
+
+	app.Config.Protocol = "https"
+	app.Config.Host = "0.0.0.0"
+	app.Config.Port = int(port)
+	if app.Config.SecretKey == "" {
+		app.Config.SecretKey = zoox.DefaultSecretKey
+	}
+
+	server := newTLSServer(app, fmt.Sprintf("0.0.0.0:%d", port), tlsConfig)
+	logger.Infof("server started at https://%s", server.Addr)
+	return server.ListenAndServeTLS("", "")
+}
+
+// newTLSServer creates the https server of app, with the timeouts of zoox
+func newTLSServer(app *zoox.Application, addr string, tlsConfig *tls.Config) *http.Server {
+	return &http.Server{
+		Addr:      addr,
+		Handler:   app,
+		TLSConfig: tlsConfig,
+		//
+		ReadHeaderTimeout: 30 * time.Second,
+		ReadTimeout:       300 * time.Second,
+		WriteTimeout:      300 * time.Second,
+		IdleTimeout:       300 * time.Second,
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// maxStdinBuffered is the max size of stdin buffered but not read by command yet
+const maxStdinBuffered = 1024 * 1024
+
+// errStdinBufferFull is the error of writing stdin faster than the command reads it
+var errStdinBufferFull = fmt.Errorf("stdin buffer is full (max: %d bytes)", maxStdinBuffered)
+
+// StdinPipe is the stdin of command streamed from websocket client,
+//
+//	writes never block, data is buffered until the command reads it, errStdinBufferFull if over maxStdinBuffered.
+type StdinPipe struct {
+	sync.Mutex
+	cond *sync.Cond
+	//
+	buf    bytes.Buffer
+	closed bool
+}
+
+// NewStdinPipe creates a new stdin pipe
+func NewStdinPipe() *StdinPipe {
+	p := &StdinPipe{}
+	p.cond = sync.NewCond(&p.Mutex)
+	return p
+}
+
+func (p *StdinPipe) Write(b []byte) (n int, err error) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	if p.buf.Len()+len(b) > maxStdinBuffered {
+		return 0, errStdinBufferFull
+	}
+
+	n, err = p.buf.Write(b)
+	p.cond.Broadcast()
+	return
+}
+
+func (p *StdinPipe) Read(b []byte) (n int, err error) {
+	p.Lock()
+	defer p.Unlock()
+
+	for p.buf.Len() == 0 && !p.closed {
+		p.cond.Wait()
+	}
+
+	if p.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+
+	return p.buf.Read(b)
+}
+
+// Close closes the pipe, the reader gets EOF after buffered data is consumed
+func (p *StdinPipe) Close() error {
+	p.Lock()
+	defer p.Unlock()
+
+	p.closed = true
+	p.cond.Broadcast()
+	return nil
+}
@@ -0,0 +1,295 @@
+package server
+
+import (
+	goerrors "errors"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-zoox/command/errors"
+	"github.com/go-zoox/core-utils/safe"
+	"github.com/go-zoox/logger"
+
+	dcommand "github.com/go-idp/agent/server/data/command"
+)
+
+// exitCodeCancelled is the exit code of cancelled command
+const exitCodeCancelled = 130
+
+// streamRetention is how long the stream is kept after command exits,
+//
+//	so a client reattaching shortly after can still get the exit code.
+var streamRetention = 5 * time.Minute
+
+// commandStreams is the streams of commands running in this process
+var commandStreams = safe.NewMap[string, *CommandStream]()
+
+// StreamSink receives the output of command
+type StreamSink interface {
+	Stdout(p []byte) error
+	Stderr(p []byte) error
+	Exit(code int, reason string) error
+}
+
+// CommandStream writes the output of command to log,
+//
+//	and fans it out to the attached sinks.
+type CommandStream struct {
+	sync.Mutex
+	//
+	ID  string
+	Cmd *dcommand.Command
+	//
+	cfg *Config
+	log io.Writer
+	// stdout and stderr mask the secrets of command before writing to log and sinks
+	stdout *redactWriter
+	stderr *redactWriter
+	//
+	sinks map[string]StreamSink
+	//
+	isExited   bool
+	exitCode   int
+	exitReason string
+}
+
+// newCommandStream creates the stream of command, and registers it
+func newCommandStream(cfg *Config, cmd *dcommand.Command, log io.Writer) *CommandStream {
+	s := &CommandStream{
+		ID:    cmd.ID,
+		Cmd:   cmd,
+		cfg:   cfg,
+		log:   log,
+		sinks: map[string]StreamSink{},
+	}
+
+	var secrets map[string]string
+	if cmd.Cmd != nil {
+		secrets = cmd.Cmd.Secrets
+	}
+	s.stdout = newRedactWriter(&streamWriter{stream: s, isStderr: false}, secrets)
+	s.stderr = newRedactWriter(&streamWriter{stream: s, isStderr: true}, secrets)
+
+	commandStreams.Set(cmd.ID, s)
+	return s
+}
+
+// Stdout returns the writer of command stdout
+func (s *CommandStream) Stdout() io.Writer {
+	return s.stdout
+}
+
+// Stderr returns the writer of command stderr
+func (s *CommandStream) Stderr() io.Writer {
+	return s.stderr
+}
+
+// Attach attaches the sink to stream, replays the log from offset first,
+//
+//	offset < 0 means no replay.
+func (s *CommandStream) Attach(id string, sink StreamSink, offset int64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if offset >= 0 {
+		if err := replayCommandLog(s.cfg, s.ID, sink, offset); err != nil {
+			return err
+		}
+	}
+
+	if s.isExited {
+		return sink.Exit(s.exitCode, s.exitReason)
+	}
+
+	s.sinks[id] = sink
+	return nil
+}
+
+// Detach detaches the sink from stream, returns true if it was attached
+func (s *CommandStream) Detach(id string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	_, ok := s.sinks[id]
+	delete(s.sinks, id)
+	return ok
+}
+
+// HasSinks returns true if any sink is attached
+func (s *CommandStream) HasSinks() bool {
+	s.Lock()
+	defer s.Unlock()
+
+	return len(s.sinks) > 0
+}
+
+// Exit sends exit code to all sinks, and unregisters the stream after retention,
+//
+//	reason is empty if the command exits normally.
+func (s *CommandStream) Exit(code int, reason string) {
+	s.stdout.Flush()
+	s.stderr.Flush()
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.isExited {
+		return
+	}
+
+	s.isExited = true
+	s.exitCode = code
+	s.exitReason = reason
+	observeCommandExit(s.Cmd, code)
+	for id, sink := range s.sinks {
+		if err := sink.Exit(code, reason); err != nil {
+			logger.Debugf("[stream][id: %s] failed to send exit code to %s: %s", s.ID, id, err)
+		}
+	}
+	s.sinks = map[string]StreamSink{}
+
+	time.AfterFunc(streamRetention, func() {
+		if commandStreams.Get(s.ID) == s {
+			commandStreams.Del(s.ID)
+		}
+	})
+}
+
+func (s *CommandStream) write(p []byte, isStderr bool) (n int, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if n, err = s.log.Write(p); err != nil {
+		return n, err
+	}
+
+	for id, sink := range s.sinks {
+		var errx error
+		if isStderr {
+			errx = sink.Stderr(p)
+		} else {
+			errx = sink.Stdout(p)
+		}
+
+		// the sink is gone, it can reattach later
+		if errx != nil {
+			logger.Debugf("[stream][id: %s] failed to write to %s, detached: %s", s.ID, id, errx)
+			delete(s.sinks, id)
+		}
+	}
+
+	return len(p), nil
+}
+
+type streamWriter struct {
+	stream   *CommandStream
+	isStderr bool
+}
+
+func (w *streamWriter) Write(p []byte) (n int, err error) {
+	return w.stream.write(p, w.isStderr)
+}
+
+// replayCommandLog sends the command log from offset to sink as stdout
+func replayCommandLog(cfg *Config, id string, sink StreamSink, offset int64) error {
+	chunk, _, err := readCommandLogChunk(cfg, id, offset)
+	if err != nil {
+		return err
+	}
+
+	if chunk == "" {
+		return nil
+	}
+
+	return sink.Stdout([]byte(chunk))
+}
+
+// exitCodeOf returns the exit code of command by the error of run
+func exitCodeOf(cmd *dcommand.Command, err error) int {
+	if err == nil {
+		return 0
+	}
+
+	if cmd.Status() == "cancelled" {
+		return exitCodeCancelled
+	}
+
+	return exitCodeOfError(err)
+}
+
+// exitCodeOfError returns the exit code of command failed by err
+func exitCodeOfError(err error) int {
+	if asPolicyError(err) != nil {
+		return exitCodeDenied
+	}
+
+	if errx := asExitError(err); errx != nil {
+		return errx.ExitCode()
+	}
+
+	return 127
+}
+
+// recordExit records the exit code and error of command finished in its state and metadata,
+//
+//	it should be called before the final state is saved.
+func recordExit(cmd *dcommand.Command, cmdCfg *CommandConfig, err error) int {
+	exitCode := exitCodeOf(cmd, err)
+	cmd.SetExit(exitCode, err)
+	cmdCfg.ExitCode.WriteString(strconv.Itoa(exitCode))
+
+	return exitCode
+}
+
+// exitReasonOf returns the reason of command exits abnormally, empty for exit error
+func exitReasonOf(cmd *dcommand.Command, err error) string {
+	if err == nil {
+		return ""
+	}
+
+	if cmd.Status() == "cancelled" {
+		return "cancelled"
+	}
+
+	if asExitError(err) != nil {
+		return ""
+	}
+
+	return err.Error()
+}
+
+// asExitError returns the exit error in the error chain, nil if not found
+func asExitError(err error) *errors.ExitError {
+	var errx *errors.ExitError
+	if goerrors.As(err, &errx) {
+		return errx
+	}
+
+	return nil
+}
+
+// exitCodeOfState returns the exit code of finished command by its state,
+//
+//	it is used when the stream is gone, the exact exit code of error is unknown if its error is not kept.
+func exitCodeOfState(state *dcommand.State) int {
+	if state == nil {
+		return 1
+	}
+	if state.ExitCode != nil {
+		return *state.ExitCode
+	}
+
+	switch state.Status {
+	case "completed":
+		return 0
+	case "cancelled":
+		return exitCodeCancelled
+	default:
+		if state.Error != nil {
+			return exitCodeOfError(state.Error)
+		}
+
+		return 1
+	}
+}
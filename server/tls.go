@@ -0,0 +1,77 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/go-idp/agent/entities"
+)
+
+// isTLSEnabled returns true if the server listens with TLS
+func (c *Config) isTLSEnabled() bool {
+	return c.TLSCertFile != "" || c.TLSKeyFile != ""
+}
+
+// loadTLSConfig loads the tls config of server, client certificates are verified against TLSClientCAFile if set
+func (c *Config) loadTLSConfig() (*tls.Config, error) {
+	if c.TLSCertFile == "" || c.TLSKeyFile == "" {
+		return nil, fmt.Errorf("tls cert and key should be both specified")
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tls cert: %s", err)
+	}
+
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if c.TLSClientCAFile != "" {
+		ca, err := os.ReadFile(c.TLSClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tls client ca: %s", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("failed to parse tls client ca: no certificate found in %s", c.TLSClientCAFile)
+		}
+
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		if c.IsTLSClientCertRequired {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return cfg, nil
+}
+
+// certIdentity returns the identity of verified client certificate, whose name is the CN
+func certIdentity(cfg *Config, r *http.Request) *Identity {
+	if cfg.TLSClientCAFile == "" || r == nil || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+
+	name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if name == "" {
+		return nil
+	}
+
+	scopes := cfg.TLSClientScopes
+	if len(scopes) == 0 {
+		scopes = defaultScopes
+	}
+
+	return &Identity{Name: name, Scopes: scopes}
+}
+
+// hasCredentials returns true if the auth request carries token, client id or secret
+func hasCredentials(req *entities.AuthRequest) bool {
+	return req.Token != "" || req.ClientID != "" || req.ClientSecret != ""
+}
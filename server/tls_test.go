@@ -0,0 +1,291 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-idp/agent/client"
+	"github.com/go-idp/agent/entities"
+	"github.com/go-zoox/websocket"
+	"github.com/go-zoox/zoox"
+	"github.com/go-zoox/zoox/defaults"
+	gorilla "github.com/gorilla/websocket"
+)
+
+// writeTestCert issues a certificate signed by parent (self-signed if nil), writes cert and key in dir
+func writeTestCert(t *testing.T, dir, name string, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	os.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600)
+
+	return cert, key
+}
+
+// newTestPKI writes ca, server (127.0.0.1) and client (CN: ci) certificates in a temp dir
+func newTestPKI(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	notAfter := time.Now().Add(time.Hour)
+
+	ca, caKey := writeTestCert(t, dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+
+	writeTestCert(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "agent"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     notAfter,
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+
+	writeTestCert(t, dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "ci"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	return dir
+}
+
+// newTestTLSServer starts the websocket service at / and GET /whoami (scope: exec) with tls of cfg
+func newTestTLSServer(t *testing.T, cfg *Config) *httptest.Server {
+	t.Helper()
+
+	tlsConfig, err := cfg.loadTLSConfig()
+	if err != nil {
+		t.Fatalf("failed to load tls config: %v", err)
+	}
+
+	authenticator := createAuthenticator(cfg)
+	wsServer, err := websocket.NewServer()
+	if err != nil {
+		t.Fatalf("failed to create websocket server: %v", err)
+	}
+	createWsService(cfg, authenticator)(wsServer)
+
+	app := defaults.Application()
+	app.WebSocket("/", func(opt *zoox.WebSocketOption) {
+		opt.Server = wsServer
+	})
+	app.Get("/whoami", createAuthMiddleware(cfg, authenticator, ScopeExec), func(ctx *zoox.Context) {
+		ctx.String(200, identityOf(cfg, ctx).Name)
+	})
+
+	// served as Run does in tls mode
+	ts := httptest.NewUnstartedServer(app)
+	ts.Config = newTLSServer(app, "", tlsConfig)
+	ts.TLS = tlsConfig
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+
+	return ts
+}
+
+// whoami requests GET /whoami by the tls config, with the basic auth of user:pass if given
+func whoami(t *testing.T, ts *httptest.Server, tlsConfig *tls.Config, basicAuth string) (int, string) {
+	t.Helper()
+
+	req, _ := http.NewRequest("GET", ts.URL+"/whoami", nil)
+	if user, pass, ok := strings.Cut(basicAuth, ":"); ok {
+		req.SetBasicAuth(user, pass)
+	}
+
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestTLS_ClientCertificateIdentity(t *testing.T) {
+	pki := newTestPKI(t)
+	cfg := &Config{
+		Shell:           DefaultShell,
+		MetadataDir:     t.TempDir(),
+		WorkDir:         t.TempDir(),
+		TLSCertFile:     filepath.Join(pki, "server.crt"),
+		TLSKeyFile:      filepath.Join(pki, "server.key"),
+		TLSClientCAFile: filepath.Join(pki, "ca.crt"),
+		TLSClientScopes: []string{ScopeExec},
+	}
+	ts := newTestTLSServer(t, cfg)
+
+	original := gorilla.DefaultDialer
+
+	ca := filepath.Join(pki, "ca.crt")
+	withCert, err := client.LoadTLSConfig(ca, filepath.Join(pki, "client.crt"), filepath.Join(pki, "client.key"))
+	if err != nil {
+		t.Fatalf("failed to load client tls config: %v", err)
+	}
+	withoutCert, err := client.LoadTLSConfig(ca, "", "")
+	if err != nil {
+		t.Fatalf("failed to load client tls config: %v", err)
+	}
+
+	if status, name := whoami(t, ts, withCert, ""); status != 200 || name != "ci" {
+		t.Fatalf("expected client certificate to be identity ci, got %d: %s", status, name)
+	}
+	if status, _ := whoami(t, ts, withoutCert, ""); status != 401 {
+		t.Fatalf("expected request without client certificate to be unauthorized, got %d", status)
+	}
+
+	// websocket with client certificate
+	addr := "wss" + strings.TrimPrefix(ts.URL, "https")
+	c := client.New(&client.Config{
+		Server:      addr,
+		TLSCAFile:   ca,
+		TLSCertFile: filepath.Join(pki, "client.crt"),
+		TLSKeyFile:  filepath.Join(pki, "client.key"),
+		Stdout:      io.Discard,
+		Stderr:      io.Discard,
+	})
+	if err := c.Connect(); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+
+	id := fmt.Sprintf("cmd-tls-%d", time.Now().UnixNano())
+	if err := c.Exec(&entities.Command{ID: id, Script: "true"}); err != nil {
+		t.Fatalf("failed to exec with client certificate: %v", err)
+	}
+	if dc := commands.Get(id); dc == nil || dc.Caller == nil || dc.Caller.Name != "ci" {
+		t.Fatalf("expected caller ci to be recorded, got %+v", dc)
+	}
+	if gorilla.DefaultDialer != original || original.TLSClientConfig != nil {
+		t.Fatalf("expected tls config of client not to change the default dialer")
+	}
+}
+
+func TestTLS_ClientCAOnlyWithoutCertificate(t *testing.T) {
+	pki := newTestPKI(t)
+	cfg := &Config{
+		Shell:           DefaultShell,
+		MetadataDir:     t.TempDir(),
+		WorkDir:         t.TempDir(),
+		TLSCertFile:     filepath.Join(pki, "server.crt"),
+		TLSKeyFile:      filepath.Join(pki, "server.key"),
+		TLSClientCAFile: filepath.Join(pki, "ca.crt"),
+		TLSClientScopes: []string{ScopeExec},
+	}
+	ts := newTestTLSServer(t, cfg)
+
+	ca := filepath.Join(pki, "ca.crt")
+	withCert, _ := client.LoadTLSConfig(ca, filepath.Join(pki, "client.crt"), filepath.Join(pki, "client.key"))
+	withoutCert, _ := client.LoadTLSConfig(ca, "", "")
+
+	// any credentials are rejected without client certificate
+	if status, name := whoami(t, ts, withoutCert, "x:y"); status != 401 {
+		t.Fatalf("expected basic auth without client certificate to be unauthorized, got %d: %s", status, name)
+	}
+	// and ignored with client certificate
+	if status, name := whoami(t, ts, withCert, "x:y"); status != 200 || name != "ci" {
+		t.Fatalf("expected client certificate to be identity ci, got %d: %s", status, name)
+	}
+
+	addr := "wss" + strings.TrimPrefix(ts.URL, "https")
+	for _, credentials := range [][2]string{{"", ""}, {"x", "y"}} {
+		c := client.New(&client.Config{
+			Server:       addr,
+			TLSCAFile:    ca,
+			ClientID:     credentials[0],
+			ClientSecret: credentials[1],
+			Stdout:       io.Discard,
+			Stderr:       io.Discard,
+		})
+		if err := c.Connect(); err == nil {
+			c.Close()
+			t.Fatalf("expected websocket without client certificate to be unauthorized (credentials: %v)", credentials)
+		}
+	}
+}
+
+func TestTLS_ClientCertificateRequired(t *testing.T) {
+	pki := newTestPKI(t)
+	cfg := &Config{
+		TLSCertFile:             filepath.Join(pki, "server.crt"),
+		TLSKeyFile:              filepath.Join(pki, "server.key"),
+		TLSClientCAFile:         filepath.Join(pki, "ca.crt"),
+		IsTLSClientCertRequired: true,
+	}
+	tlsConfig, err := cfg.loadTLSConfig()
+	if err != nil {
+		t.Fatalf("failed to load tls config: %v", err)
+	}
+
+	ts := httptest.NewUnstartedServer(http.NotFoundHandler())
+	ts.TLS = tlsConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	withoutCert, _ := client.LoadTLSConfig(filepath.Join(pki, "ca.crt"), "", "")
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: withoutCert}}
+	if _, err := httpClient.Get(ts.URL); err == nil {
+		t.Fatalf("expected handshake without client certificate to fail")
+	}
+
+	if _, err := (&Config{TLSCertFile: cfg.TLSCertFile}).loadTLSConfig(); err == nil {
+		t.Fatalf("expected tls cert without key to fail")
+	}
+}
+
+func TestTLS_ClientCertificateDefaultScopes(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "ci"}}
+	r := &http.Request{TLS: &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}}
+
+	identity := certIdentity(&Config{TLSClientCAFile: "ca.crt"}, r)
+	if identity == nil || identity.Name != "ci" {
+		t.Fatalf("expected identity ci, got %+v", identity)
+	}
+	if identity.IsAdmin() || identity.HasScope(ScopeTerminal) || !identity.HasScope(ScopeExec) {
+		t.Fatalf("expected default scopes of owner, got %v", identity.Scopes)
+	}
+}
@@ -0,0 +1,257 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dcommand "github.com/go-idp/agent/server/data/command"
+	"github.com/go-zoox/zoox"
+	"github.com/go-zoox/zoox/components/context/query"
+)
+
+const (
+	// defaultWaitTimeout is the timeout of waiting for command if not specified
+	defaultWaitTimeout = 30 * time.Second
+	// maxWaitTimeout is the max timeout of waiting for command, avoid holding connections forever
+	maxWaitTimeout = 10 * time.Minute
+	// defaultWaitLogTail is the lines of log returned with result if not specified
+	defaultWaitLogTail = 100
+)
+
+// finishedCommands are the channels closed when the commands accepted finish, by command id
+var finishedCommands = &commandWaiters{
+	channels: map[string]chan struct{}{},
+}
+
+type commandWaiters struct {
+	sync.Mutex
+	channels map[string]chan struct{}
+}
+
+// CommandResult is the result of command waited for
+type CommandResult struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	// IsFinished is false if the command is still queued or running when the wait timed out
+	IsFinished bool `json:"is_finished"`
+	// ExitCode is the exit code of command finished
+	ExitCode *int `json:"exit_code,omitempty"`
+	// Error is the reason of command failed
+	Error string `json:"error,omitempty"`
+	// Duration is the elapsed time of run, in milliseconds
+	Duration int64 `json:"duration"`
+	// Log is the tail of log
+	Log string `json:"log"`
+}
+
+// watchCommand registers the command accepted before it is saved, the id of command saved or watched is rejected,
+//
+//	finish should be called after its final state is saved, which wakes up the waiters.
+func watchCommand(id string) (finish func(), err error) {
+	finishedCommands.Lock()
+	defer finishedCommands.Unlock()
+
+	if _, ok := finishedCommands.channels[id]; ok || commands.Get(id) != nil {
+		return nil, errCommandExists
+	}
+
+	done := make(chan struct{})
+	finishedCommands.channels[id] = done
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			finishedCommands.Lock()
+			defer finishedCommands.Unlock()
+
+			if finishedCommands.channels[id] == done {
+				delete(finishedCommands.channels, id)
+			}
+			close(done)
+		})
+	}, nil
+}
+
+// commandFinished returns the channel closed when the command finishes, nil if it is not watched
+func commandFinished(id string) <-chan struct{} {
+	finishedCommands.Lock()
+	defer finishedCommands.Unlock()
+
+	if done, ok := finishedCommands.channels[id]; ok {
+		return done
+	}
+
+	return nil
+}
+
+// isCommandFinished returns true if the command will not run any more
+func isCommandFinished(dc *dcommand.Command) bool {
+	state := dc.Snapshot()
+	return state != nil && isStateFinished(state)
+}
+
+// isStateFinished returns true if the command of state will not run any more
+func isStateFinished(state *dcommand.State) bool {
+	switch state.Status {
+	case "completed", "cancelled", "error":
+		return true
+	default:
+		return false
+	}
+}
+
+// waitCommand waits for the command to finish until timeout or ctx is done, and returns its result
+func waitCommand(ctx context.Context, cfg *Config, identity *Identity, id string, timeout time.Duration, tail int) (*CommandResult, error) {
+	// watched before read, so the finish between them is not missed,
+	//	the command watched is not finished yet, otherwise it is finished or restored.
+	done := commandFinished(id)
+
+	dc := getCommandOf(identity, id)
+	if dc == nil {
+		return nil, nil
+	}
+
+	if done != nil {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		select {
+		case <-done:
+			if dc = commands.Get(id); dc == nil {
+				return nil, nil
+			}
+		case <-timer.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	return resultOf(cfg, dc, tail)
+}
+
+// resultOf returns the result of command, with the tail of log
+//
+//	the state is read by snapshot, the command may still be running.
+func resultOf(cfg *Config, dc *dcommand.Command, tail int) (*CommandResult, error) {
+	state := dc.Snapshot()
+	if state == nil {
+		state = &dcommand.State{}
+	}
+
+	result := &CommandResult{
+		ID:         dc.ID,
+		Status:     state.Status,
+		IsFinished: isStateFinished(state),
+	}
+
+	if result.IsFinished {
+		exitCode := exitCodeOfState(state)
+		result.ExitCode = &exitCode
+
+		if state.ErrorMessage != "" {
+			result.Error = state.ErrorMessage
+		} else if state.Error != nil {
+			result.Error = state.Error.Error()
+		}
+	}
+
+	if state.Usage != nil {
+		result.Duration = state.Usage.WallTime
+	} else if state.StartedAt != nil {
+		end := time.Now()
+		if state.CompletedAt != nil {
+			end = state.CompletedAt.Time()
+		} else if state.ErroredAt != nil {
+			end = state.ErroredAt.Time()
+		}
+		result.Duration = end.Sub(state.StartedAt.Time()).Milliseconds()
+	}
+
+	log, err := readCommandLog(cfg, dc.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read command log: %s", err)
+	}
+	result.Log = tailLines(log, tail)
+
+	return result, nil
+}
+
+// tailLines returns the last n lines of s, all lines if n <= 0
+func tailLines(s string, n int) string {
+	if n <= 0 {
+		return s
+	}
+
+	end := strings.TrimSuffix(s, "\n")
+	for i := 0; i < n; i++ {
+		index := strings.LastIndex(end, "\n")
+		if index == -1 {
+			return s
+		}
+		end = end[:index]
+	}
+
+	return s[len(end)+1:]
+}
+
+// parseWaitOption parses the timeout and tail of waiting in query,
+//
+//	timeout supports seconds and duration, e.g. 30, 1m, default 30s, max 10m.
+func parseWaitOption(q query.Query) (timeout time.Duration, tail int, err error) {
+	timeout = defaultWaitTimeout
+	if value := q.Get("timeout").String(); value != "" {
+		if seconds, errx := strconv.Atoi(value); errx == nil {
+			timeout = time.Duration(seconds) * time.Second
+		} else if timeout, err = time.ParseDuration(value); err != nil {
+			return 0, 0, fmt.Errorf("invalid timeout: %s", value)
+		}
+
+		if timeout < 0 {
+			return 0, 0, fmt.Errorf("invalid timeout: %s", value)
+		}
+		if timeout > maxWaitTimeout {
+			timeout = maxWaitTimeout
+		}
+	}
+
+	tail = defaultWaitLogTail
+	if value := q.Get("tail").String(); value != "" {
+		if tail, err = strconv.Atoi(value); err != nil {
+			return 0, 0, fmt.Errorf("invalid tail: %s", value)
+		}
+	}
+
+	return timeout, tail, nil
+}
+
+func waitCommandAPI(cfg *Config) func(ctx *zoox.Context) {
+	return func(ctx *zoox.Context) {
+		id := ctx.Param().Get("id").String()
+		if id == "" {
+			ctx.Fail(fmt.Errorf("id is required"), 400, "id is required")
+			return
+		}
+
+		timeout, tail, err := parseWaitOption(ctx.Query())
+		if err != nil {
+			ctx.Fail(err, 400, err.Error())
+			return
+		}
+
+		result, err := waitCommand(ctx.Request.Context(), cfg, identityOf(cfg, ctx), id, timeout, tail)
+		if err != nil {
+			ctx.Fail(err, 500, fmt.Sprintf("failed to wait for command: %s", err))
+			return
+		}
+		if result == nil {
+			ctx.Fail(nil, 404, "command not found")
+			return
+		}
+
+		ctx.Success(result)
+	}
+}
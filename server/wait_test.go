@@ -0,0 +1,140 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	dcommand "github.com/go-idp/agent/server/data/command"
+	"github.com/go-zoox/zoox"
+	"github.com/go-zoox/zoox/defaults"
+)
+
+func newTestWaitApp(t *testing.T) (*zoox.Application, *Config) {
+	t.Helper()
+
+	original := commands
+	commands = dcommand.NewMemoryStore()
+	t.Cleanup(func() {
+		commands = original
+	})
+
+	cfg := &Config{MetadataDir: t.TempDir(), WorkDir: t.TempDir()}
+	app := defaults.Application()
+	app.Post("/commands", createCommandAPI(cfg))
+	app.Get("/commands/:id", retvieveCommandAPI(cfg))
+	app.Get("/commands/:id/wait", waitCommandAPI(cfg))
+	return app, cfg
+}
+
+func doWaitRequest(t *testing.T, app *zoox.Application, method, path, body string) *CommandResult {
+	t.Helper()
+
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+	app.ServeHTTP(resp, req)
+
+	response := &struct {
+		Result *CommandResult `json:"result"`
+	}{}
+	if err := json.Unmarshal(resp.Body.Bytes(), response); err != nil || response.Result == nil {
+		t.Fatalf("unexpected response of %s %s: %d %s", method, path, resp.Code, resp.Body.String())
+	}
+
+	return response.Result
+}
+
+func TestCreateCommandAPI_Wait(t *testing.T) {
+	app, _ := newTestWaitApp(t)
+
+	result := doWaitRequest(t, app, "POST", "/commands?wait=true&tail=2", `{"id": "cmd-wait", "engine": "host", "script": "echo 1; echo 2; echo 3; exit 3"}`)
+	if !result.IsFinished || result.Status != "error" || result.ExitCode == nil || *result.ExitCode != 3 {
+		t.Fatalf("expected command to fail with exit code 3, got %+v", result)
+	}
+	if result.Log != "2\n3\n" {
+		t.Fatalf("expected the tail of log, got %q", result.Log)
+	}
+	if !strings.Contains(result.Error, "exit status 3") {
+		t.Fatalf("expected error message, got %q", result.Error)
+	}
+}
+
+func TestCreateCommandAPI_RecordsExitCode(t *testing.T) {
+	app, cfg := newTestWaitApp(t)
+
+	doWaitRequest(t, app, "POST", "/commands?wait=true", `{"id": "cmd-exit-code", "engine": "host", "script": "exit 7"}`)
+
+	req := httptest.NewRequest("GET", "/commands/cmd-exit-code", nil)
+	resp := httptest.NewRecorder()
+	app.ServeHTTP(resp, req)
+
+	response := &struct {
+		Result struct {
+			State struct {
+				ExitCode     *int   `json:"exit_code"`
+				ErrorMessage string `json:"error_message"`
+			} `json:"state"`
+		} `json:"result"`
+	}{}
+	if err := json.Unmarshal(resp.Body.Bytes(), response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if state := response.Result.State; state.ExitCode == nil || *state.ExitCode != 7 || !strings.Contains(state.ErrorMessage, "exit status 7") {
+		t.Fatalf("expected exit code and error message in state, got %s", resp.Body.String())
+	}
+
+	if exitCode, _ := readMetadataFile(filepath.Join(cfg.MetadataDir, "cmd-exit-code", "exit_code")); exitCode != "7" {
+		t.Fatalf("expected exit code in metadata, got %q", exitCode)
+	}
+}
+
+func TestWaitCommandAPI(t *testing.T) {
+	app, _ := newTestWaitApp(t)
+
+	created := doWaitRequest(t, app, "POST", "/commands", `{"id": "cmd-wait-later", "engine": "host", "script": "sleep 0.5; echo done"}`)
+	if created.Status != "running" {
+		t.Fatalf("expected command to be running, got %+v", created)
+	}
+
+	// times out while running
+	result := doWaitRequest(t, app, "GET", "/commands/cmd-wait-later/wait?timeout=10ms", "")
+	if result.IsFinished || result.ExitCode != nil || result.Status != "running" {
+		t.Fatalf("expected wait to time out, got %+v", result)
+	}
+
+	result = doWaitRequest(t, app, "GET", "/commands/cmd-wait-later/wait?timeout=5", "")
+	if !result.IsFinished || result.Status != "completed" || *result.ExitCode != 0 || result.Log != "done\n" {
+		t.Fatalf("expected command to be completed, got %+v", result)
+	}
+	if result.Duration < 500 {
+		t.Fatalf("expected duration of run, got %d", result.Duration)
+	}
+
+	// finished returns immediately
+	result = doWaitRequest(t, app, "GET", "/commands/cmd-wait-later/wait", "")
+	if result.Status != "completed" {
+		t.Fatalf("expected command to be completed, got %+v", result)
+	}
+}
+
+func TestTailLines(t *testing.T) {
+	cases := []struct {
+		s    string
+		n    int
+		tail string
+	}{
+		{"a\nb\nc\n", 2, "b\nc\n"},
+		{"a\nb\nc", 2, "b\nc"},
+		{"a\nb\n", 5, "a\nb\n"},
+		{"a\nb\n", 0, "a\nb\n"},
+		{"", 1, ""},
+	}
+	for _, c := range cases {
+		if got := tailLines(c.s, c.n); got != c.tail {
+			t.Fatalf("tailLines(%q, %d): expected %q, got %q", c.s, c.n, c.tail, got)
+		}
+	}
+}
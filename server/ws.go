@@ -5,15 +5,12 @@ import (
 	"fmt"
 	"io"
 	"runtime"
+	"sync"
 
 	// "os/exec"
-	"strings"
 	"time"
 
 	"github.com/go-idp/agent/entities"
-	"github.com/go-zoox/command/errors"
-	"github.com/go-zoox/datetime"
-	"github.com/go-zoox/fs"
 	"github.com/go-zoox/logger"
 	"github.com/go-zoox/websocket"
 	"github.com/go-zoox/websocket/conn"
@@ -37,11 +34,23 @@ func (w WSClientWriter) Write(p []byte) (n int, err error) {
 }
 
 type ConnData struct {
+	// Cmd is the latest command, which v1 messages without command id apply to
 	Cmd        *dcommand.Command
 	AuthClient *entities.AuthRequest
 	CommandN   *entities.Command
+	// Identity is the caller authenticated
+	Identity *Identity
+	//
+	Writer *MessageWriter
+	//
+	commands map[string]*dcommand.Command
+	stdins   map[string]*StdinPipe
+	mu       sync.Mutex
 	//
 	IsAuthenticated bool
+	// ExpiresAt is when the credential authenticated expires, zero means never,
+	//	the requests after it are rejected, the commands running keep running.
+	ExpiresAt time.Time
 	// Stopped                    bool
 	// IsKilledByClose            bool
 	AuthenticationTimeoutTimer *time.Timer
@@ -53,9 +62,79 @@ type ConnData struct {
 	// CommandState *CommandState
 }
 
-func createWsService(cfg *Config) func(server websocket.Server) {
+// IsExpired returns true if the credential authenticated has expired
+func (d *ConnData) IsExpired() bool {
+	return !d.ExpiresAt.IsZero() && time.Now().After(d.ExpiresAt)
+}
+
+// Stdin returns the stdin pipe of the command, created on first use,
+//
+//	id is the command id of message, empty for v1 messages.
+func (d *ConnData) Stdin(id string) *StdinPipe {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.stdins == nil {
+		d.stdins = map[string]*StdinPipe{}
+	}
+
+	if d.stdins[id] == nil {
+		d.stdins[id] = NewStdinPipe()
+	}
+
+	return d.stdins[id]
+}
+
+// CloseStdin closes the stdin pipe of the command, the next command with same id gets a new one
+func (d *ConnData) CloseStdin(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if p, ok := d.stdins[id]; ok {
+		p.Close()
+		delete(d.stdins, id)
+	}
+}
+
+// CloseStdins closes all stdin pipes of the connection
+func (d *ConnData) CloseStdins() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for id, p := range d.stdins {
+		p.Close()
+		delete(d.stdins, id)
+	}
+}
+
+// SetCommand adds the command running or attached on the connection, and makes it the latest
+func (d *ConnData) SetCommand(cmd *dcommand.Command) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.commands == nil {
+		d.commands = map[string]*dcommand.Command{}
+	}
+
+	d.commands[cmd.ID] = cmd
+	d.Cmd = cmd
+	d.CommandN = cmd.Cmd
+}
+
+// GetCommand returns the command by id, the latest one if id is empty
+func (d *ConnData) GetCommand(id string) *dcommand.Command {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if id == "" {
+		return d.Cmd
+	}
+
+	return d.commands[id]
+}
+
+func createWsService(cfg *Config, authenticator Authenticator) func(server websocket.Server) {
 	heartbeatTimeout := 30 * time.Second
-	authenticator := createAuthenticator(cfg)
 
 	return func(server websocket.Server) {
 		server.OnError(func(conn conn.Conn, err error) error {
@@ -71,42 +150,54 @@ func createWsService(cfg *Config) func(server websocket.Server) {
 
 		server.OnClose(func(conn conn.Conn, code int, message string) error {
 			logger.Infof("[ws][id: %s] connection close (code: %d, message: %s)", conn.ID(), code, message)
-
-			// enable cancel command when close
-			if cfg.IsCommandCancelOnCloseDisabled {
-				return nil
-			}
+			metricWebSocketConnections.Dec()
 
 			data, ok := conn.Get("state").(*ConnData)
 			if !ok {
 				return fmt.Errorf("failed to get state")
 			}
 
-			// if client disconnect, we want to canncel the command running
-			//	which means we want to kill the command when client disconnect
-			if data.Cmd != nil && data.Cmd.IsRunning() {
-				data.Cmd.State.IsKilledByClose = true
-
-				// // wait 1 second
-				// time.Sleep(1 * time.Second)
+			// no more stdin from the closed connection
+			data.CloseStdins()
 
-				if data.Cmd != nil {
-					data.Cmd.Cancel()
+			// detach from the streams, the command can be reattached by another connection
+			detached := []*CommandStream{}
+			commandStreams.ForEach(func(id string, stream *CommandStream) bool {
+				if stream.Detach(conn.ID()) {
+					detached = append(detached, stream)
 				}
+				return false
+			})
+
+			// enable cancel command when close
+			if cfg.IsCommandCancelOnCloseDisabled {
+				return nil
+			}
+
+			// if client disconnect, we want to canncel the command running
+			//	which means we want to kill the command when no client is attached
+			for _, stream := range detached {
+				cancelOrphanCommand(cfg, stream)
 			}
 
 			return nil
 		})
 
 		server.OnConnect(func(conn conn.Conn) error {
-			data := &ConnData{}
-			if cfg.ClientID == "" && cfg.ClientSecret == "" && cfg.AuthService == "" {
+			metricWebSocketConnections.Inc()
+
+			data := &ConnData{
+				Writer: NewMessageWriter(conn),
+			}
+			if !cfg.isAuthEnabled() {
 				data.IsAuthenticated = true
+				data.Identity = anonymous
 			}
 
 			data.AuthenticationTimeoutTimer = time.AfterFunc(30*time.Second, func() {
 				if !data.IsAuthenticated {
 					logger.Debugf("[ws][id: %s] authentication timeout", conn.ID())
+					metricAuthFailures.WithLabelValues(authFailureTimeout).Inc()
 
 					conn.Close()
 				}
@@ -124,6 +215,58 @@ func createWsService(cfg *Config) func(server websocket.Server) {
 		})
 
 		server.OnTextMessage(func(conn websocket.Conn, msg []byte) error {
+			// v2 envelope is converted to v1 message to handle, with command id kept,
+			//	v1 message has no command id, which applies to the latest command.
+			commandID := ""
+			if entities.IsEnvelope(msg) {
+				env, err := entities.DecodeEnvelope(msg)
+				if err != nil {
+					logger.Errorf("[ws][id: %s] invalid message: %s", conn.ID(), err)
+					return nil
+				}
+
+				if msg, err = env.Message(); err != nil {
+					logger.Errorf("[ws][id: %s] invalid message: %s", conn.ID(), err)
+					return nil
+				}
+				commandID = env.CommandID
+			}
+
+			// stdin is written in receiving order, so it cannot be handled in goroutine
+			if len(msg) > 0 && (msg[0] == entities.MessageCommandStdin || msg[0] == entities.MessageCommandStdinEOF) {
+				connState, ok := conn.Get("state").(*ConnData)
+				if !ok || !connState.IsAuthenticated {
+					return nil
+				}
+
+				if msg[0] == entities.MessageCommandStdinEOF {
+					return connState.Stdin(commandID).Close()
+				}
+
+				stdin := connState.Stdin(commandID)
+				if _, err := stdin.Write(msg[1:]); err != nil {
+					if err != errStdinBufferFull {
+						logger.Debugf("[ws][id: %s] failed to write stdin: %s", conn.ID(), err)
+						return nil
+					}
+
+					// the stdin is incomplete, the command is cancelled before stdin is closed,
+					//	so it does not run or finish with the partial stdin.
+					logger.Warnf("[ws][id: %s] failed to write stdin: %s", conn.ID(), err)
+					if dc := connState.GetCommand(commandID); dc != nil {
+						if stream := commandStreams.Get(dc.ID); stream != nil {
+							stream.Detach(conn.ID())
+						}
+						if err := dc.Cancel(); err != nil {
+							logger.Debugf("[ws][id: %s] failed to cancel command: %s", dc.ID, err)
+						}
+					}
+					stdin.Close()
+					connState.Writer.Fail(commandID, err.Error())
+				}
+				return nil
+			}
+
 			go func(conn websocket.Conn, msg []byte) (err error) {
 				defer func() {
 					if r := recover(); r != nil {
@@ -135,8 +278,9 @@ func createWsService(cfg *Config) func(server websocket.Server) {
 						fmt.Printf("Recovered: %v\n", r)
 						fmt.Printf("Stack trace:\n%s\n", buf[:n])
 
-						conn.WriteTextMessage(append([]byte{entities.MessageCommandStderr}, []byte(fmt.Sprintf("internal server error: %v\n", r))...))
-						conn.WriteTextMessage([]byte{entities.MessageCommandExitCode, byte(1)})
+						if connState, ok := conn.Get("state").(*ConnData); ok {
+							connState.Writer.Fail("", fmt.Sprintf("internal server error: %v", r))
+						}
 						return
 					}
 				}()
@@ -159,8 +303,15 @@ func createWsService(cfg *Config) func(server websocket.Server) {
 						return nil
 					}
 					connState.AuthenticationTimeoutTimer.Stop()
-					if err := authenticator(connState.AuthClient.ClientID, connState.AuthClient.ClientSecret); err != nil {
+					// the verified client certificate is the identity, unless credentials are given and accepted
+					identity := certIdentity(cfg, conn.Request())
+					var err error
+					if identity == nil || (cfg.isCredentialAuthEnabled() && hasCredentials(connState.AuthClient)) {
+						identity, err = authenticator(connState.AuthClient)
+					}
+					if err != nil {
 						logger.Errorf("[ws][id: %s] failed to authenticate => %v", conn.ID(), err)
+						auditWs(conn, &AuditEvent{Action: AuditActionAuthFailure, Identity: connState.AuthClient.ClientID, Reason: err.Error()})
 
 						conn.WriteTextMessage(append([]byte{entities.MessageAuthResponseFailure}, []byte(fmt.Sprintf("failed to authenticate: %s\n", err))...))
 						conn.WriteTextMessage([]byte{entities.MessageCommandExitCode, byte(1)})
@@ -169,27 +320,52 @@ func createWsService(cfg *Config) func(server websocket.Server) {
 					}
 
 					connState.IsAuthenticated = true
-					logger.Infof("[ws][id: %s] authenticated", conn.ID())
-					conn.WriteTextMessage([]byte{entities.MessageAuthResponseSuccess})
+					connState.Identity = identity
+					// the credential is verified once, with the same clock skew allowed
+					if identity.ExpiresAt != 0 {
+						connState.ExpiresAt = time.Unix(identity.ExpiresAt, 0).Add(jwtLeeway)
+					}
+					logger.Infof("[ws][id: %s] authenticated (identity: %s)", conn.ID(), identity.Name)
+					auditWs(conn, &AuditEvent{Action: AuditActionAuthSuccess, Identity: identity.Name})
+					version := negotiateVersion(connState.AuthClient.Version)
+					if version >= entities.ProtocolVersion2 {
+						response, _ := json.Marshal(&entities.AuthResponse{Version: version})
+						conn.WriteTextMessage(append([]byte{entities.MessageAuthResponseSuccess}, response...))
+					} else {
+						conn.WriteTextMessage([]byte{entities.MessageAuthResponseSuccess})
+					}
+					connState.Writer.SetVersion(version)
 				case entities.MessageCommand:
 					if !connState.IsAuthenticated {
 						logger.Errorf("[ws][id: %s] not authenticated", conn.ID())
-						conn.WriteTextMessage(append([]byte{entities.MessageCommandStderr}, []byte("not authenticated\n")...))
-						conn.WriteTextMessage([]byte{entities.MessageCommandExitCode, byte(1)})
+						metricAuthFailures.WithLabelValues(authFailureNotAuthenticated).Inc()
+						connState.Writer.Fail("", "not authenticated")
 						conn.Close()
 						return nil
 					}
 
+					if connState.IsExpired() {
+						logger.Infof("[ws][id: %s] credential expired", conn.ID())
+						metricAuthFailures.WithLabelValues(authFailureExpired).Inc()
+						connState.Writer.Fail(commandID, "credential expired")
+						return nil
+					}
+
+					if !connState.Identity.HasScope(ScopeExec) {
+						connState.Writer.Fail(commandID, fmt.Sprintf("permission denied: scope %s is required", ScopeExec))
+						return nil
+					}
+
 					commandN := &entities.Command{}
-					connState.CommandN = commandN
-					tmpScriptFilepath := ""
 					if err := json.Unmarshal(msg[1:], commandN); err != nil {
 						logger.Errorf("failed to unmarshal command request: %s", err)
 
-						conn.WriteTextMessage(append([]byte{entities.MessageCommandStderr}, []byte("invalid command request\n")...))
-						conn.WriteTextMessage([]byte{entities.MessageCommandExitCode, byte(1)})
+						connState.Writer.Fail(commandID, "invalid command request")
 						return nil
 					}
+					if commandN.ID == "" {
+						commandN.ID = commandID
+					}
 
 					// if commandN.Pipeline != nil {
 					// 	commandN.Pipeline.SetStdout(&WSClientWriter{Conn: conn, Flag: entities.MessageCommandStdout})
@@ -204,205 +380,123 @@ func createWsService(cfg *Config) func(server websocket.Server) {
 					// 	return nil
 					// }
 
-					dc, err := dcommand.New(func(c *dcommand.Config) {
-						c.ID = commandN.ID
-						if c.ID == "" {
-							c.ID = conn.ID()
-						}
-
-						c.Command = commandN
-
-						// cfg.Timeout is seconds, but command.Timeout is milliseconds
-						if cfg.Timeout != 0 {
-							c.Command.Timeout = cfg.Timeout * 1000
-						}
-
-						if c.Command.Shell == "" {
-							c.Command.Shell = cfg.Shell
-						}
-
-						// fix workdir
-						if c.Command.WorkDirBase == "" {
-							c.Command.WorkDirBase = cfg.WorkDir
-						}
-
-						if cfg.Environment != nil {
-							if c.Command.Environment == nil {
-								c.Command.Environment = map[string]string{}
-							}
-
-							for k, v := range cfg.Environment {
-								c.Command.Environment[k] = v
-							}
-						}
+					if commandN.ID == "" {
+						commandN.ID = conn.ID()
+					} else if err := validateCommandID(commandN.ID); err != nil {
+						connState.Writer.Fail(commandN.ID, err.Error())
+						return nil
+					}
 
-						if cfg.IsAutoReport {
-							c.IsAutoReport = cfg.IsAutoReport
-							c.SetAllowReportFunc(cfg.allowReportFunc)
-						}
-					})
+					dc, err := newDataCommand(cfg, commandN, connState.Identity.Caller(remoteAddrOf(conn.Request())))
 					if err != nil {
 						return fmt.Errorf("failed to create data command: %s", err)
 					}
-					connState.Cmd = dc
-					// set listener
-					dc.On("error", func(payload any) {
-						state.Command.Running.Dec(1)
-						state.Command.Error.Inc(1)
-					})
-					dc.On("run", func(payload any) {
-						state.Command.Running.Inc(1)
-					})
-					dc.On("cancel", func(payload any) {
-						state.Command.Running.Dec(1)
-						state.Command.Cancelled.Inc(1)
-					})
-					dc.On("complete", func(payload any) {
-						state.Command.Running.Dec(1)
-						state.Command.Completed.Inc(1)
-					})
-
-					commandsMap.Set(dc.ID, dc)
-					commandsIDList.LPush(dc.ID)
-					state.Command.Total.Inc(1)
-					//
 
-					cmdCfg, err := cfg.GetCommandConfig(dc.ID, commandN)
+					ticket, err := admitCommand(dc)
 					if err != nil {
-						logger.Errorf("failed to get command config: %s", err)
-						conn.WriteTextMessage(append([]byte{entities.MessageCommandStderr}, []byte("internal server error\n")...))
-						conn.WriteTextMessage([]byte{entities.MessageCommandExitCode, byte(1)})
+						logger.Warnf("[ws][id: %s] command rejected: %s", dc.ID, err)
+						connState.Writer.Fail(dc.ID, err.Error())
 						return nil
 					}
-					defer func() {
-						// clean work dir
-						if cfg.IsCleanWorkDirEnabled || commandN.EnableCleanWorkDir {
-							if ok := fs.IsExist(cmdCfg.WorkDir); ok {
-								logger.Infof("[command] clean work dir: %s", cmdCfg.WorkDir)
-								if err := fs.Remove(cmdCfg.WorkDir); err != nil {
-									logger.Warnf("failed to clean workdir(%s): %s", cmdCfg.WorkDir, err)
-								}
-							}
-						}
 
-						// clean metadata dir
-						if cfg.IsCleanMetadataDirEnabled || commandN.EnableCleanMetadataDir {
-							if ok := fs.IsExist(cmdCfg.MetadataDir); ok {
-								logger.Infof("[command] clean metadata dir: %s", cmdCfg.WorkDir)
-								if err := fs.Remove(cmdCfg.WorkDir); err != nil {
-									logger.Warnf("failed to clean metadatadir(%s): %s", cmdCfg.WorkDir, err)
-								}
-							}
-						}
-					}()
-
-					env := []string{}
-					environment := map[string]string{
-						// "HOME":    os.Getenv("HOME"),
-						// "USER":    os.Getenv("USER"),
-						// "LOGNAME": os.Getenv("LOGNAME"),
-						// "SHELL":   cfg.Shell,
-						// "TERM":    os.Getenv("TERM"),
-						// "PATH":    os.Getenv("PATH"),
-					}
-					if commandN.Environment != nil {
-						for k, v := range commandN.Environment {
-							environment[k] = v
-						}
-					}
-					if cfg.Environment != nil {
-						for k, v := range cfg.Environment {
-							environment[k] = v
+					run, err := startCommand(cfg, dc, ticket)
+					if err != nil {
+						logger.Errorf("[ws][id: %s] %s", dc.ID, err)
+						if err == errCommandExists {
+							connState.Writer.Fail(dc.ID, err.Error())
+							return nil
 						}
+
+						connState.Writer.Fail(dc.ID, "internal server error")
+						return nil
 					}
-					for k, v := range environment {
-						env = append(env, fmt.Sprintf("%s=%s", k, v))
-					}
+					connState.SetCommand(dc)
+					auditWs(conn, &AuditEvent{Action: AuditActionCommandCreate, Identity: connState.Identity.Name, CommandID: dc.ID})
 
-					// cmd, err := command.New(&command.Config{
-					// 	Command:     commandN.Script,
-					// 	Shell:       cfg.Shell,
-					// 	WorkDir:     cmdCfg.WorkDir,
-					// 	Environment: environment,
-					// 	User:        commandN.User,
-					// 	Engine:      commandN.Engine,
-					// 	Image:       commandN.Image,
-					// 	Memory:      commandN.Memory,
-					// 	CPU:         commandN.CPU,
-					// 	Platform:    commandN.Platform,
-					// 	Network:     commandN.Network,
-					// 	Privileged:  commandN.Privileged,
-					// })
-					// if err != nil {
-					// 	panic(fmt.Errorf("failed to create command (1): %s", err))
-					// }
-					// connState.Cmd = cmd
+					if commandN.Stdin {
+						dc.SetStdin(connState.Stdin(commandID))
+						defer connState.CloseStdin(commandID)
+					}
+					run.Stream.Attach(conn.ID(), &WSStreamSink{Writer: connState.Writer, ID: dc.ID}, -1)
 
-					dc.SetStdout(io.MultiWriter(cmdCfg.Log, &WSClientWriter{Conn: conn, Flag: entities.MessageCommandStdout}))
-					dc.SetStderr(io.MultiWriter(cmdCfg.Log, &WSClientWriter{Conn: conn, Flag: entities.MessageCommandStderr}))
-					defer cmdCfg.Log.Close()
+					err = run.Run(func(position int) {
+						logger.Infof("[ws][id: %s] command queued (position: %d)", dc.ID, position)
+						connState.Writer.Queued(dc.ID, position)
+					})
+					if err != nil {
+						return nil
+					}
 
-					logger.Infof("[ws][id: %s] command start to run ...", dc.ID)
-					cmdCfg.Script.WriteString(commandN.Script)
-					cmdCfg.Env.WriteString(strings.Join(env, "\n"))
-					cmdCfg.StartAt.WriteString(datetime.Now().Format("YYYY-MM-DD HH:mm:ss"))
+					if connState.HeartbeatTimeoutTimer != nil {
+						connState.HeartbeatTimeoutTimer.Stop()
+					}
 
-					if err = dc.Run(); err != nil {
-						cmdCfg.Error.WriteString(err.Error())
+					logger.Infof("[ws][id: %s] command succeed to run .", dc.ID)
+				case entities.MessageCommandAttachRequest:
+					if !connState.IsAuthenticated {
+						logger.Errorf("[ws][id: %s] not authenticated", conn.ID())
+						metricAuthFailures.WithLabelValues(authFailureNotAuthenticated).Inc()
+						connState.Writer.Fail("", "not authenticated")
+						conn.Close()
+						return nil
+					}
 
-						if dc.State.Status == "cancelled" {
-							cmdCfg.Status.WriteString("cancelled")
-							logger.Infof("[ws][id: %s] command cancelled", dc.ID)
-							// conn.WriteTextMessage([]byte{entities.MessageCommandExitCode, 127})
-							return nil
-						}
+					if connState.IsExpired() {
+						logger.Infof("[ws][id: %s] credential expired", conn.ID())
+						metricAuthFailures.WithLabelValues(authFailureExpired).Inc()
+						connState.Writer.Fail(commandID, "credential expired")
+						return nil
+					}
 
-						cmdCfg.FailedAt.WriteString(datetime.Now().Format("YYYY-MM-DD HH:mm:ss"))
-						cmdCfg.Status.WriteString("failure")
+					if !connState.Identity.HasScope(ScopeReadLogs) {
+						connState.Writer.Fail(commandID, fmt.Sprintf("permission denied: scope %s is required", ScopeReadLogs))
+						return nil
+					}
 
-						exitCode := 127
-						if errx, ok := err.(*errors.ExitError); ok {
-							exitCode = errx.ExitCode()
-						} else {
-							conn.WriteTextMessage(append([]byte{entities.MessageCommandStderr}, (err.Error() + "\n")...))
-						}
+					attachRequest := &entities.AttachRequest{}
+					if err := json.Unmarshal(msg[1:], attachRequest); err != nil {
+						logger.Errorf("failed to unmarshal attach request: %s", err)
 
-						logger.Errorf("[ws][id: %s] command failed to run (err: %v, exit code: %d)", dc.ID, err, exitCode)
-						conn.WriteTextMessage([]byte{entities.MessageCommandExitCode, byte(exitCode)})
+						connState.Writer.Fail("", "invalid attach request")
 						return nil
 					}
 
-					// connState.Cmd.State.IsCompleted = true
-
-					cmdCfg.SucceedAt.WriteString(datetime.Now().Format("YYYY-MM-DD HH:mm:ss"))
-					cmdCfg.Status.WriteString("success")
+					if err := attachCommand(cfg, conn, connState, attachRequest); err != nil {
+						logger.Errorf("[ws][id: %s] failed to attach command(%s): %s", conn.ID(), attachRequest.ID, err)
 
-					conn.WriteTextMessage([]byte{entities.MessageCommandExitCode, byte(0)})
+						connState.Writer.Fail(attachRequest.ID, fmt.Sprintf("failed to attach command: %s", err))
+						return nil
+					}
 
-					if tmpScriptFilepath != "" && fs.IsExist(tmpScriptFilepath) {
-						if err := fs.Remove(tmpScriptFilepath); err != nil {
-							panic(fmt.Errorf("failed to remove tmp script file: %s", err))
-						}
+					logger.Infof("[ws][id: %s] attached to command %s (offset: %d)", conn.ID(), attachRequest.ID, attachRequest.Offset)
+				case entities.MessageCommandCancelRequest:
+					if !connState.IsAuthenticated || !connState.Identity.HasScope(ScopeCancel) {
+						connState.Writer.Fail(commandID, fmt.Sprintf("permission denied: scope %s is required", ScopeCancel))
+						return nil
 					}
 
-					if connState.HeartbeatTimeoutTimer != nil {
-						connState.HeartbeatTimeoutTimer.Stop()
+					dc := connState.GetCommand(commandID)
+					if dc == nil {
+						connState.Writer.Fail(commandID, "command not found")
+						return nil
 					}
 
-					logger.Infof("[ws][id: %s] command succeed to run .", dc.ID)
-				case entities.MessageCommandCancelRequest:
-					// 更新状态
-					connState.Cmd.State.IsCancelled = true
+					auditWs(conn, &AuditEvent{Action: AuditActionCommandCancel, Identity: connState.Identity.Name, CommandID: dc.ID})
 
-					// wait 1 second
-					time.Sleep(1 * time.Second)
+					// the cancel response below is the exit of this connection
+					if stream := commandStreams.Get(dc.ID); stream != nil {
+						stream.Detach(conn.ID())
+					}
 
-					// if command is running, cancel it
-					if connState.Cmd != nil && !connState.Cmd.IsRunning() {
-						connState.Cmd.Cancel()
+					// the command not started yet refuses to run, the running one is killed
+					if err := dc.Cancel(); err != nil {
+						logger.Debugf("[ws][id: %s] failed to cancel command: %s", dc.ID, err)
 					}
-					conn.WriteTextMessage([]byte{entities.MessageCommandCancelResponse})
-					conn.WriteTextMessage([]byte{entities.MessageCommandExitCode, byte(0)})
+
+					// release the command waiting for stdin
+					connState.CloseStdin(commandID)
+					connState.Writer.Send(&entities.Envelope{Type: entities.EnvelopeTypeCancelResponse, CommandID: dc.ID})
+					connState.Writer.Exit(dc.ID, 0, "cancelled")
 				default:
 					logger.Errorf("unknown message type: %d", msg[0])
 				}
@@ -414,3 +508,93 @@ func createWsService(cfg *Config) func(server websocket.Server) {
 		})
 	}
 }
+
+// WSStreamSink is the stream sink of websocket connection
+type WSStreamSink struct {
+	Writer *MessageWriter
+	ID     string
+}
+
+// Stdout sends stdout to connection
+func (s *WSStreamSink) Stdout(p []byte) error {
+	return s.Writer.Stdout(s.ID, p)
+}
+
+// Stderr sends stderr to connection
+func (s *WSStreamSink) Stderr(p []byte) error {
+	return s.Writer.Stderr(s.ID, p)
+}
+
+// Exit sends exit code to connection
+func (s *WSStreamSink) Exit(code int, reason string) error {
+	return s.Writer.Exit(s.ID, code, reason)
+}
+
+// attachCommand attaches the connection to command, replays log from offset,
+//
+//	if the command has finished, only the rest log and exit code is sent.
+func attachCommand(cfg *Config, conn websocket.Conn, connState *ConnData, req *entities.AttachRequest) error {
+	if req.ID == "" {
+		return fmt.Errorf("id is required")
+	}
+
+	sink := &WSStreamSink{Writer: connState.Writer, ID: req.ID}
+	if stream := commandStreams.Get(req.ID); stream != nil {
+		if !connState.Identity.CanAccess(stream.Cmd) {
+			return fmt.Errorf("command not found")
+		}
+
+		connState.SetCommand(stream.Cmd)
+		return stream.Attach(conn.ID(), sink, req.Offset)
+	}
+
+	dc := getCommandOf(connState.Identity, req.ID)
+	if dc == nil {
+		return fmt.Errorf("command not found")
+	}
+
+	// running but no stream, it is not started by this agent
+	if dc.IsRunning() {
+		return fmt.Errorf("command is not attachable")
+	}
+
+	if req.Offset >= 0 {
+		if err := replayCommandLog(cfg, req.ID, sink, req.Offset); err != nil {
+			return err
+		}
+	}
+
+	reason := ""
+	state := dc.Snapshot()
+	if state != nil && state.Error != nil {
+		reason = state.Error.Error()
+	}
+
+	return sink.Exit(exitCodeOfState(state), reason)
+}
+
+// cancelOrphanCommand cancels the command which has no connection attached,
+//
+//	it waits for reattach if CommandReattachTimeout is set.
+func cancelOrphanCommand(cfg *Config, stream *CommandStream) {
+	cancel := func() {
+		if stream.HasSinks() {
+			return
+		}
+
+		dc := stream.Cmd
+		if dc == nil || !dc.IsRunning() {
+			return
+		}
+
+		logger.Infof("[ws][id: %s] no connection attached, cancel command", dc.ID)
+		dc.CancelByClose()
+	}
+
+	if cfg.CommandReattachTimeout <= 0 {
+		cancel()
+		return
+	}
+
+	time.AfterFunc(time.Duration(cfg.CommandReattachTimeout)*time.Second, cancel)
+}
@@ -0,0 +1,401 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-idp/agent/client"
+	"github.com/go-idp/agent/entities"
+	"github.com/go-zoox/websocket"
+	"github.com/go-zoox/zoox"
+	"github.com/go-zoox/zoox/defaults"
+	gorilla "github.com/gorilla/websocket"
+)
+
+// newTestWsServer starts a websocket command server, returns its ws address
+func newTestWsServer(t *testing.T, cfg *Config) string {
+	t.Helper()
+
+	if cfg.Shell == "" {
+		cfg.Shell = DefaultShell
+	}
+	if cfg.MetadataDir == "" {
+		cfg.MetadataDir = t.TempDir()
+	}
+	if cfg.WorkDir == "" {
+		cfg.WorkDir = t.TempDir()
+	}
+
+	wsServer, err := websocket.NewServer()
+	if err != nil {
+		t.Fatalf("failed to create websocket server: %v", err)
+	}
+	createWsService(cfg, createAuthenticator(cfg))(wsServer)
+
+	app := defaults.Application()
+	app.WebSocket("/", func(opt *zoox.WebSocketOption) {
+		opt.Server = wsServer
+	})
+
+	ts := httptest.NewServer(app)
+	t.Cleanup(ts.Close)
+
+	return "ws" + strings.TrimPrefix(ts.URL, "http")
+}
+
+func TestStdinPipe_ReadsUntilClose(t *testing.T) {
+	p := NewStdinPipe()
+	p.Write([]byte("hello "))
+	p.Write([]byte("world"))
+	p.Close()
+
+	got, err := io.ReadAll(p)
+	if err != nil {
+		t.Fatalf("failed to read stdin pipe: %v", err)
+	}
+	if string(got) != "hello world" {
+		t.Fatalf("unexpected stdin: %q", string(got))
+	}
+
+	if _, err := p.Write([]byte("x")); err == nil {
+		t.Fatalf("expected write after close to fail")
+	}
+}
+
+func TestStdinPipe_BufferLimit(t *testing.T) {
+	p := NewStdinPipe()
+	if _, err := p.Write(make([]byte, maxStdinBuffered)); err != nil {
+		t.Fatalf("failed to write stdin under limit: %v", err)
+	}
+	if _, err := p.Write([]byte("x")); err != errStdinBufferFull {
+		t.Fatalf("expected stdin buffer to be full, got %v", err)
+	}
+
+	// reading makes room
+	p.Read(make([]byte, 1))
+	if _, err := p.Write([]byte("x")); err != nil {
+		t.Fatalf("failed to write stdin after read: %v", err)
+	}
+}
+
+func TestWsService_StdinBufferFull(t *testing.T) {
+	addr := newTestWsServer(t, &Config{})
+
+	stderr := &lockedBuffer{}
+	c := client.New(&client.Config{
+		Server: addr,
+		Stdin:  bytes.NewReader(make([]byte, 2*maxStdinBuffered)),
+		Stdout: io.Discard,
+		Stderr: stderr,
+	})
+	if err := c.Connect(); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+
+	start := time.Now()
+	if err := c.Exec(&entities.Command{Script: "sleep 5; cat"}); err == nil {
+		t.Fatalf("expected command to fail when stdin buffer is full")
+	}
+	if time.Since(start) > 3*time.Second {
+		t.Fatalf("expected command to fail without waiting for it")
+	}
+	if !strings.Contains(stderr.String(), "stdin buffer is full") {
+		t.Fatalf("expected stdin buffer full error, got %q", stderr.String())
+	}
+}
+
+func TestWsService_StreamsStdin(t *testing.T) {
+	addr := newTestWsServer(t, &Config{})
+
+	stdout := &bytes.Buffer{}
+	c := client.New(&client.Config{
+		Server: addr,
+		Stdin:  strings.NewReader("line-1\nline-2\n"),
+		Stdout: stdout,
+		Stderr: io.Discard,
+	})
+	if err := c.Connect(); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+
+	if err := c.Exec(&entities.Command{Script: "cat"}); err != nil {
+		t.Fatalf("failed to exec: %v", err)
+	}
+
+	if stdout.String() != "line-1\nline-2\n" {
+		t.Fatalf("unexpected stdout: %q", stdout.String())
+	}
+}
+
+// lockedBuffer is a buffer safe to be written by client and read by test
+type lockedBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
+
+func waitForOutput(t *testing.T, b *lockedBuffer, expected string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(b.String(), expected) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %q, got %q", expected, b.String())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestWsService_ReattachAfterClose(t *testing.T) {
+	addr := newTestWsServer(t, &Config{CommandReattachTimeout: 10})
+
+	first := &lockedBuffer{}
+	c1 := client.New(&client.Config{Server: addr, Stdout: first, Stderr: io.Discard})
+	if err := c1.Connect(); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	go c1.Exec(&entities.Command{ID: "cmd-reattach", Script: "echo a; sleep 1; echo b"})
+
+	waitForOutput(t, first, "a\n")
+	c1.Close()
+
+	second := &lockedBuffer{}
+	c2 := client.New(&client.Config{Server: addr, Stdout: second, Stderr: io.Discard})
+	if err := c2.Connect(); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c2.Close()
+
+	if err := c2.Attach("cmd-reattach", 0); err != nil {
+		t.Fatalf("failed to attach: %v", err)
+	}
+	if second.String() != "a\nb\n" {
+		t.Fatalf("unexpected output after reattach: %q", second.String())
+	}
+
+	// attach to finished command gets the rest of log and exit code
+	c3 := client.New(&client.Config{Server: addr, Stdout: io.Discard, Stderr: io.Discard})
+	if err := c3.Connect(); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c3.Close()
+
+	if err := c3.Attach("cmd-reattach", 2); err != nil {
+		t.Fatalf("failed to attach finished command: %v", err)
+	}
+}
+
+func TestWsService_ConnectAgainAfterAuthFailure(t *testing.T) {
+	addr := newTestWsServer(t, &Config{ClientID: "ci", ClientSecret: "secret"})
+
+	cfg := &client.Config{Server: addr, ClientID: "ci", ClientSecret: "wrong", Stdout: io.Discard, Stderr: io.Discard}
+	c := client.New(cfg)
+	if err := c.Connect(); err == nil {
+		t.Fatalf("expected auth to fail with wrong secret")
+	}
+
+	// the attempt failed does not take the messages of the next one
+	cfg.ClientSecret = "secret"
+	if err := c.Connect(); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Exec(&entities.Command{Script: "true"})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("failed to exec: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for command after connecting again")
+	}
+}
+
+func TestWsService_CancelOrphanCommand(t *testing.T) {
+	addr := newTestWsServer(t, &Config{})
+
+	first := &lockedBuffer{}
+	c1 := client.New(&client.Config{Server: addr, Stdout: first, Stderr: io.Discard})
+	if err := c1.Connect(); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	go c1.Exec(&entities.Command{ID: "cmd-orphan", Script: "echo a; exec sleep 10"})
+
+	waitForOutput(t, first, "a\n")
+	c1.Close()
+
+	c2 := client.New(&client.Config{Server: addr, Stdout: io.Discard, Stderr: io.Discard})
+	if err := c2.Connect(); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c2.Close()
+
+	err := c2.Attach("cmd-orphan", -1)
+	if exitErr, ok := err.(*client.ExitError); !ok || exitErr.ExitCode != exitCodeCancelled {
+		t.Fatalf("expected command to be cancelled, got %v", err)
+	}
+}
+
+func TestWsService_ProtocolV2Envelope(t *testing.T) {
+	addr := newTestWsServer(t, &Config{})
+
+	conn, _, err := gorilla.DefaultDialer.Dial(addr, nil)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	auth, _ := json.Marshal(&entities.AuthRequest{Version: entities.ProtocolVersion2})
+	conn.WriteMessage(gorilla.TextMessage, append([]byte{entities.MessageAuthRequest}, auth...))
+
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("failed to read auth response: %v", err)
+	}
+	if msg[0] != entities.MessageAuthResponseSuccess || string(msg[1:]) != `{"version":2}` {
+		t.Fatalf("unexpected auth response: %q", string(msg))
+	}
+
+	payload, _ := json.Marshal(&entities.Command{ID: "cmd-v2", Script: "echo hi; exit 3"})
+	command, _ := json.Marshal(&entities.Envelope{Type: entities.EnvelopeTypeCommand, CommandID: "cmd-v2", Payload: payload})
+	conn.WriteMessage(gorilla.TextMessage, command)
+
+	envelopes := []*entities.Envelope{}
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("failed to read message: %v", err)
+		}
+		if !entities.IsEnvelope(msg) {
+			t.Fatalf("expected envelope, got %q", string(msg))
+		}
+
+		env, err := entities.DecodeEnvelope(msg)
+		if err != nil {
+			t.Fatalf("failed to decode envelope: %v", err)
+		}
+		envelopes = append(envelopes, env)
+
+		if env.Type == entities.EnvelopeTypeExit {
+			break
+		}
+	}
+
+	if len(envelopes) != 2 {
+		t.Fatalf("expected output and exit envelopes, got %d", len(envelopes))
+	}
+	output, exit := envelopes[0], envelopes[1]
+	if output.CommandID != "cmd-v2" || output.Stream != entities.StreamStdout || string(output.Data) != "hi\n" || output.Seq != 1 || output.Timestamp == 0 {
+		t.Fatalf("unexpected output envelope: %+v", output)
+	}
+	if exit.ExitCode != 3 || exit.Seq != 2 {
+		t.Fatalf("unexpected exit envelope: %+v", exit)
+	}
+}
+
+func TestWsService_ProtocolV1Compatible(t *testing.T) {
+	addr := newTestWsServer(t, &Config{})
+
+	stdout := &lockedBuffer{}
+	c := client.New(&client.Config{Server: addr, Stdout: stdout, Stderr: io.Discard, ProtocolVersion: entities.ProtocolVersion1})
+	if err := c.Connect(); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+
+	err := c.Exec(&entities.Command{Script: "echo hi; exit 3"})
+	if exitErr, ok := err.(*client.ExitError); !ok || exitErr.ExitCode != 3 {
+		t.Fatalf("expected exit code 3, got %v", err)
+	}
+	if stdout.String() != "hi\n" {
+		t.Fatalf("unexpected stdout: %q", stdout.String())
+	}
+}
+
+func TestWsService_MultiplexCommands(t *testing.T) {
+	addr := newTestWsServer(t, &Config{})
+
+	c := client.New(&client.Config{Server: addr, Stdout: io.Discard, Stderr: io.Discard})
+	if err := c.Connect(); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+
+	stdout1, stdout2 := &lockedBuffer{}, &lockedBuffer{}
+	e1, err := c.ExecAsync(&entities.Command{Script: "cat; exit 2"}, func(opt *client.ExecOption) {
+		opt.Stdin = strings.NewReader("from-1\n")
+		opt.Stdout = stdout1
+	})
+	if err != nil {
+		t.Fatalf("failed to exec: %v", err)
+	}
+	e2, err := c.ExecAsync(&entities.Command{Script: "echo from-2; exec sleep 10"}, func(opt *client.ExecOption) {
+		opt.Stdout = stdout2
+	})
+	if err != nil {
+		t.Fatalf("failed to exec: %v", err)
+	}
+
+	err = e1.Wait()
+	if exitErr, ok := err.(*client.ExitError); !ok || exitErr.ExitCode != 2 {
+		t.Fatalf("expected exit code 2, got %v", err)
+	}
+	if stdout1.String() != "from-1\n" {
+		t.Fatalf("unexpected stdout of first command: %q", stdout1.String())
+	}
+
+	waitForOutput(t, stdout2, "from-2\n")
+	if err := e2.Cancel(); err != nil {
+		t.Fatalf("failed to cancel: %v", err)
+	}
+	if stdout2.String() != "from-2\n" {
+		t.Fatalf("unexpected stdout of second command: %q", stdout2.String())
+	}
+}
+
+func TestWsService_MultiplexRequiresV2(t *testing.T) {
+	addr := newTestWsServer(t, &Config{})
+
+	stdout := &lockedBuffer{}
+	c := client.New(&client.Config{Server: addr, Stdout: stdout, Stderr: io.Discard, ProtocolVersion: entities.ProtocolVersion1})
+	if err := c.Connect(); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+
+	e, err := c.ExecAsync(&entities.Command{Script: "echo started; exec sleep 10"})
+	if err != nil {
+		t.Fatalf("failed to exec: %v", err)
+	}
+	waitForOutput(t, stdout, "started\n")
+	if _, err := c.ExecAsync(&entities.Command{Script: "true"}); err == nil {
+		t.Fatalf("expected second command to be rejected in protocol v1")
+	}
+
+	if err := e.Cancel(); err != nil {
+		t.Fatalf("failed to cancel: %v", err)
+	}
+}